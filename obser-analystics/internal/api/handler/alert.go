@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"kuroko.com/analystics/internal/model"
+	"kuroko.com/analystics/internal/service"
+)
+
+// alertError maps the errors of the alert, notification and slo services to a status code
+func alertError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, service.ErrInvalidAlertRule), errors.Is(err, service.ErrInvalidChannel), errors.Is(err, service.ErrInvalidSLO):
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	case errors.Is(err, service.ErrAlertNotFound), errors.Is(err, service.ErrSLONotFound):
+		return c.JSON(404, model.Error{Message: err.Error(), Code: 404})
+	}
+	return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
+}
+
+// @Summary		List alert rules
+// @Description	List alert rules
+// @Tags			alert
+// @Produce		json
+// @Success		200	{object}	[]model.AlertRule
+// @Failure		500	{object}	model.Error
+// @Router			/alert-rules [get]
+func (h *Handler) GetAlertRulesHandler(c echo.Context) error {
+	res, err := h.service.FindAllAlertRules(c.Request().Context())
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Get alert rule
+// @Description	Get alert rule
+// @Tags			alert
+// @Produce		json
+// @Param			id	path		string	true	"Rule Id"
+// @Success		200	{object}	model.AlertRule
+// @Failure		404	{object}	model.Error
+// @Failure		500	{object}	model.Error
+// @Router			/alert-rules/{id} [get]
+func (h *Handler) GetAlertRuleHandler(c echo.Context) error {
+	res, err := h.service.GetAlertRule(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Create alert rule
+// @Description	Create a rule on the error rate, a latency quantile, the request rate or its drop of an API, path or hop
+// @Tags			alert
+// @Accept			json
+// @Produce		json
+// @Param			rule	body		model.AlertRule	true	"Rule"
+// @Success		201		{object}	model.AlertRule
+// @Failure		400		{object}	model.Error
+// @Failure		500		{object}	model.Error
+// @Router			/alert-rules [post]
+func (h *Handler) CreateAlertRuleHandler(c echo.Context) error {
+	var rule model.AlertRule
+	if err := c.Bind(&rule); err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
+	res, err := h.service.CreateAlertRule(c.Request().Context(), &rule)
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(201, res)
+}
+
+// @Summary		Update alert rule
+// @Description	Replace an alert rule, its state starts over
+// @Tags			alert
+// @Accept			json
+// @Produce		json
+// @Param			id		path		string			true	"Rule Id"
+// @Param			rule	body		model.AlertRule	true	"Rule"
+// @Success		200		{object}	model.AlertRule
+// @Failure		400		{object}	model.Error
+// @Failure		404		{object}	model.Error
+// @Failure		500		{object}	model.Error
+// @Router			/alert-rules/{id} [put]
+func (h *Handler) UpdateAlertRuleHandler(c echo.Context) error {
+	var rule model.AlertRule
+	if err := c.Bind(&rule); err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
+	res, err := h.service.UpdateAlertRule(c.Request().Context(), c.Param("id"), &rule)
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Delete alert rule
+// @Description	Delete alert rule
+// @Tags			alert
+// @Param			id	path	string	true	"Rule Id"
+// @Success		204
+// @Failure		404	{object}	model.Error
+// @Failure		500	{object}	model.Error
+// @Router			/alert-rules/{id} [delete]
+func (h *Handler) DeleteAlertRuleHandler(c echo.Context) error {
+	if err := h.service.DeleteAlertRule(c.Request().Context(), c.Param("id")); err != nil {
+		return alertError(c, err)
+	}
+	return c.NoContent(204)
+}
+
+// @Summary		Alert states
+// @Description	Every rule with its latest state: ok, pending, firing or no_data
+// @Tags			alert
+// @Produce		json
+// @Success		200	{object}	[]model.AlertStatus
+// @Failure		500	{object}	model.Error
+// @Router			/alerts [get]
+func (h *Handler) GetAlertStatusesHandler(c echo.Context) error {
+	res, err := h.service.FindAlertStatuses(c.Request().Context())
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Alert history
+// @Description	Firing and resolved events, latest first
+// @Tags			alert
+// @Produce		json
+// @Param			rule_id	query		string	false	"Rule Id"
+// @Param			from	query		string	false	"from, milisecond, default 24h ago"
+// @Param			to		query		string	false	"to, milisecond, default now"
+// @Param			limit	query		string	false	"Limit, default 100"
+// @Success		200		{object}	[]model.AlertEvent
+// @Failure		400		{object}	model.Error
+// @Failure		500		{object}	model.Error
+// @Router			/alerts/history [get]
+func (h *Handler) GetAlertHistoryHandler(c echo.Context) error {
+	to := time.Now().UnixMilli()
+	from := to - (24 * time.Hour).Milliseconds()
+	limit := int64(100)
+	ints := map[string]*int64{
+		"from":  &from,
+		"to":    &to,
+		"limit": &limit,
+	}
+	for name, dst := range ints {
+		if v := c.QueryParam(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return c.JSON(400, model.Error{Message: "invalid " + name, Code: 400})
+			}
+			*dst = n
+		}
+	}
+	res, err := h.service.FindAlertHistory(c.Request().Context(), c.QueryParam("rule_id"), from, to, limit)
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		List alert silences
+// @Description	List alert silences
+// @Tags			alert
+// @Produce		json
+// @Success		200	{object}	[]model.AlertSilence
+// @Failure		500	{object}	model.Error
+// @Router			/alert-silences [get]
+func (h *Handler) GetAlertSilencesHandler(c echo.Context) error {
+	res, err := h.service.FindAlertSilences(c.Request().Context())
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Create alert silence
+// @Description	Mute one rule, or every rule whose target matches the set target fields, until ends_at or forever
+// @Tags			alert
+// @Accept			json
+// @Produce		json
+// @Param			silence	body		model.AlertSilence	true	"Silence"
+// @Success		201		{object}	model.AlertSilence
+// @Failure		400		{object}	model.Error
+// @Failure		500		{object}	model.Error
+// @Router			/alert-silences [post]
+func (h *Handler) CreateAlertSilenceHandler(c echo.Context) error {
+	var silence model.AlertSilence
+	if err := c.Bind(&silence); err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
+	res, err := h.service.CreateAlertSilence(c.Request().Context(), &silence)
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(201, res)
+}
+
+// @Summary		Delete alert silence
+// @Description	Delete alert silence
+// @Tags			alert
+// @Param			id	path	string	true	"Silence Id"
+// @Success		204
+// @Failure		404	{object}	model.Error
+// @Failure		500	{object}	model.Error
+// @Router			/alert-silences/{id} [delete]
+func (h *Handler) DeleteAlertSilenceHandler(c echo.Context) error {
+	if err := h.service.DeleteAlertSilence(c.Request().Context(), c.Param("id")); err != nil {
+		return alertError(c, err)
+	}
+	return c.NoContent(204)
+}
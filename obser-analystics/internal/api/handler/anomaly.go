@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"kuroko.com/analystics/internal/model"
+)
+
+// @Summary		Anomalies
+// @Description	APIs and paths whose hourly latency, error rate or request rate deviate from their seasonal baseline, worst first
+// @Tags			anomaly
+// @Produce		json
+// @Param			from	query		string	false	"from, milisecond, default 24h ago"
+// @Param			to		query		string	false	"to, milisecond, default now"
+// @Param			kind	query		string	false	"api or path, default both"
+// @Param			metric	query		string	false	"latency, error_rate or request_rate, default all"
+// @Param			limit	query		string	false	"Limit, default 50"
+// @Success		200		{object}	[]model.AnomalySeries
+// @Failure		400		{object}	model.Error
+// @Failure		500		{object}	model.Error
+// @Router			/anomalies [get]
+func (h *Handler) GetAnomaliesHandler(c echo.Context) error {
+	to := time.Now().UnixMilli()
+	from := to - (24 * time.Hour).Milliseconds()
+	limit := int64(50)
+	ints := map[string]*int64{
+		"from":  &from,
+		"to":    &to,
+		"limit": &limit,
+	}
+	for name, dst := range ints {
+		if v := c.QueryParam(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return c.JSON(400, model.Error{Message: "invalid " + name, Code: 400})
+			}
+			*dst = n
+		}
+	}
+	if from > to {
+		return c.JSON(400, model.Error{Message: "from must not be after to", Code: 400})
+	}
+	kind := c.QueryParam("kind")
+	if kind != "" && kind != "api" && kind != "path" {
+		return c.JSON(400, model.Error{Message: "kind must be api or path", Code: 400})
+	}
+	metric := c.QueryParam("metric")
+	switch metric {
+	case "", model.AlertMetricLatency, model.AlertMetricErrorRate, model.AlertMetricRequestRate:
+	default:
+		return c.JSON(400, model.Error{Message: "metric must be latency, error_rate or request_rate", Code: 400})
+	}
+	res, err := h.service.FindAnomalies(c.Request().Context(), kind, metric, from, to, limit)
+	if err != nil {
+		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
+	}
+	return c.JSON(200, res)
+}
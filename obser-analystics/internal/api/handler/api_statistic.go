@@ -1,10 +1,14 @@
 package handler
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"kuroko.com/analystics/internal/model"
+	"kuroko.com/analystics/internal/service"
 )
 
 // @Summary		Get Api Statistic
@@ -18,7 +22,9 @@ import (
 // @Param			from			query		string	true	"From"
 // @Param			to				query		string	true	"To"
 // @Param			unit			query		string	true	"Unit"
+// @Param			quantiles		query		string	false	"Comma separated latency quantiles, default 0.5,0.95,0.99"
 // @Success		200				{object}	model.ApiStatistic
+// @Failure		400				{object}	model.Error
 // @Failure		500				{object}	model.Error
 // @Router			/api-statistics [get]
 func (h *Handler) GetApiStatisticHandler(c echo.Context) error {
@@ -28,8 +34,12 @@ func (h *Handler) GetApiStatisticHandler(c echo.Context) error {
 	from := c.QueryParam("from")
 	to := c.QueryParam("to")
 	unit := c.QueryParam("unit")
+	quantiles, err := parseQuantiles(c)
+	if err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
 
-	res, err := h.service.GetApiStatisticService(c.Request().Context(), serviceName, uri_path, method, from, to, unit)
+	res, err := h.service.GetApiStatisticService(c.Request().Context(), serviceName, uri_path, method, from, to, unit, quantiles)
 	if err != nil {
 		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
 	}
@@ -249,39 +259,51 @@ func (h *Handler) OnlineUserHandler(c echo.Context) error {
 }
 
 // @Summary		Service Statistic
-// @Description	Service Statistic
+// @Description	Non-GET requests of the services by hour of the day, aggregated daily by the processor
 // @Tags			api
 // @Accept			json
 // @Produce		json
-// @Param			date			query		string	true	"Date"
-// @Param			service			query		string	true	"Service"
+// @Param			date			query		string	true	"Date, yyyyMMdd"
+// @Param			service			query		string	false	"Service"
 // @Success		200				{object}	[]model.ServiceStatisticObject
+// @Failure		400				{object}	model.Error
 // @Failure		500				{object}	model.Error
 // @Router			/service-statistic [get]
 func (h *Handler) ServiceStatisticHandler(c echo.Context) error {
 	date := c.QueryParam("date")
+	if _, err := time.Parse("20060102", date); err != nil {
+		return c.JSON(400, model.Error{Message: "date must be formatted yyyyMMdd", Code: 400})
+	}
 	svc := c.QueryParam("service")
 	var rs []model.ServiceStatisticObject
+	var err error
 	if svc == "" {
-		rs, _ = h.service.FindServiceStatisticByDate(c.Request().Context(), date)
+		rs, err = h.service.FindServiceStatisticByDate(c.Request().Context(), date)
 	} else {
-		rs, _ = h.service.FindServiceStatisticByDateAndName(c.Request().Context(), date, svc)
+		rs, err = h.service.FindServiceStatisticByDateAndName(c.Request().Context(), date, svc)
+	}
+	if err != nil {
+		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
 	}
 	return c.JSON(200, rs)
 }
 
 // @Summary		Uri Statistic
-// @Description	Uri Statistic
+// @Description	Requests of the non-GET APIs by hour of the day, aggregated daily by the processor
 // @Tags			api
 // @Accept			json
 // @Produce		json
-// @Param			date			query		string	true	"Date"
-// @Param			uri			query		string	true	"Uri"
+// @Param			date			query		string	true	"Date, yyyyMMdd"
+// @Param			uri			query		string	false	"Uri"
 // @Success		200				{object}	[]model.URIStatisticObject
+// @Failure		400				{object}	model.Error
 // @Failure		500				{object}	model.Error
 // @Router			/uri-statistic [get]
 func (h *Handler) UriStatisticHandler(c echo.Context) error {
 	date := c.QueryParam("date")
+	if _, err := time.Parse("20060102", date); err != nil {
+		return c.JSON(400, model.Error{Message: "date must be formatted yyyyMMdd", Code: 400})
+	}
 	uri := c.QueryParam("uri")
 	var rs []model.URIStatisticObject
 	var err error
@@ -339,3 +361,21 @@ func (h *Handler) UsageHandler(c echo.Context) error {
 
 	return c.JSON(200, rs)
 }
+
+// parseQuantiles reads the quantiles query parameter, a comma separated list of
+// numbers in (0, 1]
+func parseQuantiles(c echo.Context) ([]float64, error) {
+	v := c.QueryParam("quantiles")
+	if v == "" {
+		return service.DefaultQuantiles, nil
+	}
+	var quantiles []float64
+	for _, s := range strings.Split(v, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || q <= 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile %q", s)
+		}
+		quantiles = append(quantiles, q)
+	}
+	return quantiles, nil
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"github.com/labstack/echo/v4"
+	"kuroko.com/analystics/internal/model"
+)
+
+// @Summary		Get dependency graph
+// @Description	Service or operation call graph over all paths with call count, error rate and latency percentiles per edge
+// @Tags			dependencies
+// @Accept			json
+// @Produce		json
+// @Param			from	query		string	true	"from, milisecond"
+// @Param			to		query		string	true	"to, milisecond"
+// @Param			level	query		string	false	"service (default) or operation"
+// @Param			quantiles	query	string	false	"Comma separated latency quantiles, default 0.5,0.95,0.99"
+// @Success		200		{object}	model.DependencyGraph
+// @Failure		400		{object}	model.Error
+// @Failure		500		{object}	model.Error
+// @Router			/dependencies [get]
+func (h *Handler) GetDependencyGraphHandler(c echo.Context) error {
+	from := c.QueryParam("from")
+	to := c.QueryParam("to")
+	level := c.QueryParam("level")
+	if level == "" {
+		level = "service"
+	}
+	if level != "service" && level != "operation" {
+		return c.JSON(400, model.Error{Message: "level must be service or operation", Code: 400})
+	}
+
+	quantiles, err := parseQuantiles(c)
+	if err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
+
+	res, err := h.service.GetDependencyGraph(c.Request().Context(), from, to, level, quantiles)
+	if err != nil {
+		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
+	}
+	return c.JSON(200, res)
+}
@@ -16,12 +16,17 @@ func NewHandler(service *service.Service) *Handler {
 func (h *Handler) RegisterRoutes(v1 *echo.Group) {
 	// user view specific path then click view traces and view specific trace
 	v1.GET("/paths/:path_id/traces", h.getAllTracesOfPath)
+	v1.GET("/traces", h.searchTraces)
+	v1.GET("/traces/compare", h.compareTraces)
 	v1.GET("/traces/:trace_id", h.getTraceById)
+	v1.GET("/traces/:trace_id/critical-path", h.getCriticalPath)
 
 	v1.POST("/paths", h.GetAllPathFromOperationsHandler)
 	v1.GET("/paths/:path_id", h.GetPathDetailByIdHandler)
+	v1.GET("/paths/:path_id/latency-breakdown", h.GetPathLatencyBreakdownHandler)
 	v1.GET("/paths/long", h.GetLongPathHandler)
 	v1.GET("/hops/:hop_id", h.GetHopDetailByIdHandler)
+	v1.GET("/dependencies", h.GetDependencyGraphHandler)
 
 	v1.GET("/services/:service_name/operations", h.GetAllOperationsFromServiceHandler)
 	v1.GET("/services", h.GetAllServicesHandler)
@@ -38,6 +43,30 @@ func (h *Handler) RegisterRoutes(v1 *echo.Group) {
 	v1.GET("/get-alert", h.GetAlertHandler)
 	v1.GET("/uri-list", h.GetUriListHandler)
 	v1.PATCH("/ignore-alert/:id", h.IgnoreAlertHandler)
+	v1.GET("/alert-rules", h.GetAlertRulesHandler)
+	v1.POST("/alert-rules", h.CreateAlertRuleHandler)
+	v1.GET("/alert-rules/:id", h.GetAlertRuleHandler)
+	v1.PUT("/alert-rules/:id", h.UpdateAlertRuleHandler)
+	v1.DELETE("/alert-rules/:id", h.DeleteAlertRuleHandler)
+	v1.GET("/alerts", h.GetAlertStatusesHandler)
+	v1.GET("/alerts/history", h.GetAlertHistoryHandler)
+	v1.GET("/alert-silences", h.GetAlertSilencesHandler)
+	v1.POST("/alert-silences", h.CreateAlertSilenceHandler)
+	v1.DELETE("/alert-silences/:id", h.DeleteAlertSilenceHandler)
+	v1.GET("/notification-channels", h.GetNotificationChannelsHandler)
+	v1.POST("/notification-channels", h.CreateNotificationChannelHandler)
+	v1.GET("/notification-channels/:id", h.GetNotificationChannelHandler)
+	v1.PUT("/notification-channels/:id", h.UpdateNotificationChannelHandler)
+	v1.DELETE("/notification-channels/:id", h.DeleteNotificationChannelHandler)
+	v1.POST("/notification-channels/:id/test", h.TestNotificationChannelHandler)
+	v1.GET("/notifications", h.GetNotificationsHandler)
+	v1.GET("/anomalies", h.GetAnomaliesHandler)
+	v1.GET("/slos", h.GetSLOsHandler)
+	v1.POST("/slos", h.CreateSLOHandler)
+	v1.GET("/slos/:id", h.GetSLOHandler)
+	v1.PUT("/slos/:id", h.UpdateSLOHandler)
+	v1.DELETE("/slos/:id", h.DeleteSLOHandler)
+	v1.GET("/slos/:id/history", h.GetSLOHistoryHandler)
 	// v1.GET("/online-time", h.OnlineTimeHandler)
 	// v1.GET("/online-user", h.OnlineUserHandler)
 	v1.GET("/service-statistic", h.ServiceStatisticHandler)
@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"kuroko.com/analystics/internal/model"
+)
+
+// RegisterJaegerRoutes mounts the Jaeger query API, Jaeger UI and Grafana's Jaeger
+// datasource use the group prefix as their base url
+func (h *Handler) RegisterJaegerRoutes(g *echo.Group) {
+	g.GET("/services", h.JaegerServicesHandler)
+	g.GET("/services/:service_name/operations", h.JaegerOperationsHandler)
+	g.GET("/traces", h.JaegerFindTracesHandler)
+	g.GET("/traces/:trace_id", h.JaegerTraceHandler)
+	g.GET("/dependencies", h.JaegerDependenciesHandler)
+}
+
+func jaegerError(c echo.Context, code int, err error) error {
+	return c.JSON(code, model.JaegerResponse{
+		Errors: []model.JaegerError{{Code: code, Msg: err.Error()}},
+	})
+}
+
+// @Summary		Jaeger services
+// @Description	List services in the Jaeger query format
+// @Tags			jaeger
+// @Produce		json
+// @Success		200	{object}	model.JaegerResponse
+// @Failure		500	{object}	model.JaegerResponse
+// @Router			/jaeger/api/services [get]
+func (h *Handler) JaegerServicesHandler(c echo.Context) error {
+	res, err := h.service.GetAllServices(c.Request().Context())
+	if err != nil {
+		return jaegerError(c, 500, err)
+	}
+	if res == nil {
+		res = []string{}
+	}
+	return c.JSON(200, model.JaegerResponse{Data: res, Total: len(res)})
+}
+
+// @Summary		Jaeger operations
+// @Description	List operations of a service in the Jaeger query format
+// @Tags			jaeger
+// @Produce		json
+// @Param			service_name	path		string	true	"Service Name"
+// @Success		200				{object}	model.JaegerResponse
+// @Failure		500				{object}	model.JaegerResponse
+// @Router			/jaeger/api/services/:service_name/operations [get]
+func (h *Handler) JaegerOperationsHandler(c echo.Context) error {
+	res, err := h.service.GetAllOperationsFromService(c.Request().Context(), c.Param("service_name"))
+	if err != nil {
+		return jaegerError(c, 500, err)
+	}
+	if res == nil {
+		res = []string{}
+	}
+	return c.JSON(200, model.JaegerResponse{Data: res, Total: len(res)})
+}
+
+// @Summary		Jaeger trace search
+// @Description	Search traces in the Jaeger query format, start and end are in microseconds
+// @Tags			jaeger
+// @Produce		json
+// @Param			service		query		string	false	"Service"
+// @Param			operation	query		string	false	"Operation"
+// @Param			tags		query		string	false	"JSON object of tags"
+// @Param			minDuration	query		string	false	"Minimum duration, e.g. 100ms"
+// @Param			maxDuration	query		string	false	"Maximum duration, e.g. 2s"
+// @Param			start		query		string	false	"Start"
+// @Param			end			query		string	false	"End"
+// @Param			lookback	query		string	false	"Lookback when start is missing, e.g. 1h"
+// @Param			limit		query		string	false	"Limit"
+// @Success		200			{object}	model.JaegerResponse
+// @Failure		400			{object}	model.JaegerResponse
+// @Failure		500			{object}	model.JaegerResponse
+// @Router			/jaeger/api/traces [get]
+func (h *Handler) JaegerFindTracesHandler(c echo.Context) error {
+	q, err := parseJaegerTraceQuery(c)
+	if err != nil {
+		return jaegerError(c, 400, err)
+	}
+	res, err := h.service.FindJaegerTraces(c.Request().Context(), q)
+	if err != nil {
+		return jaegerError(c, 500, err)
+	}
+	return c.JSON(200, model.JaegerResponse{Data: res, Total: len(res), Limit: q.Limit})
+}
+
+// @Summary		Jaeger trace
+// @Description	Get a trace in the Jaeger query format
+// @Tags			jaeger
+// @Produce		json
+// @Param			trace_id	path		string	true	"Trace Id"
+// @Success		200			{object}	model.JaegerResponse
+// @Failure		404			{object}	model.JaegerResponse
+// @Failure		500			{object}	model.JaegerResponse
+// @Router			/jaeger/api/traces/:trace_id [get]
+func (h *Handler) JaegerTraceHandler(c echo.Context) error {
+	traceId := c.Param("trace_id")
+	res, err := h.service.GetJaegerTrace(c.Request().Context(), traceId)
+	if err != nil {
+		return jaegerError(c, 500, err)
+	}
+	if res == nil {
+		return c.JSON(404, model.JaegerResponse{
+			Errors: []model.JaegerError{{Code: 404, Msg: "trace not found", TraceID: traceId}},
+		})
+	}
+	return c.JSON(200, model.JaegerResponse{Data: []*model.JaegerTrace{res}, Total: 1})
+}
+
+// @Summary		Jaeger dependencies
+// @Description	Service call counts in the Jaeger query format, endTs and lookback are in milliseconds
+// @Tags			jaeger
+// @Produce		json
+// @Param			endTs		query		string	false	"End"
+// @Param			lookback	query		string	false	"Lookback"
+// @Success		200			{object}	model.JaegerResponse
+// @Failure		400			{object}	model.JaegerResponse
+// @Failure		500			{object}	model.JaegerResponse
+// @Router			/jaeger/api/dependencies [get]
+func (h *Handler) JaegerDependenciesHandler(c echo.Context) error {
+	endTs := time.Now().UnixMilli()
+	lookback := int64(24 * time.Hour / time.Millisecond)
+	var err error
+	if v := c.QueryParam("endTs"); v != "" {
+		if endTs, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return jaegerError(c, 400, fmt.Errorf("invalid endTs: %w", err))
+		}
+	}
+	if v := c.QueryParam("lookback"); v != "" {
+		if lookback, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return jaegerError(c, 400, fmt.Errorf("invalid lookback: %w", err))
+		}
+	}
+	res, err := h.service.GetJaegerDependencies(c.Request().Context(), endTs-lookback, endTs)
+	if err != nil {
+		return jaegerError(c, 500, err)
+	}
+	return c.JSON(200, model.JaegerResponse{Data: res, Total: len(res)})
+}
+
+func parseJaegerTraceQuery(c echo.Context) (*model.JaegerTraceQuery, error) {
+	q := &model.JaegerTraceQuery{
+		Service:   c.QueryParam("service"),
+		Operation: c.QueryParam("operation"),
+		Tags:      map[string]string{},
+		Limit:     20,
+	}
+	// Jaeger UI sends "all" when no operation is selected
+	if q.Operation == "all" {
+		q.Operation = ""
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit %q", v)
+		}
+		q.Limit = limit
+	}
+
+	var err error
+	if q.MinDuration, err = parseJaegerDuration(c.QueryParam("minDuration")); err != nil {
+		return nil, fmt.Errorf("invalid minDuration: %w", err)
+	}
+	if q.MaxDuration, err = parseJaegerDuration(c.QueryParam("maxDuration")); err != nil {
+		return nil, fmt.Errorf("invalid maxDuration: %w", err)
+	}
+
+	q.End = time.Now().UnixMicro()
+	if v := c.QueryParam("end"); v != "" {
+		if q.End, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid end: %w", err)
+		}
+	}
+	lookback := time.Hour
+	if v := c.QueryParam("lookback"); v != "" && v != "custom" {
+		if lookback, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid lookback: %w", err)
+		}
+	}
+	q.Start = q.End - lookback.Microseconds()
+	if v := c.QueryParam("start"); v != "" {
+		if q.Start, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid start: %w", err)
+		}
+	}
+
+	// tags is a JSON object, the older tag parameter repeats key:value pairs
+	if v := c.QueryParam("tags"); v != "" {
+		if err := json.Unmarshal([]byte(v), &q.Tags); err != nil {
+			return nil, fmt.Errorf("invalid tags: %w", err)
+		}
+	}
+	for _, tag := range c.QueryParams()["tag"] {
+		key, value, ok := strings.Cut(tag, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		q.Tags[key] = value
+	}
+	return q, nil
+}
+
+// parseJaegerDuration converts a Go duration such as 1.2s to microseconds
+func parseJaegerDuration(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	return d.Microseconds(), nil
+}
@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"kuroko.com/analystics/internal/model"
+)
+
+// @Summary		List notification channels
+// @Description	List notification channels
+// @Tags			notification
+// @Produce		json
+// @Success		200	{object}	[]model.NotificationChannel
+// @Failure		500	{object}	model.Error
+// @Router			/notification-channels [get]
+func (h *Handler) GetNotificationChannelsHandler(c echo.Context) error {
+	res, err := h.service.FindAllNotificationChannels(c.Request().Context())
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Get notification channel
+// @Description	Get notification channel
+// @Tags			notification
+// @Produce		json
+// @Param			id	path		string	true	"Channel Id"
+// @Success		200	{object}	model.NotificationChannel
+// @Failure		404	{object}	model.Error
+// @Failure		500	{object}	model.Error
+// @Router			/notification-channels/{id} [get]
+func (h *Handler) GetNotificationChannelHandler(c echo.Context) error {
+	res, err := h.service.GetNotificationChannel(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Create notification channel
+// @Description	Create a webhook, slack, email or nats channel, alert rules route to it by id in channels
+// @Tags			notification
+// @Accept			json
+// @Produce		json
+// @Param			channel	body		model.NotificationChannel	true	"Channel"
+// @Success		201		{object}	model.NotificationChannel
+// @Failure		400		{object}	model.Error
+// @Failure		500		{object}	model.Error
+// @Router			/notification-channels [post]
+func (h *Handler) CreateNotificationChannelHandler(c echo.Context) error {
+	var ch model.NotificationChannel
+	if err := c.Bind(&ch); err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
+	res, err := h.service.CreateNotificationChannel(c.Request().Context(), &ch)
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(201, res)
+}
+
+// @Summary		Update notification channel
+// @Description	Replace a notification channel
+// @Tags			notification
+// @Accept			json
+// @Produce		json
+// @Param			id		path		string						true	"Channel Id"
+// @Param			channel	body		model.NotificationChannel	true	"Channel"
+// @Success		200		{object}	model.NotificationChannel
+// @Failure		400		{object}	model.Error
+// @Failure		404		{object}	model.Error
+// @Failure		500		{object}	model.Error
+// @Router			/notification-channels/{id} [put]
+func (h *Handler) UpdateNotificationChannelHandler(c echo.Context) error {
+	var ch model.NotificationChannel
+	if err := c.Bind(&ch); err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
+	res, err := h.service.UpdateNotificationChannel(c.Request().Context(), c.Param("id"), &ch)
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Delete notification channel
+// @Description	Delete notification channel
+// @Tags			notification
+// @Param			id	path	string	true	"Channel Id"
+// @Success		204
+// @Failure		404	{object}	model.Error
+// @Failure		500	{object}	model.Error
+// @Router			/notification-channels/{id} [delete]
+func (h *Handler) DeleteNotificationChannelHandler(c echo.Context) error {
+	if err := h.service.DeleteNotificationChannel(c.Request().Context(), c.Param("id")); err != nil {
+		return alertError(c, err)
+	}
+	return c.NoContent(204)
+}
+
+// @Summary		Test notification channel
+// @Description	Send a sample firing event to the channel now, the result is returned and kept in the delivery log
+// @Tags			notification
+// @Produce		json
+// @Param			id	path		string	true	"Channel Id"
+// @Success		200	{object}	model.Notification
+// @Failure		404	{object}	model.Error
+// @Failure		500	{object}	model.Error
+// @Router			/notification-channels/{id}/test [post]
+func (h *Handler) TestNotificationChannelHandler(c echo.Context) error {
+	res, err := h.service.TestNotificationChannel(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Notification delivery log
+// @Description	Notifications with their status (grouping, pending, sent or failed), attempts and last error, latest first
+// @Tags			notification
+// @Produce		json
+// @Param			channel_id	query		string	false	"Channel Id"
+// @Param			status		query		string	false	"Status"
+// @Param			from		query		string	false	"from, milisecond, default 24h ago"
+// @Param			to			query		string	false	"to, milisecond, default now"
+// @Param			limit		query		string	false	"Limit, default 100"
+// @Success		200			{object}	[]model.Notification
+// @Failure		400			{object}	model.Error
+// @Failure		500			{object}	model.Error
+// @Router			/notifications [get]
+func (h *Handler) GetNotificationsHandler(c echo.Context) error {
+	to := time.Now().UnixMilli()
+	from := to - (24 * time.Hour).Milliseconds()
+	limit := int64(100)
+	ints := map[string]*int64{
+		"from":  &from,
+		"to":    &to,
+		"limit": &limit,
+	}
+	for name, dst := range ints {
+		if v := c.QueryParam(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return c.JSON(400, model.Error{Message: "invalid " + name, Code: 400})
+			}
+			*dst = n
+		}
+	}
+	res, err := h.service.FindNotifications(c.Request().Context(), c.QueryParam("channel_id"), c.QueryParam("status"), from, to, limit)
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
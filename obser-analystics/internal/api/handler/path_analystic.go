@@ -1,10 +1,13 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
 	"kuroko.com/analystics/internal/model"
+	"kuroko.com/analystics/internal/service"
 )
 
 // @Summary		Get All Path From Operation
@@ -49,7 +52,9 @@ func (h *Handler) GetAllPathFromOperationsHandler(c echo.Context) error {
 // @Param			from				query		string	true	"From"
 // @Param			to				query		string	true	"To"
 // @Param			unit				query		string	true	"Unit"
+// @Param			quantiles			query		string	false	"Comma separated latency quantiles, default 0.5,0.95,0.99"
 // @Success		200				{object}	model.PathDetail
+// @Failure		400				{object}	model.Error
 // @Failure		500				{object}	model.Error
 // @Router			/paths/:path_id [get]
 func (h *Handler) GetPathDetailByIdHandler(c echo.Context) error {
@@ -57,8 +62,55 @@ func (h *Handler) GetPathDetailByIdHandler(c echo.Context) error {
 	from := c.QueryParam("from")
 	to := c.QueryParam("to")
 	unit := c.QueryParam("unit")
+	quantiles, err := parseQuantiles(c)
+	if err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
+
+	res, err := h.service.GetPathDetailById(c.Request().Context(), pathId, from, to, unit, quantiles)
+	if err != nil {
+		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
+	}
+
+	return c.JSON(200, res)
+}
+
+// @Summary		Get Path Latency Breakdown
+// @Description	Self time and critical path time per operation of the path, aggregated over its latest traces
+// @Tags			path
+// @Accept			json
+// @Produce		json
+// @Param			path_id			param		string	true	"Path Id"
+// @Param			from				query		string	true	"From"
+// @Param			to				query		string	true	"To"
+// @Param			limit				query		string	false	"Maximum traces analysed, the latest ones, default all"
+// @Param			quantiles			query		string	false	"Comma separated latency quantiles, default 0.5,0.95,0.99"
+// @Success		200				{object}	model.PathLatencyBreakdown
+// @Failure		400				{object}	model.Error
+// @Failure		404				{object}	model.Error
+// @Failure		500				{object}	model.Error
+// @Router			/paths/:path_id/latency-breakdown [get]
+func (h *Handler) GetPathLatencyBreakdownHandler(c echo.Context) error {
+	pathId := c.Param("path_id")
+	from := c.QueryParam("from")
+	to := c.QueryParam("to")
+	var limit int64
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return c.JSON(400, model.Error{Message: "invalid limit", Code: 400})
+		}
+		limit = n
+	}
+	quantiles, err := parseQuantiles(c)
+	if err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
 
-	res, err := h.service.GetPathDetailById(c.Request().Context(), pathId, from, to, unit)
+	res, err := h.service.GetPathLatencyBreakdown(c.Request().Context(), pathId, from, to, limit, quantiles)
+	if errors.Is(err, service.ErrPathNotFound) {
+		return c.JSON(404, model.Error{Message: err.Error(), Code: 404})
+	}
 	if err != nil {
 		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
 	}
@@ -75,7 +127,9 @@ func (h *Handler) GetPathDetailByIdHandler(c echo.Context) error {
 // @Param			from				query		string	true	"From"
 // @Param			to				query		string	true	"To"
 // @Param			unit				query		string	true	"Unit"
+// @Param			quantiles			query		string	false	"Comma separated latency quantiles, default 0.5,0.95,0.99"
 // @Success		200				{object}	model.HopDetail
+// @Failure		400				{object}	model.Error
 // @Failure		500				{object}	model.Error
 // @Router			/hops/:hop_id [get]
 func (h *Handler) GetHopDetailByIdHandler(c echo.Context) error {
@@ -83,8 +137,12 @@ func (h *Handler) GetHopDetailByIdHandler(c echo.Context) error {
 	from := c.QueryParam("from")
 	to := c.QueryParam("to")
 	unit := c.QueryParam("unit")
+	quantiles, err := parseQuantiles(c)
+	if err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
 
-	res, err := h.service.GetHopDetailById(c.Request().Context(), hopID, from, to, unit)
+	res, err := h.service.GetHopDetailById(c.Request().Context(), hopID, from, to, unit, quantiles)
 	if err != nil {
 		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
 	}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"kuroko.com/analystics/internal/model"
+)
+
+// @Summary		List SLOs
+// @Description	Every SLO with its current SLI, error budget and burn rates
+// @Tags			slo
+// @Produce		json
+// @Success		200	{object}	[]model.SLOStatus
+// @Failure		500	{object}	model.Error
+// @Router			/slos [get]
+func (h *Handler) GetSLOsHandler(c echo.Context) error {
+	res, err := h.service.FindSLOStatuses(c.Request().Context())
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Get SLO
+// @Description	An SLO with its current SLI, error budget and burn rates
+// @Tags			slo
+// @Produce		json
+// @Param			id	path		string	true	"SLO Id"
+// @Success		200	{object}	model.SLOStatus
+// @Failure		404	{object}	model.Error
+// @Failure		500	{object}	model.Error
+// @Router			/slos/{id} [get]
+func (h *Handler) GetSLOHandler(c echo.Context) error {
+	res, err := h.service.GetSLOStatus(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Create SLO
+// @Description	Create an SLO on the requests of an API, e.g. 99.5% of POST /checkout under 300ms and non-5xx over 28 days
+// @Tags			slo
+// @Accept			json
+// @Produce		json
+// @Param			slo	body		model.SLO	true	"SLO"
+// @Success		201	{object}	model.SLO
+// @Failure		400	{object}	model.Error
+// @Failure		500	{object}	model.Error
+// @Router			/slos [post]
+func (h *Handler) CreateSLOHandler(c echo.Context) error {
+	var slo model.SLO
+	if err := c.Bind(&slo); err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
+	res, err := h.service.CreateSLO(c.Request().Context(), &slo)
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(201, res)
+}
+
+// @Summary		Update SLO
+// @Description	Replace an SLO, its counts and state start over
+// @Tags			slo
+// @Accept			json
+// @Produce		json
+// @Param			id	path		string		true	"SLO Id"
+// @Param			slo	body		model.SLO	true	"SLO"
+// @Success		200	{object}	model.SLO
+// @Failure		400	{object}	model.Error
+// @Failure		404	{object}	model.Error
+// @Failure		500	{object}	model.Error
+// @Router			/slos/{id} [put]
+func (h *Handler) UpdateSLOHandler(c echo.Context) error {
+	var slo model.SLO
+	if err := c.Bind(&slo); err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
+	res, err := h.service.UpdateSLO(c.Request().Context(), c.Param("id"), &slo)
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Delete SLO
+// @Description	Delete an SLO with its history
+// @Tags			slo
+// @Param			id	path	string	true	"SLO Id"
+// @Success		204
+// @Failure		404	{object}	model.Error
+// @Failure		500	{object}	model.Error
+// @Router			/slos/{id} [delete]
+func (h *Handler) DeleteSLOHandler(c echo.Context) error {
+	if err := h.service.DeleteSLO(c.Request().Context(), c.Param("id")); err != nil {
+		return alertError(c, err)
+	}
+	return c.NoContent(204)
+}
+
+// @Summary		SLO history
+// @Description	Past evaluations of an SLO, latest first
+// @Tags			slo
+// @Produce		json
+// @Param			id		path		string	true	"SLO Id"
+// @Param			from	query		string	false	"from, milisecond, default 24h ago"
+// @Param			to		query		string	false	"to, milisecond, default now"
+// @Param			limit	query		string	false	"Limit, default 1440"
+// @Success		200		{object}	[]model.SLOSnapshot
+// @Failure		400		{object}	model.Error
+// @Failure		404		{object}	model.Error
+// @Failure		500		{object}	model.Error
+// @Router			/slos/{id}/history [get]
+func (h *Handler) GetSLOHistoryHandler(c echo.Context) error {
+	to := time.Now().UnixMilli()
+	from := to - (24 * time.Hour).Milliseconds()
+	limit := int64(1440)
+	ints := map[string]*int64{
+		"from":  &from,
+		"to":    &to,
+		"limit": &limit,
+	}
+	for name, dst := range ints {
+		if v := c.QueryParam(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return c.JSON(400, model.Error{Message: "invalid " + name, Code: 400})
+			}
+			*dst = n
+		}
+	}
+	res, err := h.service.FindSLOHistory(c.Request().Context(), c.Param("id"), from, to, limit)
+	if err != nil {
+		return alertError(c, err)
+	}
+	return c.JSON(200, res)
+}
@@ -1,10 +1,14 @@
 package handler
 
 import (
+	"errors"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"kuroko.com/analystics/internal/model"
+	"kuroko.com/analystics/internal/service"
 )
 
 // @Summary		Get all traces of path
@@ -22,8 +26,8 @@ func (h *Handler) getAllTracesOfPath(c echo.Context) error {
 	pathIdStr := c.Param("path_id")
 	from := c.QueryParam("from")
 	to := c.QueryParam("to")
-	pathId, _ := strconv.Atoi(pathIdStr)
-	res, err := h.service.GetAllTracesOfPath(c.Request().Context(), uint32(pathId), from, to)
+	pathId, _ := strconv.ParseUint(pathIdStr, 10, 64)
+	res, err := h.service.GetAllTracesOfPath(c.Request().Context(), pathId, from, to)
 	if err != nil {
 		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
 	}
@@ -36,5 +40,182 @@ func (h *Handler) getTraceById(c echo.Context) error {
 	if err != nil {
 		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
 	}
+	if res == nil {
+		return c.JSON(404, model.Error{Message: "trace not found", Code: 404})
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Search traces
+// @Description	Search traces by span filters, trace duration and error status. Service, operation and tags must match the same span.
+// @Tags			traces
+// @Accept			json
+// @Produce		json
+// @Param			service			query		string	false	"Service"
+// @Param			operation		query		string	false	"Operation"
+// @Param			tag				query		string	false	"key:value, repeatable"
+// @Param			min_duration	query		string	false	"Minimum trace duration in microseconds"
+// @Param			max_duration	query		string	false	"Maximum trace duration in microseconds"
+// @Param			error			query		string	false	"true or false"
+// @Param			from			query		string	false	"from, milisecond"
+// @Param			to				query		string	false	"to, milisecond"
+// @Param			sort			query		string	false	"latest, slowest or spans"
+// @Param			limit			query		string	false	"Page size, at most 100"
+// @Param			cursor			query		string	false	"next_cursor of the previous page"
+// @Success		200				{object}	model.TraceSearchResponse
+// @Failure		400				{object}	model.Error
+// @Failure		500				{object}	model.Error
+// @Router			/traces [get]
+func (h *Handler) searchTraces(c echo.Context) error {
+	q := &model.TraceSearchQuery{
+		Service:   c.QueryParam("service"),
+		Operation: c.QueryParam("operation"),
+		Sort:      c.QueryParam("sort"),
+		Cursor:    c.QueryParam("cursor"),
+		Limit:     20,
+		To:        time.Now().UnixMilli(),
+	}
+	if q.Sort == "" {
+		q.Sort = "latest"
+	}
+	q.From = q.To - time.Hour.Milliseconds()
+
+	ints := map[string]*int64{
+		"min_duration": &q.MinDuration,
+		"max_duration": &q.MaxDuration,
+		"from":         &q.From,
+		"to":           &q.To,
+	}
+	for name, dst := range ints {
+		if v := c.QueryParam(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return c.JSON(400, model.Error{Message: "invalid " + name, Code: 400})
+			}
+			*dst = n
+		}
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > 100 {
+			return c.JSON(400, model.Error{Message: "limit must be between 1 and 100", Code: 400})
+		}
+		q.Limit = limit
+	}
+	if v := c.QueryParam("error"); v != "" {
+		hasError, err := strconv.ParseBool(v)
+		if err != nil {
+			return c.JSON(400, model.Error{Message: "invalid error", Code: 400})
+		}
+		q.HasError = &hasError
+	}
+	for _, tag := range c.QueryParams()["tag"] {
+		key, value, ok := strings.Cut(tag, ":")
+		if !ok {
+			return c.JSON(400, model.Error{Message: "tag must be key:value", Code: 400})
+		}
+		q.Tags = append(q.Tags, model.KeyValue{Key: key, Value: value})
+	}
+
+	res, err := h.service.SearchTraces(c.Request().Context(), q)
+	if errors.Is(err, service.ErrInvalidTraceQuery) {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
+	if err != nil {
+		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Get critical path of trace
+// @Description	Self time and critical path contribution of every span and a per-service breakdown, times in microseconds
+// @Tags			traces
+// @Accept			json
+// @Produce		json
+// @Param			trace_id	path		string	true	"Trace Id"
+// @Success		200			{object}	model.CriticalPathResponse
+// @Failure		404			{object}	model.Error
+// @Failure		500			{object}	model.Error
+// @Router			/traces/:trace_id/critical-path [get]
+func (h *Handler) getCriticalPath(c echo.Context) error {
+	res, err := h.service.GetCriticalPath(c.Request().Context(), c.Param("trace_id"))
+	if err != nil {
+		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
+	}
+	if res == nil {
+		return c.JSON(404, model.Error{Message: "trace not found", Code: 404})
+	}
+	return c.JSON(200, res)
+}
+
+// @Summary		Compare traces
+// @Description	Diff two traces by service_operation ID, or with path_id the traces of a path in two time windows
+// @Tags			traces
+// @Accept			json
+// @Produce		json
+// @Param			a		query		string	false	"Trace Id of the baseline trace"
+// @Param			b		query		string	false	"Trace Id of the compared trace"
+// @Param			path_id	query		string	false	"Path Id, compares two time windows"
+// @Param			a_from	query		string	false	"Baseline window start, milisecond"
+// @Param			a_to	query		string	false	"Baseline window end, milisecond"
+// @Param			b_from	query		string	false	"Compared window start, milisecond"
+// @Param			b_to	query		string	false	"Compared window end, milisecond"
+// @Param			limit	query		string	false	"Maximum traces per window, the latest ones, default all"
+// @Param			quantiles	query	string	false	"Comma separated latency quantiles of a time window, default 0.5,0.95,0.99"
+// @Success		200		{object}	model.TraceComparison
+// @Failure		400		{object}	model.Error
+// @Failure		404		{object}	model.Error
+// @Failure		500		{object}	model.Error
+// @Router			/traces/compare [get]
+func (h *Handler) compareTraces(c echo.Context) error {
+	if c.QueryParam("path_id") == "" {
+		a, b := c.QueryParam("a"), c.QueryParam("b")
+		if a == "" || b == "" {
+			return c.JSON(400, model.Error{Message: "a and b, or path_id, are required", Code: 400})
+		}
+		res, err := h.service.CompareTraces(c.Request().Context(), a, b)
+		if err != nil {
+			return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
+		}
+		if res == nil {
+			return c.JSON(404, model.Error{Message: "trace not found", Code: 404})
+		}
+		return c.JSON(200, res)
+	}
+
+	pathId, err := strconv.ParseUint(c.QueryParam("path_id"), 10, 64)
+	if err != nil {
+		return c.JSON(400, model.Error{Message: "invalid path_id", Code: 400})
+	}
+	var aFrom, aTo, bFrom, bTo, limit int64
+	ints := map[string]*int64{
+		"a_from": &aFrom,
+		"a_to":   &aTo,
+		"b_from": &bFrom,
+		"b_to":   &bTo,
+	}
+	for name, dst := range ints {
+		n, err := strconv.ParseInt(c.QueryParam(name), 10, 64)
+		if err != nil {
+			return c.JSON(400, model.Error{Message: "invalid " + name, Code: 400})
+		}
+		*dst = n
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return c.JSON(400, model.Error{Message: "invalid limit", Code: 400})
+		}
+		limit = n
+	}
+	quantiles, err := parseQuantiles(c)
+	if err != nil {
+		return c.JSON(400, model.Error{Message: err.Error(), Code: 400})
+	}
+
+	res, err := h.service.ComparePathWindows(c.Request().Context(), pathId, aFrom, aTo, bFrom, bTo, limit, quantiles)
+	if err != nil {
+		return c.JSON(500, model.Error{Message: err.Error(), Code: 500})
+	}
 	return c.JSON(200, res)
 }
@@ -1,27 +1,87 @@
 package config
 
+import (
+	"errors"
+	"flag"
+	"time"
+)
+
 const (
 	// ProjectName is the name of the project
 	ProjectName = "obser-analystics"
 
 	// ProjectVersion is the version of the project
 	ProjectVersion = "1.0.0"
+)
 
-	MONGO_DATABASE = "kltn"
-	INTERVAL       = 600 // second
-	LOOKBACK       = 60000
-	LIMIT          = 99999
+var (
+	MongoURI         = flag.String("mongo.uri", "mongodb://localhost:27017", "MongoDB connection string")
+	MongoDatabase    = flag.String("mongo.database", "kltn", "MongoDB database name")
+	HttpAddr         = flag.String("http.addr", "127.0.0.1:8585", "HTTP listen address")
+	ElasticsearchURL = flag.String("elasticsearch.url", "http://localhost:9200", "Elasticsearch url")
+	AlertInterval    = flag.Duration("alert.interval", time.Minute, "How often alert rules are evaluated, 0 disables evaluation")
+	AlertDelay       = flag.Duration("alert.delay", 30*time.Second, "How long after its end a minute is complete in the rollups, at least the processor buffer.time plus rollup.interval")
+	StatisticRollups = flag.Bool("statistic.rollups", true, "Serve API, path and hop statistics from the rollups kept by the processor")
 
-	TRACE_PORT = 4111
+	NotifyInterval       = flag.Duration("notify.interval", 10*time.Second, "How often due alert notifications are delivered, 0 disables delivery")
+	NotifyGroupWait      = flag.Duration("notify.group-wait", 30*time.Second, "How long alert events for a channel are collected into one notification")
+	NotifyRepeatInterval = flag.Duration("notify.repeat-interval", 4*time.Hour, "How often a rule still firing is notified again, 0 disables reminders")
+	NotifyMaxAttempts    = flag.Int("notify.max-attempts", 5, "Delivery attempts of a notification before it is given up")
+	NotifyRetryBackoff   = flag.Duration("notify.retry-backoff", 30*time.Second, "Delay before the first retry of a notification, doubled on every retry")
+	NotifyTimeout        = flag.Duration("notify.timeout", 10*time.Second, "Timeout of one notification delivery")
+	SmtpAddr             = flag.String("smtp.addr", "", "SMTP server host:port for email notifications")
+	SmtpFrom             = flag.String("smtp.from", "", "Sender address of email notifications")
+	SmtpUsername         = flag.String("smtp.username", "", "SMTP username, empty sends without authentication")
+	SmtpPassword         = flag.String("smtp.password", "", "SMTP password")
+	NatsURL              = flag.String("nats.url", "", "NATS url for nats notification channels, empty disables them")
 
-	Neo4jUsername = "neo4j"
-	Neo4jPassword = "123456789"
-	Neo4jDatabase = "neo4j"
+	SLOInterval         = flag.Duration("slo.interval", time.Minute, "How often SLOs are evaluated, 0 disables evaluation")
+	SLOHistoryRetention = flag.Duration("slo.history-retention", 30*24*time.Hour, "How long SLO evaluations are kept in slo_history, 0 keeps them")
+	SLOBucketHours      = flag.Int("slo.bucket-hours", 24, "Hours of requests an SLO evaluation counts at most, a new window is counted over several evaluations")
 
-	// MONGO_URI  = "mongodb://mongo-db:27017"
-	// TRACE_HOST = "mock-zipkin"
-	// Neo4jURI   = "bolt://neo4j-db:7687"
-	MONGO_URI  = "mongodb://localhost:27017"
-	TRACE_HOST = "localhost"
-	Neo4jURI   = "bolt://localhost:7687"
+	AnomalySeasons   = flag.Int("anomaly.seasons", 4, "Weeks of the same hour the anomaly baseline is learnt from")
+	AnomalyThreshold = flag.Float64("anomaly.threshold", 3.5, "Robust z-score from which an hour is anomalous")
+	AnomalyMinCount  = flag.Int64("anomaly.min-count", 20, "Requests an hour needs for its latency and error rate to be judged")
+	AnomalyQuantile  = flag.Float64("anomaly.quantile", 0.95, "Latency quantile watched by the anomaly detector")
 )
+
+func init() {
+	// the Elasticsearch url was read from ELASTICSEARCH_URL before it was a flag
+	LegacyEnv("elasticsearch.url", "ELASTICSEARCH_URL")
+	Validate(func() error {
+		if *MongoURI == "" {
+			return errors.New("mongo.uri must not be empty")
+		}
+		if *MongoDatabase == "" {
+			return errors.New("mongo.database must not be empty")
+		}
+		if *HttpAddr == "" {
+			return errors.New("http.addr must not be empty")
+		}
+		if *AlertInterval < 0 || *AlertDelay < 0 {
+			return errors.New("alert.interval and alert.delay must not be negative")
+		}
+		if *NotifyInterval < 0 || *NotifyRepeatInterval < 0 || *NotifyGroupWait < 0 {
+			return errors.New("notify.interval, notify.group-wait and notify.repeat-interval must not be negative")
+		}
+		if *AnomalySeasons < 1 || *AnomalyThreshold <= 0 {
+			return errors.New("anomaly.seasons and anomaly.threshold must be positive")
+		}
+		if *AnomalyQuantile <= 0 || *AnomalyQuantile > 1 {
+			return errors.New("anomaly.quantile must be in (0, 1]")
+		}
+		if *SLOInterval < 0 || *SLOHistoryRetention < 0 {
+			return errors.New("slo.interval and slo.history-retention must not be negative")
+		}
+		if *SLOBucketHours < 1 {
+			return errors.New("slo.bucket-hours must be at least 1")
+		}
+		if *NotifyMaxAttempts < 1 {
+			return errors.New("notify.max-attempts must be at least 1")
+		}
+		if *NotifyRetryBackoff <= 0 || *NotifyTimeout <= 0 {
+			return errors.New("notify.retry-backoff and notify.timeout must be positive")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(file, []byte("mongo:\n  uri: mongodb://file\n  database: file\nhttp:\n  addr: file:1\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvName("config"), file)
+	t.Setenv(EnvName("mongo.database"), "env")
+	t.Setenv(EnvName("http.addr"), "env:1")
+	t.Setenv("ELASTICSEARCH_URL", "http://legacy:9200")
+	args := os.Args
+	os.Args = []string{"analystics", "-http.addr", "flag:1"}
+	defer func() { os.Args = args }()
+
+	if err := Load(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"file over default", *MongoURI, "mongodb://file"},
+		{"env over file", *MongoDatabase, "env"},
+		{"flag over env", *HttpAddr, "flag:1"},
+		{"legacy env without OBSER_ variable", *ElasticsearchURL, "http://legacy:9200"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %q, want %q", tt.got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package model
+
+// Metrics an alert rule can watch
+const (
+	AlertMetricErrorRate       = "error_rate"        // percent of failed requests
+	AlertMetricLatency         = "latency"           // latency quantile in milliseconds
+	AlertMetricRequestRate     = "request_rate"      // requests per minute
+	AlertMetricRequestRateDrop = "request_rate_drop" // percent drop against the previous window
+
+	// raised by SLOs, the value is the burn rate of the long window
+	AlertMetricSLOFastBurn = "slo_fast_burn"
+	AlertMetricSLOSlowBurn = "slo_slow_burn"
+)
+
+// States of an alert rule
+const (
+	AlertStateOK       = "ok"
+	AlertStatePending  = "pending"
+	AlertStateFiring   = "firing"
+	AlertStateResolved = "resolved"
+	AlertStateNoData   = "no_data"
+)
+
+// AlertTarget selects the API, path or hop a rule watches
+type AlertTarget struct {
+	Kind        string `json:"kind" bson:"kind"` // api, path or hop
+	ServiceName string `json:"service_name,omitempty" bson:"service_name,omitempty"`
+	URIPath     string `json:"uri_path,omitempty" bson:"uri_path,omitempty"`
+	Method      string `json:"method,omitempty" bson:"method,omitempty"`
+	PathID      uint64 `json:"path_id,omitempty" bson:"path_id,omitempty"`
+	HopID       string `json:"hop_id,omitempty" bson:"hop_id,omitempty"`
+}
+
+// AlertRule fires when the metric of its target compares to the threshold with the
+// operator over the last window, for at least For. Window and For are Go durations
+type AlertRule struct {
+	ID          string            `json:"id" bson:"_id"`
+	Name        string            `json:"name" bson:"name"`
+	Description string            `json:"description" bson:"description"`
+	Target      AlertTarget       `json:"target" bson:"target"`
+	Metric      string            `json:"metric" bson:"metric"`
+	Quantile    float64           `json:"quantile,omitempty" bson:"quantile,omitempty"` // latency only
+	Operator    string            `json:"operator" bson:"operator"`                     // > or <
+	Threshold   float64           `json:"threshold" bson:"threshold"`
+	Window      string            `json:"window" bson:"window"`
+	For         string            `json:"for,omitempty" bson:"for,omitempty"`
+	MinCount    int64             `json:"min_count,omitempty" bson:"min_count,omitempty"` // requests needed to evaluate
+	Enabled     bool              `json:"enabled" bson:"enabled"`
+	Labels      map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+	Channels    []string          `json:"channels,omitempty" bson:"channels,omitempty"` // notification channel ids
+	CreatedAt   int64             `json:"created_at" bson:"created_at"`                 // milisecond
+	UpdatedAt   int64             `json:"updated_at" bson:"updated_at"`                 // milisecond
+}
+
+// AlertState is the latest evaluation of a rule
+type AlertState struct {
+	RuleID         string  `json:"rule_id" bson:"_id"`
+	State          string  `json:"state" bson:"state"`
+	Value          float64 `json:"value" bson:"value"`
+	Since          int64   `json:"since" bson:"since"` // milisecond, start of the state
+	LastEvaluation int64   `json:"last_evaluation" bson:"last_evaluation"`
+	NotifiedAt     int64   `json:"notified_at" bson:"notified_at"` // milisecond, last firing notification
+	Silenced       bool    `json:"silenced" bson:"silenced"`
+}
+
+// AlertStatus is a rule with its state
+type AlertStatus struct {
+	Rule  *AlertRule  `json:"rule"`
+	State *AlertState `json:"state"`
+}
+
+// AlertEvent records a rule starting or stopping to fire
+type AlertEvent struct {
+	ID        string      `json:"id" bson:"_id"`
+	RuleID    string      `json:"rule_id" bson:"rule_id"`
+	RuleName  string      `json:"rule_name" bson:"rule_name"`
+	Target    AlertTarget `json:"target" bson:"target"`
+	Metric    string      `json:"metric" bson:"metric"`
+	State     string      `json:"state" bson:"state"` // firing or resolved
+	Value     float64     `json:"value" bson:"value"`
+	Threshold float64     `json:"threshold" bson:"threshold"`
+	Silenced  bool        `json:"silenced" bson:"silenced"`
+	Repeat    bool        `json:"repeat,omitempty" bson:"repeat,omitempty"` // reminder of a rule still firing
+	Timestamp int64       `json:"timestamp" bson:"timestamp"`               // milisecond
+}
+
+// AlertSilence mutes the rules it matches between StartsAt and EndsAt, a zero EndsAt
+// never expires. An empty RuleID matches every rule whose target has the set fields
+// of Target
+type AlertSilence struct {
+	ID        string      `json:"id" bson:"_id"`
+	RuleID    string      `json:"rule_id,omitempty" bson:"rule_id,omitempty"`
+	Target    AlertTarget `json:"target" bson:"target"`
+	StartsAt  int64       `json:"starts_at" bson:"starts_at"` // milisecond
+	EndsAt    int64       `json:"ends_at" bson:"ends_at"`     // milisecond
+	Comment   string      `json:"comment" bson:"comment"`
+	CreatedBy string      `json:"created_by" bson:"created_by"`
+	CreatedAt int64       `json:"created_at" bson:"created_at"`
+}
+
+// Notification channel types
+const (
+	ChannelWebhook = "webhook"
+	ChannelSlack   = "slack"
+	ChannelEmail   = "email"
+	ChannelNats    = "nats"
+)
+
+// NotificationChannel is where alert events of the rules routing to it are delivered:
+// URL for webhook and slack, To for email, Subject for nats
+type NotificationChannel struct {
+	ID        string            `json:"id" bson:"_id"`
+	Name      string            `json:"name" bson:"name"`
+	Type      string            `json:"type" bson:"type"`
+	URL       string            `json:"url,omitempty" bson:"url,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty" bson:"headers,omitempty"`
+	To        []string          `json:"to,omitempty" bson:"to,omitempty"`
+	Subject   string            `json:"subject,omitempty" bson:"subject,omitempty"`
+	Enabled   bool              `json:"enabled" bson:"enabled"`
+	CreatedAt int64             `json:"created_at" bson:"created_at"`
+	UpdatedAt int64             `json:"updated_at" bson:"updated_at"`
+}
+
+// Delivery states of a notification
+const (
+	NotificationGrouping = "grouping" // collecting events until GroupUntil
+	NotificationPending  = "pending"  // waiting for NextAttemptAt
+	NotificationSent     = "sent"
+	NotificationFailed   = "failed" // gave up after the last attempt
+)
+
+// Notification is one delivery to a channel of the events grouped in it, it doubles as
+// the delivery log
+type Notification struct {
+	ID            string        `json:"id" bson:"_id"`
+	ChannelID     string        `json:"channel_id" bson:"channel_id"`
+	ChannelType   string        `json:"channel_type" bson:"channel_type"`
+	Events        []*AlertEvent `json:"events" bson:"events"`
+	Status        string        `json:"status" bson:"status"`
+	Attempts      int           `json:"attempts" bson:"attempts"`
+	LastError     string        `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	GroupUntil    int64         `json:"group_until" bson:"group_until"`         // milisecond
+	NextAttemptAt int64         `json:"next_attempt_at" bson:"next_attempt_at"` // milisecond
+	CreatedAt     int64         `json:"created_at" bson:"created_at"`
+	SentAt        int64         `json:"sent_at,omitempty" bson:"sent_at,omitempty"`
+}
@@ -0,0 +1,23 @@
+package model
+
+// AnomalyPoint is one hour of a series with its seasonal baseline
+type AnomalyPoint struct {
+	Timestamp int64   `json:"timestamp"` // milisecond, start of the hour
+	Count     int64   `json:"count"`
+	Value     float64 `json:"value"`
+	Expected  float64 `json:"expected"`
+	Lower     float64 `json:"lower"`
+	Upper     float64 `json:"upper"`
+	Score     float64 `json:"score"` // deviation from expected in robust standard deviations
+	Anomaly   bool    `json:"anomaly"`
+}
+
+// AnomalySeries is a metric of an API or path with at least one anomalous hour, Points
+// are all the scored hours of the requested range
+type AnomalySeries struct {
+	Target    AlertTarget     `json:"target"`
+	Metric    string          `json:"metric"` // latency (ms), error_rate (percent) or request_rate (per hour)
+	Score     float64         `json:"score"`  // score of the worst hour
+	Timestamp int64           `json:"timestamp"`
+	Points    []*AnomalyPoint `json:"points"`
+}
@@ -17,6 +17,7 @@ type ApiStatistic struct {
 	ErrorDistTime map[int64]int
 	Latency       map[string]int // max min p50 p99
 	LatencyDist   map[int64]int
+	Quantiles     map[string]int // requested latency quantiles
 }
 type LongApiResponse struct {
 	Id struct {
@@ -36,14 +37,15 @@ type CalledApiResponse struct {
 	Count int
 }
 type HopDetail struct {
-	HopInfo      *Hop          `json:"hop_info"`
-	Count        int           `json:"count"`
-	Frequency    float32       `json:"frequency"`
-	Distribution map[int64]int `json:"distribution"`
-	ErrorCount   int           `json:"error_count"`
-	ErrorRate    float32       `json:"error_rate"`
-	ErrorDist    map[int64]int `json:"error_dist"`
-	Latency      map[int64]int `json:"latency"`
+	HopInfo      *Hop           `json:"hop_info"`
+	Count        int            `json:"count"`
+	Frequency    float32        `json:"frequency"`
+	Distribution map[int64]int  `json:"distribution"`
+	ErrorCount   int            `json:"error_count"`
+	ErrorRate    float32        `json:"error_rate"`
+	ErrorDist    map[int64]int  `json:"error_dist"`
+	Latency      map[int64]int  `json:"latency"`
+	Quantiles    map[string]int `json:"quantiles"` // microsecond
 }
 
 type ServiceDetail struct {
@@ -51,13 +53,15 @@ type ServiceDetail struct {
 	HttpApi    any `json:"http_api"`
 }
 type PathDetail struct {
-	PathInfo     *Path         `json:"path_info"`
-	Count        int           `json:"count"`
-	Frequency    float32       `json:"frequency"`
-	Distribution map[int64]int `json:"distribution"`
-	ErrorCount   int           `json:"error_count"`
-	ErrorRate    float32       `json:"error_rate"`
-	ErrorDist    map[int64]int `json:"error_dist"`
+	PathInfo     *Path          `json:"path_info"`
+	Count        int            `json:"count"`
+	Frequency    float32        `json:"frequency"`
+	Distribution map[int64]int  `json:"distribution"`
+	ErrorCount   int            `json:"error_count"`
+	ErrorRate    float32        `json:"error_rate"`
+	ErrorDist    map[int64]int  `json:"error_dist"`
+	Latency      map[int64]int  `json:"latency"`
+	Quantiles    map[string]int `json:"quantiles"` // microsecond, of the root span
 }
 
 type GroupResult struct {
@@ -85,7 +89,7 @@ type PathResponse struct {
 
 type Path struct {
 	ID                string          `json:"id" bson:"_id"`
-	PathID            uint32          `json:"path_id" bson:"path_id"`
+	PathID            uint64          `json:"path_id" bson:"path_id"`
 	CreatedAt         int64           `json:"created_at" bson:"created_at"`
 	LongestChain      int             `json:"longest_chain" bson:"longest_chain"`
 	LongestErrorChain int             `json:"longest_error_chain" bson:"longest_error_chain"`
@@ -119,6 +123,28 @@ type TraceSummaryResponse struct {
 	StartTime     int64  `json:"start_time"`
 	SpanNum       int    `json:"span_num"`
 	Duration      int    `json:"duration"`
+	HasError      bool   `json:"has_error"`
+}
+
+// TraceSearchQuery holds the filters of GET /traces, service, operation and tags must
+// match one span while the other filters apply to the whole trace
+type TraceSearchQuery struct {
+	Service     string
+	Operation   string
+	Tags        []KeyValue
+	MinDuration int64 // microsecond
+	MaxDuration int64 // microsecond
+	HasError    *bool
+	From        int64 // milisecond
+	To          int64 // milisecond
+	Sort        string
+	Limit       int
+	Cursor      string
+}
+
+type TraceSearchResponse struct {
+	Traces     []*TraceSummaryResponse `json:"traces"`
+	NextCursor string                  `json:"next_cursor"`
 }
 type TraceResponse struct {
 	Spans      []*Span           `json:"spans"`
@@ -126,3 +152,119 @@ type TraceResponse struct {
 	SpanErrors map[string]bool   `json:"span_errors"`
 	SpanIds    map[string]string `json:"span_ids"`
 }
+
+// DependencyEdge is a model.Edge with the RED metrics of the calls it stands for
+type DependencyEdge struct {
+	Edge
+	CallCount  int            `json:"call_count"`
+	ErrorCount int            `json:"error_count"`
+	ErrorRate  float32        `json:"error_rate"`
+	P50        int            `json:"p50"`       // microsecond
+	P95        int            `json:"p95"`       // microsecond
+	P99        int            `json:"p99"`       // microsecond
+	Quantiles  map[string]int `json:"quantiles"` // microsecond
+}
+
+type DependencyGraph struct {
+	Nodes []Node           `json:"nodes"`
+	Edges []DependencyEdge `json:"edges"`
+}
+
+// CriticalPathSpan times are in microseconds, CriticalTime is how much of the span's own
+// time lies on the critical path
+type CriticalPathSpan struct {
+	SpanID         string `json:"span_id"`
+	ParentID       string `json:"parent_id"`
+	Service        string `json:"service"`
+	Operation      string `json:"operation"`
+	StartTime      int64  `json:"start_time"`
+	Duration       int64  `json:"duration"`
+	SelfTime       int64  `json:"self_time"`
+	CriticalTime   int64  `json:"critical_time"`
+	OnCriticalPath bool   `json:"on_critical_path"`
+}
+
+type CriticalPathService struct {
+	Service      string  `json:"service"`
+	SelfTime     int64   `json:"self_time"`
+	CriticalTime int64   `json:"critical_time"`
+	Percentage   float32 `json:"percentage"` // share of the trace duration on the critical path
+}
+
+type CriticalPathResponse struct {
+	TraceID  string                 `json:"trace_id"`
+	Duration int64                  `json:"duration"`
+	Spans    []*CriticalPathSpan    `json:"spans"`
+	Services []*CriticalPathService `json:"services"`
+}
+
+// LatencyStats are in microseconds
+type LatencyStats struct {
+	Avg       int64          `json:"avg"`
+	P50       int64          `json:"p50"`
+	P95       int64          `json:"p95"`
+	P99       int64          `json:"p99"`
+	Quantiles map[string]int `json:"quantiles"`
+}
+
+type OperationLatencyBreakdown struct {
+	PathOperation
+	TraceCount    int          `json:"trace_count"`
+	SelfTime      LatencyStats `json:"self_time"`
+	CriticalTime  LatencyStats `json:"critical_time"`
+	CriticalShare float32      `json:"critical_share"` // percent of the summed trace durations
+}
+
+type PathLatencyBreakdown struct {
+	PathID     uint64                       `json:"path_id"`
+	TraceCount int                          `json:"trace_count"`
+	Duration   LatencyStats                 `json:"duration"`
+	Operations []*OperationLatencyBreakdown `json:"operations"`
+}
+
+// TraceCompareSide describes one side of a comparison, a single trace or the traces of
+// a path in a time window. Duration is the average trace duration in microseconds,
+// Quantiles those of the trace durations in a time window
+type TraceCompareSide struct {
+	TraceID    string         `json:"trace_id,omitempty"`
+	PathID     uint64         `json:"path_id"`
+	From       int64          `json:"from,omitempty"` // milisecond
+	To         int64          `json:"to,omitempty"`   // milisecond
+	TraceCount int            `json:"trace_count"`
+	SpanCount  int            `json:"span_count"`
+	ErrorCount int            `json:"error_count"`
+	Duration   int64          `json:"duration"`
+	Quantiles  map[string]int `json:"quantiles,omitempty"`
+}
+
+// OperationDiff compares the spans of one service_operation ID, durations are the
+// summed span durations averaged over the traces containing the operation, quantiles
+// those of the summed durations when comparing time windows
+type OperationDiff struct {
+	ID            string         `json:"id"`
+	Service       string         `json:"service"`
+	Operation     string         `json:"operation"`
+	Status        string         `json:"status"` // common, added or missing
+	ATraces       int            `json:"a_traces"`
+	BTraces       int            `json:"b_traces"`
+	ASpans        int            `json:"a_spans"`
+	BSpans        int            `json:"b_spans"`
+	AErrors       int            `json:"a_errors"`
+	BErrors       int            `json:"b_errors"`
+	ADuration     int64          `json:"a_duration"`
+	BDuration     int64          `json:"b_duration"`
+	DurationDelta int64          `json:"duration_delta"`
+	AQuantiles    map[string]int `json:"a_quantiles,omitempty"`
+	BQuantiles    map[string]int `json:"b_quantiles,omitempty"`
+}
+
+type TraceComparison struct {
+	A             TraceCompareSide `json:"a"`
+	B             TraceCompareSide `json:"b"`
+	DurationDelta int64            `json:"duration_delta"`
+	Operations    []*OperationDiff `json:"operations"`
+	Added         []string         `json:"added"`
+	Missing       []string         `json:"missing"`
+	NewErrors     []string         `json:"new_errors"`
+	FixedErrors   []string         `json:"fixed_errors"`
+}
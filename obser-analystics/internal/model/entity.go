@@ -2,25 +2,29 @@ package model
 
 type HopStatistic struct{}
 
+// ServiceStatisticObject counts the non-GET requests of a service by hour of a day,
+// written by the processor
 type ServiceStatisticObject struct {
-	ID          string
-	Date        string
-	ServiceName string
-	Statistic   map[int]int64
+	ID          string        `json:"id" bson:"_id"`
+	Date        string        `json:"date" bson:"date"`
+	ServiceName string        `json:"service_name" bson:"service_name"`
+	Statistic   map[int]int64 `json:"statistic" bson:"statistic"`
 }
 
+// URIStatisticObject counts the requests of a non-GET API by hour of a day, written by
+// the processor
 type URIStatisticObject struct {
-	ID          string
-	Date        string
-	URIPath     string
-	ServiceName string
-	Method      string
-	Statistic   map[int]int64
+	ID          string        `json:"id" bson:"_id"`
+	Date        string        `json:"date" bson:"date"`
+	URIPath     string        `json:"uri_path" bson:"uri_path"`
+	ServiceName string        `json:"service_name" bson:"service_name"`
+	Method      string        `json:"method" bson:"method"`
+	Statistic   map[int]int64 `json:"statistic" bson:"statistic"`
 }
 
 type StatisticDone struct {
 	// date format yyyyMMdd
-	Date string
+	Date string `json:"date" bson:"_id"`
 }
 
 type TimeInput struct {
@@ -34,13 +38,13 @@ type OnlineTimeOutput struct {
 	Username  string
 }
 type URIObject struct {
-	ID          string
-	ServiceName string
-	Method      string
-	URIPath     string
+	ID          string `json:"id" bson:"id"`
+	ServiceName string `json:"service_name" bson:"service_name"`
+	Method      string `json:"method" bson:"method"`
+	URIPath     string `json:"uri_path" bson:"uri_path"`
 }
 type ServiceObject struct {
-	ServiceName string
+	ServiceName string `json:"service_name" bson:"service_name"`
 }
 
 type Hop struct {
@@ -61,7 +65,7 @@ type LogMiddlewareEvent struct {
 	RemoteIP    string `json:"remote_ip" bson:"remote_ip"`
 	RequestId   string `json:"request_id" bson:"request_id"`
 	// TraceId      string `json:"trace_id" bson:"trace_id"`
-	PathId       uint32 `json:"path_id" bson:"path_id"`
+	PathId       uint64 `json:"path_id" bson:"path_id"`
 	UserId       string `json:"user_id" bson:"user_id"`
 	Referer      string `json:"referer" bson:"referer"`
 	UserAgent    string `json:"user_agent" bson:"user_agent"`
@@ -74,10 +78,33 @@ type LogMiddlewareEvent struct {
 }
 
 type PathEvent struct {
-	PathID    uint32 `json:"path_id" bson:"path_id"`
-	TraceID   string `json:"trace_id" bson:"trace_id"`
-	Timestamp int64  `json:"timestamp" bson:"timestamp"`
-	HasError  bool   `json:"has_error" bson:"has_error"`
+	PathID      uint64 `json:"path_id" bson:"path_id"`
+	TraceID     string `json:"trace_id" bson:"trace_id"`
+	Timestamp   int64  `json:"timestamp" bson:"timestamp"`
+	Duration    int    `json:"duration" bson:"duration"` // microsecond, of the root span
+	HasError    bool   `json:"has_error" bson:"has_error"`
+	Broken      bool   `json:"broken" bson:"broken"`
+	OrphanCount int    `json:"orphan_count" bson:"orphan_count"`
+	SampledOut  bool   `json:"sampled_out" bson:"sampled_out"`
+}
+
+// Rollup aggregates the API, path or hop events of one bucket, it is maintained by the
+// processor. Latencies are in microseconds
+type Rollup struct {
+	Unit        string           `json:"unit" bson:"unit"`
+	ServiceName string           `json:"service_name,omitempty" bson:"service_name,omitempty"`
+	URIPath     string           `json:"uri_path,omitempty" bson:"uri_path,omitempty"`
+	Method      string           `json:"method,omitempty" bson:"method,omitempty"`
+	PathID      uint64           `json:"path_id,omitempty" bson:"path_id,omitempty"`
+	HopID       string           `json:"hop_id,omitempty" bson:"hop_id,omitempty"`
+	Bucket      int64            `json:"bucket" bson:"bucket"` // milisecond
+	Count       int64            `json:"count" bson:"count"`
+	ErrorCount  int64            `json:"error_count" bson:"error_count"`
+	LatencySum  int64            `json:"latency_sum" bson:"latency_sum"`
+	LatencyMin  int64            `json:"latency_min" bson:"latency_min"`
+	LatencyMax  int64            `json:"latency_max" bson:"latency_max"`
+	Sketch      map[string]int64 `json:"sketch" bson:"sketch"` // DDSketch bins by index
+	StatusCodes map[string]int64 `json:"status_codes" bson:"status_codes"`
 }
 
 type HopEvent struct {
@@ -89,16 +116,40 @@ type HopEvent struct {
 }
 
 type Span struct {
-	ID        string `json:"id" bson:"_id"`
-	TraceID   string `json:"trace_id" bson:"trace_id"`
-	ParentID  string `json:"parent_id" bson:"parent_id"`
-	Service   string `json:"service" bson:"service"`
-	Operation string `json:"operation" bson:"operation"`
-	Timestamp int64  `json:"timestamp" bson:"timestamp"`
-	Duration  int    `json:"duration" bson:"duration"`
-	Error     string `json:"error" bson:"error"`
-	PathID    uint32 `json:"path_id" bson:"path_id"`
-	HasError  bool   `json:"has_error" bson:"has_error"`
+	ID        string     `json:"id" bson:"_id"`
+	TraceID   string     `json:"trace_id" bson:"trace_id"`
+	ParentID  string     `json:"parent_id" bson:"parent_id"`
+	Service   string     `json:"service" bson:"service"`
+	Operation string     `json:"operation" bson:"operation"`
+	Timestamp int64      `json:"timestamp" bson:"timestamp"`
+	Duration  int        `json:"duration" bson:"duration"`
+	Error     string     `json:"error" bson:"error"`
+	PathID    uint64     `json:"path_id" bson:"path_id"`
+	HasError  bool       `json:"has_error" bson:"has_error"`
+	Tags      []KeyValue `json:"tags" bson:"tags"`
+
+	Kind          string      `json:"kind" bson:"kind"`
+	StatusCode    string      `json:"status_code" bson:"status_code"`
+	StatusMessage string      `json:"status_message" bson:"status_message"`
+	Events        []SpanEvent `json:"events" bson:"events"`
+	Links         []SpanLink  `json:"links" bson:"links"`
+}
+
+type SpanEvent struct {
+	Name       string     `json:"name" bson:"name"`
+	Timestamp  int64      `json:"timestamp" bson:"timestamp"` // microsecond
+	Attributes []KeyValue `json:"attributes" bson:"attributes"`
+}
+
+type SpanLink struct {
+	TraceID    string     `json:"trace_id" bson:"trace_id"`
+	SpanID     string     `json:"span_id" bson:"span_id"`
+	Attributes []KeyValue `json:"attributes" bson:"attributes"`
+}
+
+type KeyValue struct {
+	Key   string `json:"key" bson:"key"`
+	Value string `json:"value" bson:"value"`
 }
 
 type AlertGetObject struct {
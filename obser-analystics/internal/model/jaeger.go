@@ -0,0 +1,78 @@
+package model
+
+// Types of the Jaeger query API, see jaeger-query's structured response format
+
+type JaegerResponse struct {
+	Data   any           `json:"data"`
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+	Errors []JaegerError `json:"errors"`
+}
+
+type JaegerError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	TraceID string `json:"traceID,omitempty"`
+}
+
+type JaegerTrace struct {
+	TraceID   string                   `json:"traceID"`
+	Spans     []JaegerSpan             `json:"spans"`
+	Processes map[string]JaegerProcess `json:"processes"`
+	Warnings  []string                 `json:"warnings"`
+}
+
+type JaegerSpan struct {
+	TraceID       string            `json:"traceID"`
+	SpanID        string            `json:"spanID"`
+	Flags         int               `json:"flags"`
+	OperationName string            `json:"operationName"`
+	References    []JaegerReference `json:"references"`
+	StartTime     int64             `json:"startTime"` // microsecond
+	Duration      int64             `json:"duration"`  // microsecond
+	Tags          []JaegerKeyValue  `json:"tags"`
+	Logs          []JaegerLog       `json:"logs"`
+	ProcessID     string            `json:"processID"`
+	Warnings      []string          `json:"warnings"`
+}
+
+type JaegerReference struct {
+	RefType string `json:"refType"`
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+}
+
+type JaegerKeyValue struct {
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	Value any    `json:"value"`
+}
+
+type JaegerLog struct {
+	Timestamp int64            `json:"timestamp"` // microsecond
+	Fields    []JaegerKeyValue `json:"fields"`
+}
+
+type JaegerProcess struct {
+	ServiceName string           `json:"serviceName"`
+	Tags        []JaegerKeyValue `json:"tags"`
+}
+
+type JaegerDependency struct {
+	Parent    string `json:"parent"`
+	Child     string `json:"child"`
+	CallCount int    `json:"callCount"`
+}
+
+// JaegerTraceQuery holds the filters of GET /api/traces, times are in microseconds
+type JaegerTraceQuery struct {
+	Service     string
+	Operation   string
+	Tags        map[string]string
+	MinDuration int64
+	MaxDuration int64
+	Start       int64
+	End         int64
+	Limit       int
+}
@@ -0,0 +1,69 @@
+package model
+
+// SLO is an objective on the requests of an API: Objective percent of them are good
+// over the last WindowDays days. A request is good when its status is under
+// ErrorStatus and, with a LatencyThreshold, it took at most that many milliseconds
+type SLO struct {
+	ID               string   `json:"id" bson:"_id"`
+	Name             string   `json:"name" bson:"name"`
+	Description      string   `json:"description" bson:"description"`
+	ServiceName      string   `json:"service_name" bson:"service_name"`
+	URIPath          string   `json:"uri_path" bson:"uri_path"`
+	Method           string   `json:"method" bson:"method"`
+	Objective        float64  `json:"objective" bson:"objective"`                 // percent, e.g. 99.5
+	LatencyThreshold int64    `json:"latency_threshold" bson:"latency_threshold"` // milisecond, 0 ignores latency
+	ErrorStatus      int      `json:"error_status" bson:"error_status"`           // default 500
+	WindowDays       int      `json:"window_days" bson:"window_days"`             // default 28
+	FastBurnRate     float64  `json:"fast_burn_rate" bson:"fast_burn_rate"`       // default 14.4, over 1h and 5m
+	SlowBurnRate     float64  `json:"slow_burn_rate" bson:"slow_burn_rate"`       // default 6, over 6h and 30m
+	Alert            bool     `json:"alert" bson:"alert"`                         // record fast and slow burn in the alert history
+	Channels         []string `json:"channels,omitempty" bson:"channels,omitempty"`
+	Enabled          bool     `json:"enabled" bson:"enabled"`
+	CreatedAt        int64    `json:"created_at" bson:"created_at"` // milisecond
+	UpdatedAt        int64    `json:"updated_at" bson:"updated_at"` // milisecond
+}
+
+// SLOState is the latest evaluation of an SLO
+type SLOState struct {
+	SLOID           string             `json:"slo_id" bson:"_id"`
+	Timestamp       int64              `json:"timestamp" bson:"timestamp"` // milisecond
+	Total           int64              `json:"total" bson:"total"`
+	Good            int64              `json:"good" bson:"good"`
+	SLI             float64            `json:"sli" bson:"sli"`                           // percent of good requests
+	ErrorBudget     float64            `json:"error_budget" bson:"error_budget"`         // bad requests allowed so far
+	BudgetRemaining float64            `json:"budget_remaining" bson:"budget_remaining"` // percent, negative once exhausted
+	BurnRates       map[string]float64 `json:"burn_rates" bson:"burn_rates"`             // by window: 5m, 30m, 1h, 6h
+	FastBurn        bool               `json:"fast_burn" bson:"fast_burn"`
+	SlowBurn        bool               `json:"slow_burn" bson:"slow_burn"`
+	CatchingUp      bool               `json:"catching_up" bson:"catching_up"` // the window is not fully counted yet
+	BucketedUntil   int64              `json:"-" bson:"bucketed_until"`        // hours before are counted in slo_bucket
+}
+
+// SLOStatus is an SLO with its state
+type SLOStatus struct {
+	SLO   *SLO      `json:"slo"`
+	State *SLOState `json:"state"`
+}
+
+// SLOSnapshot is a past evaluation of an SLO
+type SLOSnapshot struct {
+	ID              string             `json:"id" bson:"_id"`
+	SLOID           string             `json:"slo_id" bson:"slo_id"`
+	Timestamp       int64              `json:"timestamp" bson:"timestamp"`
+	Total           int64              `json:"total" bson:"total"`
+	Good            int64              `json:"good" bson:"good"`
+	SLI             float64            `json:"sli" bson:"sli"`
+	BudgetRemaining float64            `json:"budget_remaining" bson:"budget_remaining"`
+	BurnRates       map[string]float64 `json:"burn_rates" bson:"burn_rates"`
+	FastBurn        bool               `json:"fast_burn" bson:"fast_burn"`
+	SlowBurn        bool               `json:"slow_burn" bson:"slow_burn"`
+}
+
+// SLOBucket counts the requests of an SLO in an hour
+type SLOBucket struct {
+	ID     string `bson:"_id"`
+	SLOID  string `bson:"slo_id"`
+	Bucket int64  `bson:"bucket"`
+	Total  int64  `bson:"total"`
+	Good   int64  `bson:"good"`
+}
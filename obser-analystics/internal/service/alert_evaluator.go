@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"kuroko.com/analystics/internal/config"
+	"kuroko.com/analystics/internal/model"
+)
+
+const minuteMs = 60 * 1000
+
+// StartAlertEvaluator evaluates the enabled rules every alert.interval until the
+// context is cancelled
+func (s *Service) StartAlertEvaluator(ctx context.Context) {
+	if *config.AlertInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(*config.AlertInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.EvaluateAlertRules(ctx, time.Now().UnixMilli()); err != nil {
+				log.Printf("Failed to evaluate alert rules: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// EvaluateAlertRules evaluates every enabled rule over its window ending at the last
+// complete minute before now, now is in milliseconds
+func (s *Service) EvaluateAlertRules(ctx context.Context, now int64) error {
+	var rules []*model.AlertRule
+	if err := alertRuleCollection.Find(ctx, bson.M{"enabled": true}).All(&rules); err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	var silences []*model.AlertSilence
+	if err := alertSilenceCollection.Find(ctx, bson.M{}).All(&silences); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := s.evaluateAlertRule(ctx, rule, silences, now); err != nil {
+			log.Printf("Failed to evaluate alert rule %s: %v", rule.ID, err)
+		}
+	}
+	return nil
+}
+
+// alertWindowEnd is the end of the last minute complete in the rollups at now, the
+// processor writes a minute until alert.delay after it ends
+func alertWindowEnd(now int64) int64 {
+	return (now - config.AlertDelay.Milliseconds()) / minuteMs * minuteMs
+}
+
+func (s *Service) evaluateAlertRule(ctx context.Context, rule *model.AlertRule, silences []*model.AlertSilence, now int64) error {
+	window, _ := time.ParseDuration(rule.Window)
+	forDuration, _ := time.ParseDuration(rule.For)
+
+	end := alertWindowEnd(now)
+	start := end - window.Milliseconds()
+	cur, err := s.alertWindowTotal(ctx, &rule.Target, start, end)
+	if err != nil {
+		return err
+	}
+	var prev *rollupTotal
+	if rule.Metric == model.AlertMetricRequestRateDrop {
+		if prev, err = s.alertWindowTotal(ctx, &rule.Target, start-window.Milliseconds(), start); err != nil {
+			return err
+		}
+	}
+	value, ok := alertMetricValue(rule, cur, prev, window)
+	breached := ok && ((rule.Operator == "<" && value < rule.Threshold) || (rule.Operator != "<" && value > rule.Threshold))
+
+	var state *model.AlertState
+	err = alertStateCollection.Find(ctx, bson.M{"_id": rule.ID}).One(&state)
+	if qmgo.IsErrNoDocuments(err) {
+		state = &model.AlertState{RuleID: rule.ID, State: model.AlertStateOK, Since: now}
+	} else if err != nil {
+		return err
+	}
+	state.Silenced = false
+	for _, silence := range silences {
+		if silenceMatches(silence, rule, now) {
+			state.Silenced = true
+			break
+		}
+	}
+
+	event := advanceAlertState(state, ok, breached, value, now, forDuration.Milliseconds())
+	if event != "" {
+		if err := s.recordAlertEvent(ctx, rule, state, event, now); err != nil {
+			return err
+		}
+		if event == model.AlertStateFiring {
+			state.NotifiedAt = now
+		}
+	} else {
+		s.notifyStillFiring(ctx, rule, state, now)
+	}
+	_, err = alertStateCollection.UpsertId(ctx, rule.ID, state)
+	return err
+}
+
+// advanceAlertState moves the state machine of a rule forward and returns firing or
+// resolved when an event has to be recorded. Without data a firing rule keeps firing
+// and any other rule shows no_data
+func advanceAlertState(state *model.AlertState, ok, breached bool, value float64, now, forMs int64) string {
+	state.LastEvaluation = now
+	if !ok {
+		if state.State != model.AlertStateFiring && state.State != model.AlertStateNoData {
+			state.State, state.Since = model.AlertStateNoData, now
+		}
+		return ""
+	}
+	state.Value = value
+	switch {
+	case breached && state.State == model.AlertStateFiring:
+		return ""
+	case breached && state.State == model.AlertStatePending:
+		if now-state.Since >= forMs {
+			state.State, state.Since = model.AlertStateFiring, now
+			return model.AlertStateFiring
+		}
+		return ""
+	case breached:
+		if forMs <= 0 {
+			state.State, state.Since = model.AlertStateFiring, now
+			return model.AlertStateFiring
+		}
+		state.State, state.Since = model.AlertStatePending, now
+		return ""
+	case state.State == model.AlertStateFiring:
+		state.State, state.Since = model.AlertStateOK, now
+		return model.AlertStateResolved
+	case state.State != model.AlertStateOK:
+		state.State, state.Since = model.AlertStateOK, now
+	}
+	return ""
+}
+
+// alertWindowTotal merges the minute rollups of the target in [start, end)
+func (s *Service) alertWindowTotal(ctx context.Context, target *model.AlertTarget, start, end int64) (*rollupTotal, error) {
+	var src rollupSource
+	var key bson.M
+	switch target.Kind {
+	case "api":
+		src = apiRollupSource()
+		key = bson.M{"service_name": target.ServiceName, "uri_path": target.URIPath, "method": target.Method}
+	case "path":
+		src, key = pathRollupSource(), bson.M{"path_id": target.PathID}
+	default:
+		src, key = hopRollupSource(), bson.M{"hop_id": target.HopID}
+	}
+	rollups, err := findRollups(ctx, src, key, "minute", start, end-1)
+	if err != nil {
+		return nil, err
+	}
+	total := newRollupTotal()
+	for _, r := range rollups {
+		total.add(r)
+	}
+	return total, nil
+}
+
+// alertMetricValue computes the metric of a rule, ok is false when the window has too
+// few requests to judge
+func alertMetricValue(rule *model.AlertRule, cur, prev *rollupTotal, window time.Duration) (float64, bool) {
+	switch rule.Metric {
+	case model.AlertMetricRequestRate:
+		return float64(cur.count) / window.Minutes(), true
+	case model.AlertMetricRequestRateDrop:
+		if prev == nil || prev.count == 0 || prev.count < rule.MinCount {
+			return 0, false
+		}
+		return float64(prev.count-cur.count) * 100 / float64(prev.count), true
+	}
+	if cur.count == 0 || cur.count < rule.MinCount {
+		return 0, false
+	}
+	if rule.Metric == model.AlertMetricLatency {
+		return float64(cur.sketch.Quantile(rule.Quantile)) / 1000, true // to ms
+	}
+	return float64(cur.errorCount) * 100 / float64(cur.count), true
+}
+
+func (s *Service) recordAlertEvent(ctx context.Context, rule *model.AlertRule, state *model.AlertState, event string, now int64) error {
+	return s.publishAlertEvent(ctx, rule.Channels, newAlertEvent(rule, state, event, now))
+}
+
+// publishAlertEvent keeps the event in the history and queues its notifications unless
+// it is silenced
+func (s *Service) publishAlertEvent(ctx context.Context, channels []string, e *model.AlertEvent) error {
+	if _, err := alertHistoryCollection.InsertOne(ctx, e); err != nil {
+		return err
+	}
+	if !e.Silenced {
+		if err := s.notifyAlertEvent(ctx, channels, e); err != nil {
+			log.Printf("Failed to notify alert %s: %v", e.RuleID, err)
+		}
+	}
+	return nil
+}
+
+func newAlertEvent(rule *model.AlertRule, state *model.AlertState, event string, now int64) *model.AlertEvent {
+	return &model.AlertEvent{
+		ID:        primitive.NewObjectID().Hex(),
+		RuleID:    rule.ID,
+		RuleName:  rule.Name,
+		Target:    rule.Target,
+		Metric:    rule.Metric,
+		State:     event,
+		Value:     state.Value,
+		Threshold: rule.Threshold,
+		Silenced:  state.Silenced,
+		Timestamp: now,
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"kuroko.com/analystics/internal/config"
+	"kuroko.com/analystics/internal/model"
+)
+
+func TestAdvanceAlertState(t *testing.T) {
+	// the rule has been in its state exactly forMs
+	const now, since, forMs = 10_000, 5_000, 5_000
+
+	tests := []struct {
+		name      string
+		state     string
+		ok        bool
+		breached  bool
+		forMs     int64
+		wantState string
+		wantEvent string
+		moved     bool // whether Since is reset to now
+	}{
+		{"no data on an ok rule", model.AlertStateOK, false, false, forMs, model.AlertStateNoData, "", true},
+		{"no data again", model.AlertStateNoData, false, false, forMs, model.AlertStateNoData, "", false},
+		{"no data keeps a firing rule firing", model.AlertStateFiring, false, true, forMs, model.AlertStateFiring, "", false},
+		{"breach without for fires at once", model.AlertStateOK, true, true, 0, model.AlertStateFiring, model.AlertStateFiring, true},
+		{"breach with for goes pending", model.AlertStateOK, true, true, forMs, model.AlertStatePending, "", true},
+		{"breach after no data goes pending", model.AlertStateNoData, true, true, forMs, model.AlertStatePending, "", true},
+		{"pending shorter than for", model.AlertStatePending, true, true, forMs + 1, model.AlertStatePending, "", false},
+		{"pending for long enough fires", model.AlertStatePending, true, true, forMs, model.AlertStateFiring, model.AlertStateFiring, true},
+		{"firing keeps firing", model.AlertStateFiring, true, true, forMs, model.AlertStateFiring, "", false},
+		{"firing recovers", model.AlertStateFiring, true, false, forMs, model.AlertStateOK, model.AlertStateResolved, true},
+		{"pending recovers silently", model.AlertStatePending, true, false, forMs, model.AlertStateOK, "", true},
+		{"no data recovers silently", model.AlertStateNoData, true, false, forMs, model.AlertStateOK, "", true},
+		{"ok stays ok", model.AlertStateOK, true, false, forMs, model.AlertStateOK, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &model.AlertState{State: tt.state, Since: since, Value: -1}
+			event := advanceAlertState(state, tt.ok, tt.breached, 42, now, tt.forMs)
+			if state.State != tt.wantState || event != tt.wantEvent {
+				t.Errorf("got state %q event %q, want state %q event %q", state.State, event, tt.wantState, tt.wantEvent)
+			}
+			wantSince := int64(since)
+			if tt.moved {
+				wantSince = now
+			}
+			if state.Since != wantSince {
+				t.Errorf("Since = %d, want %d", state.Since, wantSince)
+			}
+			if state.LastEvaluation != now {
+				t.Errorf("LastEvaluation = %d, want %d", state.LastEvaluation, now)
+			}
+			if wantValue := map[bool]float64{true: 42, false: -1}[tt.ok]; state.Value != wantValue {
+				t.Errorf("Value = %v, want %v", state.Value, wantValue)
+			}
+		})
+	}
+}
+
+func TestAlertWindowEnd(t *testing.T) {
+	defer func(delay time.Duration) { *config.AlertDelay = delay }(*config.AlertDelay)
+	const minute = int64(28_000_000) * minuteMs
+
+	tests := []struct {
+		name  string
+		delay time.Duration
+		now   int64
+		want  int64
+	}{
+		{"minute still being flushed", 30 * time.Second, minute + 20_000, minute - minuteMs},
+		{"minute complete after the delay", 30 * time.Second, minute + 30_000, minute},
+		{"delay longer than a minute", 90 * time.Second, minute + 80_000, minute - minuteMs},
+		{"no delay", 0, minute + 1, minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*config.AlertDelay = tt.delay
+			if got := alertWindowEnd(tt.now); got != tt.want {
+				t.Errorf("alertWindowEnd(%d) = %d, want %d", tt.now, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"kuroko.com/analystics/internal/model"
+)
+
+// ErrInvalidAlertRule is returned for a rule or silence that cannot be evaluated
+var ErrInvalidAlertRule = errors.New("invalid alert rule")
+
+// ErrAlertNotFound is returned when the rule or silence does not exist
+var ErrAlertNotFound = errors.New("alert not found")
+
+func validateAlertTarget(t *model.AlertTarget) error {
+	switch t.Kind {
+	case "api":
+		if t.ServiceName == "" || t.URIPath == "" || t.Method == "" {
+			return fmt.Errorf("%w: api target needs service_name, uri_path and method", ErrInvalidAlertRule)
+		}
+	case "path":
+		if t.PathID == 0 {
+			return fmt.Errorf("%w: path target needs path_id", ErrInvalidAlertRule)
+		}
+	case "hop":
+		if t.HopID == "" {
+			return fmt.Errorf("%w: hop target needs hop_id", ErrInvalidAlertRule)
+		}
+	default:
+		return fmt.Errorf("%w: target kind must be api, path or hop", ErrInvalidAlertRule)
+	}
+	return nil
+}
+
+func validateAlertRule(rule *model.AlertRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidAlertRule)
+	}
+	if err := validateAlertTarget(&rule.Target); err != nil {
+		return err
+	}
+	switch rule.Metric {
+	case model.AlertMetricErrorRate, model.AlertMetricRequestRate, model.AlertMetricRequestRateDrop:
+	case model.AlertMetricLatency:
+		if rule.Quantile <= 0 || rule.Quantile > 1 {
+			return fmt.Errorf("%w: latency rules need a quantile in (0, 1]", ErrInvalidAlertRule)
+		}
+	default:
+		return fmt.Errorf("%w: unknown metric %q", ErrInvalidAlertRule, rule.Metric)
+	}
+	if rule.Operator == "" {
+		rule.Operator = ">"
+	}
+	if rule.Operator != ">" && rule.Operator != "<" {
+		return fmt.Errorf("%w: operator must be > or <", ErrInvalidAlertRule)
+	}
+	window, err := time.ParseDuration(rule.Window)
+	if err != nil || window < time.Minute || window%time.Minute != 0 {
+		return fmt.Errorf("%w: window must be a whole number of minutes", ErrInvalidAlertRule)
+	}
+	if rule.For != "" {
+		if d, err := time.ParseDuration(rule.For); err != nil || d < 0 {
+			return fmt.Errorf("%w: invalid for", ErrInvalidAlertRule)
+		}
+	}
+	return nil
+}
+
+func (s *Service) FindAllAlertRules(ctx context.Context) ([]*model.AlertRule, error) {
+	rules := []*model.AlertRule{}
+	err := alertRuleCollection.Find(ctx, bson.M{}).Sort("name").All(&rules)
+	return rules, err
+}
+
+func (s *Service) GetAlertRule(ctx context.Context, id string) (*model.AlertRule, error) {
+	var rule *model.AlertRule
+	err := alertRuleCollection.Find(ctx, bson.M{"_id": id}).One(&rule)
+	if qmgo.IsErrNoDocuments(err) {
+		return nil, ErrAlertNotFound
+	}
+	return rule, err
+}
+
+func (s *Service) CreateAlertRule(ctx context.Context, rule *model.AlertRule) (*model.AlertRule, error) {
+	if err := validateAlertRule(rule); err != nil {
+		return nil, err
+	}
+	if err := s.checkAlertChannels(ctx, rule.Channels); err != nil {
+		return nil, err
+	}
+	rule.ID = primitive.NewObjectID().Hex()
+	rule.CreatedAt = time.Now().UnixMilli()
+	rule.UpdatedAt = rule.CreatedAt
+	if _, err := alertRuleCollection.InsertOne(ctx, rule); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// UpdateAlertRule replaces the rule, its state starts over so the new condition is
+// evaluated from scratch
+func (s *Service) UpdateAlertRule(ctx context.Context, id string, rule *model.AlertRule) (*model.AlertRule, error) {
+	old, err := s.GetAlertRule(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateAlertRule(rule); err != nil {
+		return nil, err
+	}
+	if err := s.checkAlertChannels(ctx, rule.Channels); err != nil {
+		return nil, err
+	}
+	rule.ID = id
+	rule.CreatedAt = old.CreatedAt
+	rule.UpdatedAt = time.Now().UnixMilli()
+	if err := alertRuleCollection.ReplaceOne(ctx, bson.M{"_id": id}, rule); err != nil {
+		return nil, err
+	}
+	if err := s.resetAlertState(ctx, old); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (s *Service) DeleteAlertRule(ctx context.Context, id string) error {
+	rule, err := s.GetAlertRule(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := alertRuleCollection.RemoveId(ctx, id); err != nil {
+		return err
+	}
+	return s.resetAlertState(ctx, rule)
+}
+
+// resetAlertState drops the state of a rule, a firing rule is recorded as resolved
+func (s *Service) resetAlertState(ctx context.Context, rule *model.AlertRule) error {
+	var state *model.AlertState
+	err := alertStateCollection.Find(ctx, bson.M{"_id": rule.ID}).One(&state)
+	if qmgo.IsErrNoDocuments(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if state.State == model.AlertStateFiring {
+		if err := s.recordAlertEvent(ctx, rule, state, model.AlertStateResolved, time.Now().UnixMilli()); err != nil {
+			return err
+		}
+	}
+	return alertStateCollection.RemoveId(ctx, rule.ID)
+}
+
+// FindAlertStatuses returns every rule with its latest state, rules never evaluated
+// have a nil state
+func (s *Service) FindAlertStatuses(ctx context.Context) ([]*model.AlertStatus, error) {
+	rules, err := s.FindAllAlertRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var states []*model.AlertState
+	if err := alertStateCollection.Find(ctx, bson.M{}).All(&states); err != nil {
+		return nil, err
+	}
+	byRule := make(map[string]*model.AlertState, len(states))
+	for _, state := range states {
+		byRule[state.RuleID] = state
+	}
+	res := make([]*model.AlertStatus, 0, len(rules))
+	for _, rule := range rules {
+		res = append(res, &model.AlertStatus{Rule: rule, State: byRule[rule.ID]})
+	}
+	return res, nil
+}
+
+// FindAlertHistory returns the firing and resolved events in [from, to], latest first,
+// optionally of one rule
+func (s *Service) FindAlertHistory(ctx context.Context, ruleId string, from, to int64, limit int64) ([]*model.AlertEvent, error) {
+	filter := bson.M{"timestamp": bson.M{"$gte": from, "$lte": to}}
+	if ruleId != "" {
+		filter["rule_id"] = ruleId
+	}
+	events := []*model.AlertEvent{}
+	err := alertHistoryCollection.Find(ctx, filter).Sort("-timestamp").Limit(limit).All(&events)
+	return events, err
+}
+
+func (s *Service) FindAlertSilences(ctx context.Context) ([]*model.AlertSilence, error) {
+	silences := []*model.AlertSilence{}
+	err := alertSilenceCollection.Find(ctx, bson.M{}).Sort("-created_at").All(&silences)
+	return silences, err
+}
+
+func (s *Service) CreateAlertSilence(ctx context.Context, silence *model.AlertSilence) (*model.AlertSilence, error) {
+	if silence.RuleID == "" && silence.Target == (model.AlertTarget{}) {
+		return nil, fmt.Errorf("%w: a silence needs a rule_id or a target", ErrInvalidAlertRule)
+	}
+	now := time.Now().UnixMilli()
+	if silence.StartsAt == 0 {
+		silence.StartsAt = now
+	}
+	if silence.EndsAt != 0 && silence.EndsAt <= silence.StartsAt {
+		return nil, fmt.Errorf("%w: ends_at must be after starts_at", ErrInvalidAlertRule)
+	}
+	silence.ID = primitive.NewObjectID().Hex()
+	silence.CreatedAt = now
+	if _, err := alertSilenceCollection.InsertOne(ctx, silence); err != nil {
+		return nil, err
+	}
+	return silence, nil
+}
+
+func (s *Service) DeleteAlertSilence(ctx context.Context, id string) error {
+	err := alertSilenceCollection.RemoveId(ctx, id)
+	if qmgo.IsErrNoDocuments(err) {
+		return ErrAlertNotFound
+	}
+	return err
+}
+
+// silenceMatches reports whether the silence mutes the rule at now
+func silenceMatches(silence *model.AlertSilence, rule *model.AlertRule, now int64) bool {
+	if now < silence.StartsAt || (silence.EndsAt != 0 && now >= silence.EndsAt) {
+		return false
+	}
+	if silence.RuleID != "" {
+		return silence.RuleID == rule.ID
+	}
+	t, r := silence.Target, rule.Target
+	return (t.Kind == "" || t.Kind == r.Kind) &&
+		(t.ServiceName == "" || t.ServiceName == r.ServiceName) &&
+		(t.URIPath == "" || t.URIPath == r.URIPath) &&
+		(t.Method == "" || t.Method == r.Method) &&
+		(t.PathID == 0 || t.PathID == r.PathID) &&
+		(t.HopID == "" || t.HopID == r.HopID)
+}
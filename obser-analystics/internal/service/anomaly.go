@@ -0,0 +1,218 @@
+package service
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/analystics/internal/config"
+	"kuroko.com/analystics/internal/model"
+)
+
+const (
+	hourMs = 60 * minuteMs
+	weekMs = 7 * 24 * hourMs
+
+	// anomalyEwmaAlpha weighs the last hour in the baseline used while fewer than two
+	// past weeks are known
+	anomalyEwmaAlpha = 0.3
+	// anomalyResiduals is how many past hours the spread of the residuals is taken from
+	anomalyResiduals = 7 * 24
+	// anomalyMinResiduals is how many past hours a series needs before it is scored
+	anomalyMinResiduals = 24
+)
+
+var anomalyMetrics = []string{model.AlertMetricLatency, model.AlertMetricErrorRate, model.AlertMetricRequestRate}
+
+// FindAnomalies scores every hour in [from, to] of the latency, error rate and request
+// rate of every API and path against a seasonal baseline, the median of the same hour
+// of the last anomaly.seasons weeks, or an EWMA of the previous hours while that
+// history is missing. The spread is the MAD of the residuals of the previous week.
+// Series with an anomalous hour are returned, worst first
+func (s *Service) FindAnomalies(ctx context.Context, kind, metric string, from, to, limit int64) ([]*model.AnomalySeries, error) {
+	// the current hour is still being written by the processor
+	from, to = from/hourMs*hourMs, min(to/hourMs*hourMs, time.Now().UnixMilli()/hourMs*hourMs-hourMs)
+	// a week of residuals before the first scored hour, and the seasons before those
+	start := from - int64(anomalyResiduals)*hourMs - int64(*config.AnomalySeasons)*weekMs
+	res := []*model.AnomalySeries{}
+	for _, source := range []struct {
+		kind string
+		rollupSource
+	}{
+		{"api", apiRollupSource()},
+		{"path", pathRollupSource()},
+	} {
+		if kind != "" && kind != source.kind {
+			continue
+		}
+		rollups, err := findHourRollups(ctx, source.rollups, start, to)
+		if err != nil {
+			return nil, err
+		}
+		// history from before rollups were written is read from the raw events
+		seedEnd := to + hourMs
+		if len(rollups) > 0 {
+			seedEnd = rollups[0].Bucket
+		}
+		if seedEnd > start {
+			seed, err := rawRollups(ctx, source.rollupSource, nil, "hour", hourMs, start, seedEnd)
+			if err != nil {
+				return nil, err
+			}
+			rollups = append(seed, rollups...)
+		}
+		for target, hours := range hourSeries(source.kind, rollups) {
+			for _, m := range anomalyMetrics {
+				if metric != "" && metric != m {
+					continue
+				}
+				if a := detectAnomalies(hours, m, start, from, to); a != nil {
+					a.Target = target
+					res = append(res, a)
+				}
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return math.Abs(res[i].Score) > math.Abs(res[j].Score)
+	})
+	if limit > 0 && int64(len(res)) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// findHourRollups loads the hour rollups in [start, end], oldest first
+func findHourRollups(ctx context.Context, coll *qmgo.Collection, start, end int64) ([]*model.Rollup, error) {
+	var rollups []*model.Rollup
+	err := coll.Find(ctx, bson.M{"unit": "hour", "bucket": bson.M{"$gte": start, "$lte": end}}).Sort("bucket").All(&rollups)
+	return rollups, err
+}
+
+// hourSeries merges hour rollups by target
+func hourSeries(kind string, rollups []*model.Rollup) map[model.AlertTarget]map[int64]*rollupTotal {
+	series := make(map[model.AlertTarget]map[int64]*rollupTotal)
+	for _, r := range rollups {
+		target := model.AlertTarget{Kind: kind, ServiceName: r.ServiceName, URIPath: r.URIPath, Method: r.Method, PathID: r.PathID}
+		if series[target] == nil {
+			series[target] = make(map[int64]*rollupTotal)
+		}
+		if series[target][r.Bucket] == nil {
+			series[target][r.Bucket] = newRollupTotal()
+		}
+		series[target][r.Bucket].add(r)
+	}
+	return series
+}
+
+// anomalyValue is the metric of an hour, ok is false when the hour has too few
+// requests to judge. An hour without rollup after the first one of the series had no
+// request
+func anomalyValue(metric string, t *rollupTotal) (float64, bool) {
+	if metric == model.AlertMetricRequestRate {
+		if t == nil {
+			return 0, true
+		}
+		return float64(t.count), true
+	}
+	if t == nil || t.count == 0 || t.count < *config.AnomalyMinCount {
+		return 0, false
+	}
+	if metric == model.AlertMetricLatency {
+		q := *config.AnomalyQuantile
+		return float64(t.quantiles([]float64{q})[strconv.FormatFloat(q, 'f', -1, 64)]) / 1000, true // to ms
+	}
+	return float64(t.errorCount) * 100 / float64(t.count), true
+}
+
+// detectAnomalies walks the hours from start to to, learning the baseline, and scores
+// the hours from from on. It returns nil when no hour is anomalous. Latency and error
+// rate are only anomalous above the baseline, the request rate both ways
+func detectAnomalies(hours map[int64]*rollupTotal, metric string, start, from, to int64) *model.AnomalySeries {
+	// the hours before the series was first seen are unknown, not empty
+	first := to + hourMs
+	for h := range hours {
+		first = min(first, max(h, start))
+	}
+	values := make(map[int64]float64)
+	for h := first; h <= to; h += hourMs {
+		if v, ok := anomalyValue(metric, hours[h]); ok {
+			values[h] = v
+		}
+	}
+	threshold := *config.AnomalyThreshold
+	var (
+		ewma      float64
+		ewmaSet   bool
+		residuals []float64
+		series    = &model.AnomalySeries{Metric: metric}
+		anomalous bool
+	)
+	for h := start; h <= to; h += hourMs {
+		v, ok := values[h]
+		var seasonal []float64
+		for k := 1; k <= *config.AnomalySeasons; k++ {
+			if sv, found := values[h-int64(k)*weekMs]; found {
+				seasonal = append(seasonal, sv)
+			}
+		}
+		expected, have := ewma, ewmaSet
+		if len(seasonal) >= 2 {
+			expected, have = median(seasonal), true
+		}
+
+		if ok && have && h >= from && len(residuals) >= anomalyMinResiduals {
+			// 1.4826 scales the MAD to a standard deviation for normal data, the floor
+			// keeps flat series from scoring every wiggle
+			scale := max(1.4826*median(residuals), 0.05*math.Abs(expected), 1)
+			p := &model.AnomalyPoint{
+				Timestamp: h,
+				Value:     v,
+				Expected:  expected,
+				Lower:     max(expected-threshold*scale, 0),
+				Upper:     expected + threshold*scale,
+				Score:     (v - expected) / scale,
+			}
+			if t := hours[h]; t != nil {
+				p.Count = t.count
+			}
+			p.Anomaly = p.Score >= threshold || (metric == model.AlertMetricRequestRate && p.Score <= -threshold)
+			if p.Anomaly && math.Abs(p.Score) > math.Abs(series.Score) {
+				series.Score, series.Timestamp = p.Score, h
+			}
+			anomalous = anomalous || p.Anomaly
+			series.Points = append(series.Points, p)
+		}
+		if ok && have {
+			residuals = append(residuals, math.Abs(v-expected))
+			if len(residuals) > anomalyResiduals {
+				residuals = residuals[1:]
+			}
+		}
+		if ok {
+			if ewmaSet {
+				ewma = anomalyEwmaAlpha*v + (1-anomalyEwmaAlpha)*ewma
+			} else {
+				ewma, ewmaSet = v, true
+			}
+		}
+	}
+	if !anomalous {
+		return nil
+	}
+	return series
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"testing"
+
+	"kuroko.com/analystics/internal/model"
+)
+
+func TestDetectAnomalies(t *testing.T) {
+	const weeks = 5
+	start := int64(2900) * weekMs
+	to := start + weeks*weekMs - hourMs
+	from := to - 24*hourMs
+
+	// hours builds a series from hour first on, a steady 100 requests with 10% errors
+	// and a small wiggle, where change may override the last hour
+	hours := func(first int64, count, errors int64) map[int64]*rollupTotal {
+		series := make(map[int64]*rollupTotal)
+		for h := first; h <= to; h += hourMs {
+			t := newRollupTotal()
+			wiggle := (h / hourMs) % 3
+			t.count, t.errorCount = 100+wiggle, 10+wiggle%2
+			if h == to {
+				t.count, t.errorCount = count, errors
+			}
+			series[h] = t
+		}
+		return series
+	}
+
+	tests := []struct {
+		name   string
+		hours  map[int64]*rollupTotal
+		metric string
+		// want is the sign of the score of the worst hour, 0 for no anomaly
+		want int
+	}{
+		{"steady requests", hours(start, 101, 10), model.AlertMetricRequestRate, 0},
+		{"request spike", hours(start, 300, 10), model.AlertMetricRequestRate, 1},
+		{"request drop", hours(start, 5, 0), model.AlertMetricRequestRate, -1},
+		{"error spike", hours(start, 100, 60), model.AlertMetricErrorRate, 1},
+		{"fewer errors are not anomalous", hours(start, 100, 0), model.AlertMetricErrorRate, 0},
+		{"error spike on too few requests", hours(start, 10, 10), model.AlertMetricErrorRate, 0},
+		{"series first seen in the middle of the range", hours(start+2*weekMs+5*hourMs, 101, 10), model.AlertMetricRequestRate, 0},
+		{"series seen too briefly to be scored", hours(to-10*hourMs, 300, 10), model.AlertMetricRequestRate, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			series := detectAnomalies(tt.hours, tt.metric, start, from, to)
+			if tt.want == 0 {
+				if series != nil {
+					t.Fatalf("got anomaly at %d with score %.2f, want none", series.Timestamp, series.Score)
+				}
+				return
+			}
+			if series == nil {
+				t.Fatal("got no anomaly")
+			}
+			if series.Timestamp != to || (series.Score > 0) != (tt.want > 0) {
+				t.Errorf("got worst hour %d with score %.2f, want hour %d with sign %d", series.Timestamp, series.Score, to, tt.want)
+			}
+			for _, p := range series.Points {
+				if p.Timestamp < from {
+					t.Errorf("point %d scored before from %d", p.Timestamp, from)
+				}
+				if p.Anomaly != (p.Timestamp == to) {
+					t.Errorf("point %d anomaly = %v", p.Timestamp, p.Anomaly)
+				}
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package service
 
 import (
 	"context"
-	"sort"
 	"strconv"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -16,7 +15,7 @@ type Log struct {
 	Duration   int64 `json:"duration" bson:"duration"`
 }
 
-func (s *Service) GetApiStatisticService(ctx context.Context, serviceName, uri_path, method, _from, _to, unit string) (*model.ApiStatistic, error) {
+func (s *Service) GetApiStatisticService(ctx context.Context, serviceName, uri_path, method, _from, _to, unit string, quantiles []float64) (*model.ApiStatistic, error) {
 	from, to := ParseFromToStringToInt(_from, _to)
 	interval := ParseUnitToInterval(unit)
 
@@ -28,6 +27,14 @@ func (s *Service) GetApiStatisticService(ctx context.Context, serviceName, uri_p
 		To:          to,
 		Unit:        unit,
 	}
+	if unitName, ok := rollupUnitFor(interval); ok {
+		key := bson.M{"service_name": serviceName, "uri_path": uri_path, "method": method}
+		rollups, err := findRollups(ctx, apiRollupSource(), key, unitName, from, to)
+		if err != nil {
+			return nil, err
+		}
+		return buildApiStatisticFromRollups(res, rollups, interval, quantiles), nil
+	}
 	filter := bson.M{
 		"service_name": serviceName,
 		"uri_path":     uri_path,
@@ -61,30 +68,70 @@ func (s *Service) GetApiStatisticService(ctx context.Context, serviceName, uri_p
 	res.ErrorRate = float32(errCount) / float32(count)
 	res.ErrorDist = errDist
 	res.ErrorDistTime = errTimeDist
-	res.Latency, res.LatencyDist = s.GetLatencyService(ctx, logs, from, to, interval)
+	res.Latency, res.LatencyDist, res.Quantiles = s.GetLatencyService(ctx, logs, from, to, interval, quantiles)
 	return res, nil
 }
 
-func (s *Service) GetLatencyService(ctx context.Context, logs []*Log, from, to int64, unit int64) (map[string]int, map[int64]int) {
-	var latencies []int
-	for _, log := range logs {
-		latencies = append(latencies, int(log.Duration))
+// buildApiStatisticFromRollups fills the statistic like the raw log path does, it
+// returns nil when the range has no request
+func buildApiStatisticFromRollups(res *model.ApiStatistic, rollups []*model.Rollup, interval int64, quantiles []float64) *model.ApiStatistic {
+	total, buckets := sumRollups(rollups, res.From, res.To, interval)
+	if total.count == 0 {
+		return nil
+	}
+	res.Count = int(total.count)
+	res.Frequency = float32(res.Count) * float32(interval) / float32(res.To-res.From)
+	res.ErrorCount = int(total.errorCount)
+	res.ErrorRate = float32(res.ErrorCount) / float32(res.Count)
+	res.ErrorDist = map[int]int{}
+	for code, n := range total.statusCodes {
+		if code >= 400 && code <= 600 && n > 0 {
+			res.ErrorDist[code] = int(n)
+		}
+	}
+	p := total.quantiles(DefaultQuantiles)
+	res.Latency = map[string]int{
+		"max": int(total.latencyMax),
+		"min": int(total.latencyMin),
+		"avg": int(total.latencySum / total.count),
+		"p50": p["0.5"],
+		"p95": p["0.95"],
+		"p99": p["0.99"],
+	}
+	res.Quantiles = total.quantiles(quantiles)
+	res.Distribution, res.ErrorDistTime, res.LatencyDist = map[int64]int{}, map[int64]int{}, map[int64]int{}
+	for k, b := range buckets {
+		res.Distribution[k] = int(b.count)
+		res.ErrorDistTime[k] = int(b.errorCount)
+		res.LatencyDist[k] = 0
+		if b.count > 0 {
+			res.LatencyDist[k] = int(b.latencySum / b.count / 1000) // to ms
+		}
 	}
-	sort.Slice(latencies, func(i, j int) bool {
-		return latencies[i] < latencies[j]
-	})
-	count := len(latencies)
-	var sum int = 0
-	for _, l := range latencies {
-		sum += l
+	return res
+}
+
+// GetLatencyService summarizes the latencies of the logs, quantiles are estimated with
+// a sketch like rollups are
+func (s *Service) GetLatencyService(ctx context.Context, logs []*Log, from, to int64, unit int64, quantiles []float64) (map[string]int, map[int64]int, map[string]int) {
+	sketch := NewSketch()
+	var sum, minLatency, maxLatency int64
+	for i, log := range logs {
+		sketch.Add(log.Duration)
+		sum += log.Duration
+		if i == 0 || log.Duration < minLatency {
+			minLatency = log.Duration
+		}
+		maxLatency = max(maxLatency, log.Duration)
 	}
+	p := sketch.Quantiles(DefaultQuantiles)
 	res := map[string]int{
-		"max": latencies[count-1],
-		"min": latencies[0],
-		"avg": sum / count,
-		"p50": latencies[count/2],
-		"p95": latencies[int(float32(count)*float32(0.95))],
-		"p99": latencies[int(float32(count)*float32(0.99))],
+		"max": int(maxLatency),
+		"min": int(minLatency),
+		"avg": int(sum / int64(len(logs))),
+		"p50": p["0.5"],
+		"p95": p["0.95"],
+		"p99": p["0.99"],
 	}
 	var resDist = map[int64]int{}
 	var sumDist = map[int64]int{}
@@ -105,7 +152,7 @@ func (s *Service) GetLatencyService(ctx context.Context, logs []*Log, from, to i
 		}
 		resDist[k] = sumDist[k] / v / 1000 // to ms
 	}
-	return res, resDist
+	return res, resDist, sketch.Quantiles(quantiles)
 }
 
 func (s *Service) GetApiErrorService(ctx context.Context, logs []*Log, from, to, unit int64) (int, map[int]int, map[int64]int) {
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/analystics/internal/model"
+)
+
+type spanNode struct {
+	span     *model.CriticalPathSpan
+	children []*spanNode
+}
+
+func (n *spanNode) end() int64 {
+	return n.span.StartTime + n.span.Duration
+}
+
+// GetCriticalPath walks the trace tree backwards from the end of each span, at every
+// point the child finishing last is what the parent was waiting for, time no child
+// covers is the parent's own. Returns nil when no span of the trace is stored.
+func (s *Service) GetCriticalPath(ctx context.Context, traceId string) (*model.CriticalPathResponse, error) {
+	var spans []*model.Span
+	if err := spanCollection.Find(ctx, bson.M{"trace_id": traceId}).All(&spans); err != nil {
+		return nil, err
+	}
+	if len(spans) == 0 {
+		return nil, nil
+	}
+	return buildCriticalPath(traceId, spans), nil
+}
+
+func buildCriticalPath(traceId string, spans []*model.Span) *model.CriticalPathResponse {
+	res := &model.CriticalPathResponse{TraceID: traceId}
+	nodes := make(map[string]*spanNode, len(spans))
+	for _, span := range spans {
+		cp := &model.CriticalPathSpan{
+			SpanID:    span.ID,
+			ParentID:  span.ParentID,
+			Service:   span.Service,
+			Operation: span.Operation,
+			StartTime: span.Timestamp,
+			Duration:  int64(span.Duration),
+		}
+		res.Spans = append(res.Spans, cp)
+		nodes[span.ID] = &spanNode{span: cp}
+	}
+
+	// spans whose parent is missing are handled as extra roots
+	var roots []*spanNode
+	traceStart, traceEnd := res.Spans[0].StartTime, res.Spans[0].StartTime
+	for _, node := range nodes {
+		if parent, ok := nodes[node.span.ParentID]; ok && node.span.ParentID != node.span.SpanID {
+			parent.children = append(parent.children, node)
+		} else {
+			roots = append(roots, node)
+		}
+		traceStart = min(traceStart, node.span.StartTime)
+		traceEnd = max(traceEnd, node.end())
+	}
+	res.Duration = traceEnd - traceStart
+
+	for _, node := range nodes {
+		node.span.SelfTime = selfTime(node)
+	}
+	// the roots are walked like the children of a span covering the whole trace
+	walkCriticalPath(&spanNode{
+		span:     &model.CriticalPathSpan{StartTime: traceStart, Duration: res.Duration},
+		children: roots,
+	}, traceEnd)
+
+	services := make(map[string]*model.CriticalPathService)
+	for _, cp := range res.Spans {
+		svc, ok := services[cp.Service]
+		if !ok {
+			svc = &model.CriticalPathService{Service: cp.Service}
+			services[cp.Service] = svc
+			res.Services = append(res.Services, svc)
+		}
+		svc.SelfTime += cp.SelfTime
+		svc.CriticalTime += cp.CriticalTime
+	}
+	for _, svc := range res.Services {
+		if res.Duration > 0 {
+			svc.Percentage = float32(svc.CriticalTime) * 100 / float32(res.Duration)
+		}
+	}
+	sort.Slice(res.Services, func(i, j int) bool {
+		return res.Services[i].CriticalTime > res.Services[j].CriticalTime
+	})
+	sort.Slice(res.Spans, func(i, j int) bool {
+		return res.Spans[i].StartTime < res.Spans[j].StartTime
+	})
+	return res
+}
+
+// walkCriticalPath credits node with the time before end that none of its children on
+// the critical path cover, children ending after end are clipped
+func walkCriticalPath(node *spanNode, end int64) {
+	node.span.OnCriticalPath = true
+	cursor := min(end, node.end())
+
+	children := append([]*spanNode(nil), node.children...)
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].end() > children[j].end()
+	})
+	for _, child := range children {
+		if cursor <= node.span.StartTime {
+			break
+		}
+		// the child started after what the parent was waiting for
+		if child.span.StartTime >= cursor {
+			continue
+		}
+		childEnd := min(child.end(), cursor)
+		node.span.CriticalTime += cursor - childEnd
+		walkCriticalPath(child, childEnd)
+		cursor = max(child.span.StartTime, node.span.StartTime)
+	}
+	if cursor > node.span.StartTime {
+		node.span.CriticalTime += cursor - node.span.StartTime
+	}
+}
+
+// selfTime is the part of the span not covered by any of its children
+func selfTime(node *spanNode) int64 {
+	start, end := node.span.StartTime, node.end()
+	intervals := make([][2]int64, 0, len(node.children))
+	for _, child := range node.children {
+		cs, ce := max(child.span.StartTime, start), min(child.end(), end)
+		if cs < ce {
+			intervals = append(intervals, [2]int64{cs, ce})
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i][0] < intervals[j][0] })
+
+	covered, cursor := int64(0), start
+	for _, iv := range intervals {
+		if iv[1] <= cursor {
+			continue
+		}
+		covered += iv[1] - max(iv[0], cursor)
+		cursor = iv[1]
+	}
+	return end - start - covered
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"testing"
+
+	"kuroko.com/analystics/internal/model"
+)
+
+func TestBuildCriticalPath(t *testing.T) {
+	span := func(id, parentID, service string, start int64, duration int) *model.Span {
+		return &model.Span{ID: id, ParentID: parentID, Service: service, Operation: id, Timestamp: start, Duration: duration}
+	}
+
+	tests := []struct {
+		name     string
+		spans    []*model.Span
+		duration int64
+		// self and critical time by span, spans with no critical time are off the path
+		want map[string][2]int64
+		// critical time by service, largest first
+		services []string
+	}{
+		{
+			name:     "sequential calls",
+			spans:    []*model.Span{span("a", "", "gateway", 0, 100), span("b", "a", "order", 10, 30), span("c", "a", "order", 50, 40)},
+			duration: 100,
+			want:     map[string][2]int64{"a": {30, 30}, "b": {30, 30}, "c": {40, 40}},
+			services: []string{"order", "gateway"},
+		},
+		{
+			name:     "parallel calls wait for the longest",
+			spans:    []*model.Span{span("a", "", "gateway", 0, 100), span("b", "a", "user", 10, 50), span("c", "a", "order", 10, 80)},
+			duration: 100,
+			want:     map[string][2]int64{"a": {20, 20}, "b": {50, 0}, "c": {80, 80}},
+			services: []string{"order", "gateway", "user"},
+		},
+		{
+			name:     "grandchild outliving its parent is clipped",
+			spans:    []*model.Span{span("a", "", "gateway", 0, 100), span("b", "a", "order", 10, 40), span("c", "b", "db", 20, 50)},
+			duration: 100,
+			want:     map[string][2]int64{"a": {60, 60}, "b": {10, 10}, "c": {50, 30}},
+			services: []string{"gateway", "db", "order"},
+		},
+		{
+			name:     "spans under a missing parent are extra roots",
+			spans:    []*model.Span{span("a", "", "gateway", 0, 40), span("x", "gone", "order", 60, 40)},
+			duration: 100,
+			want:     map[string][2]int64{"a": {40, 40}, "x": {40, 40}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := buildCriticalPath("t", tt.spans)
+			if res.Duration != tt.duration {
+				t.Errorf("duration = %d, want %d", res.Duration, tt.duration)
+			}
+			for i, cp := range res.Spans {
+				if i > 0 && cp.StartTime < res.Spans[i-1].StartTime {
+					t.Errorf("spans are not ordered by start time")
+				}
+				want := tt.want[cp.SpanID]
+				if cp.SelfTime != want[0] || cp.CriticalTime != want[1] || cp.OnCriticalPath != (want[1] > 0) {
+					t.Errorf("span %s: self %d, critical %d, on path %v, want %v", cp.SpanID, cp.SelfTime, cp.CriticalTime, cp.OnCriticalPath, want)
+				}
+			}
+			if tt.services == nil {
+				return
+			}
+			if len(res.Services) != len(tt.services) {
+				t.Fatalf("got %d services, want %v", len(res.Services), tt.services)
+			}
+			for i, svc := range res.Services {
+				if svc.Service != tt.services[i] {
+					t.Errorf("service %d is %s, want %s", i, svc.Service, tt.services[i])
+				}
+				if want := float32(svc.CriticalTime) * 100 / float32(tt.duration); svc.Percentage != want {
+					t.Errorf("service %s percentage %v, want %v", svc.Service, svc.Percentage, want)
+				}
+			}
+		})
+	}
+}
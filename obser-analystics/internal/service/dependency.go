@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/analystics/internal/model"
+)
+
+// missingParentService is the service of the synthetic spans the processor's repair mode
+// puts in place of parents that never arrived, they are no service of the graph
+const missingParentService = "missing parent"
+
+// GetDependencyGraph merges the hops of every path into a directed call graph between
+// services, or between operations when level is "operation", from and to are in milliseconds
+func (s *Service) GetDependencyGraph(ctx context.Context, _from, _to, level string, quantiles []float64) (*model.DependencyGraph, error) {
+	if level != "service" && level != "operation" {
+		return nil, errors.New("level must be service or operation")
+	}
+	from, to := ParseFromToStringToInt(_from, _to)
+
+	hopStats, err := loadHopStats(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(hopStats) == 0 {
+		return &model.DependencyGraph{Nodes: []model.Node{}, Edges: []model.DependencyEdge{}}, nil
+	}
+
+	hopIds := make([]string, 0, len(hopStats))
+	for hopId := range hopStats {
+		hopIds = append(hopIds, hopId)
+	}
+	var hops []*model.Hop
+	if err := hopCollection.Find(ctx, bson.M{"_id": bson.M{"$in": hopIds}}).All(&hops); err != nil {
+		return nil, err
+	}
+	return buildDependencyGraph(hops, hopStats, level, quantiles), nil
+}
+
+// buildDependencyGraph merges the traffic of the hops into edges between their nodes
+func buildDependencyGraph(hops []*model.Hop, hopStats map[string]*hopStat, level string, quantiles []float64) *model.DependencyGraph {
+	res := &model.DependencyGraph{Nodes: []model.Node{}, Edges: []model.DependencyEdge{}}
+	nodes := make(map[string]bool)
+	addNode := func(service, operation string) string {
+		node := model.Node{ID: service, Service: service}
+		if level == "operation" {
+			node.ID = strings.ToUpper(service + "_" + operation)
+			node.Operation = operation
+		}
+		if !nodes[node.ID] {
+			nodes[node.ID] = true
+			res.Nodes = append(res.Nodes, node)
+		}
+		return node.ID
+	}
+
+	edges := make(map[string]int)
+	sketches := make(map[string]*Sketch)
+	for _, hop := range hops {
+		h, ok := hopStats[hop.ID]
+		if !ok || hop.CalledService == missingParentService {
+			continue
+		}
+		target := addNode(hop.CalledService, hop.CalledOperation)
+		// hops from the synthetic root or a missing parent only mark entry points
+		if hop.CallerService == "root" || hop.CallerService == missingParentService {
+			continue
+		}
+		source := addNode(hop.CallerService, hop.CallerOperation)
+
+		id := source + "->" + target
+		i, ok := edges[id]
+		if !ok {
+			i = len(res.Edges)
+			edges[id] = i
+			res.Edges = append(res.Edges, model.DependencyEdge{
+				Edge: model.Edge{ID: id, Source: source, Target: target},
+			})
+		}
+		res.Edges[i].CallCount += h.count
+		res.Edges[i].ErrorCount += h.errors
+		if sketches[id] == nil {
+			sketches[id] = NewSketch()
+		}
+		sketches[id].Merge(h.sketch)
+	}
+
+	for i := range res.Edges {
+		edge := &res.Edges[i]
+		sketch := sketches[edge.ID]
+		edge.P50, edge.P95, edge.P99 = int(sketch.Quantile(0.5)), int(sketch.Quantile(0.95)), int(sketch.Quantile(0.99))
+		edge.Quantiles = sketch.Quantiles(quantiles)
+		if edge.CallCount > 0 {
+			edge.ErrorRate = float32(edge.ErrorCount) / float32(edge.CallCount)
+		}
+		edge.Label = fmt.Sprintf("%d calls, %.1f%% errors, p95 %dus", edge.CallCount, edge.ErrorRate*100, edge.P95)
+	}
+	return res
+}
+
+// hopStat is the traffic of one hop over the range of a dependency graph
+type hopStat struct {
+	count  int
+	errors int
+	sketch *Sketch
+}
+
+// loadHopStats reads the hop rollups, or aggregates the raw hop events into sketches
+// when the range is too short for them
+func loadHopStats(ctx context.Context, from, to int64) (map[string]*hopStat, error) {
+	stats := make(map[string]*hopStat)
+	if to < from {
+		return stats, nil
+	}
+	var rollups []*model.Rollup
+	var err error
+	if unit, ok := rollupUnitForRange(from, to); ok {
+		rollups, err = findRollups(ctx, hopRollupSource(), nil, unit, from, to)
+	} else {
+		// one bucket spans the range, or two when it straddles a multiple of its size
+		rollups, err = rawRollups(ctx, hopRollupSource(), nil, "", to-from+1, from, to+1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rollups {
+		if r.Count <= 0 {
+			continue
+		}
+		stat, ok := stats[r.HopID]
+		if !ok {
+			stat = &hopStat{sketch: NewSketch()}
+			stats[r.HopID] = stat
+		}
+		stat.count += int(r.Count)
+		stat.errors += int(r.ErrorCount)
+		stat.sketch.AddBins(r.Sketch)
+	}
+	return stats, nil
+}
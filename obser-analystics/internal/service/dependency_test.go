@@ -0,0 +1,92 @@
+package service
+
+import (
+	"sort"
+	"testing"
+
+	"kuroko.com/analystics/internal/model"
+)
+
+func TestBuildDependencyGraph(t *testing.T) {
+	hop := func(id, callerService, callerOperation, calledService, calledOperation string) *model.Hop {
+		return &model.Hop{ID: id, CallerService: callerService, CallerOperation: callerOperation, CalledService: calledService, CalledOperation: calledOperation}
+	}
+	stat := func(count, errors int, duration int64) *hopStat {
+		sketch := NewSketch()
+		for i := 0; i < count; i++ {
+			sketch.Add(duration)
+		}
+		return &hopStat{count: count, errors: errors, sketch: sketch}
+	}
+	hops := []*model.Hop{
+		hop("entry", "root", "", "gateway", "GET /order"),
+		hop("load", "gateway", "GET /order", "order", "load"),
+		hop("store", "gateway", "GET /order", "order", "store"),
+		hop("orphan", missingParentService, missingParentService, "order", "load"),
+		hop("lost", "order", "load", missingParentService, missingParentService),
+		hop("idle", "gateway", "GET /order", "user", "auth"),
+	}
+	stats := map[string]*hopStat{
+		"entry":  stat(10, 0, 5000),
+		"load":   stat(8, 2, 1000),
+		"store":  stat(2, 0, 3000),
+		"orphan": stat(1, 0, 1000),
+		"lost":   stat(1, 0, 1000),
+	}
+
+	tests := []struct {
+		level string
+		nodes []string
+		// edges by id with their call count, error count and p99
+		edges map[string][3]int
+	}{
+		{
+			"service",
+			[]string{"gateway", "order"},
+			map[string][3]int{"gateway->order": {10, 2, 3000}},
+		},
+		{
+			"operation",
+			[]string{"GATEWAY_GET /ORDER", "ORDER_LOAD", "ORDER_STORE"},
+			map[string][3]int{
+				"GATEWAY_GET /ORDER->ORDER_LOAD":  {8, 2, 1000},
+				"GATEWAY_GET /ORDER->ORDER_STORE": {2, 0, 3000},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			graph := buildDependencyGraph(hops, stats, tt.level, []float64{0.99})
+			var nodes []string
+			for _, node := range graph.Nodes {
+				nodes = append(nodes, node.ID)
+			}
+			sort.Strings(nodes)
+			if len(nodes) != len(tt.nodes) {
+				t.Fatalf("nodes = %v, want %v", nodes, tt.nodes)
+			}
+			for i := range nodes {
+				if nodes[i] != tt.nodes[i] {
+					t.Fatalf("nodes = %v, want %v", nodes, tt.nodes)
+				}
+			}
+			if len(graph.Edges) != len(tt.edges) {
+				t.Fatalf("got %d edges, want %d", len(graph.Edges), len(tt.edges))
+			}
+			for _, edge := range graph.Edges {
+				want, ok := tt.edges[edge.ID]
+				if !ok {
+					t.Errorf("unexpected edge %s", edge.ID)
+					continue
+				}
+				p99 := edge.Quantiles["0.99"]
+				if edge.CallCount != want[0] || edge.ErrorCount != want[1] || p99 < want[2]*99/100 || p99 > want[2]*101/100 {
+					t.Errorf("edge %s has %d calls, %d errors, p99 %d, want %v", edge.ID, edge.CallCount, edge.ErrorCount, p99, want)
+				}
+				if wantRate := float32(want[1]) / float32(want[0]); edge.ErrorRate != wantRate {
+					t.Errorf("edge %s error rate %v, want %v", edge.ID, edge.ErrorRate, wantRate)
+				}
+			}
+		})
+	}
+}
@@ -2,24 +2,17 @@ package service
 
 import (
 	"fmt"
-	"os"
-
 	"github.com/elastic/go-elasticsearch/v7"
+	"kuroko.com/analystics/internal/config"
 )
 
 var esClient *elasticsearch.Client
 
 // InitElasticsearch initializes the Elasticsearch client
 func (s *Service) InitElasticsearch() error {
-	// Get Elasticsearch URL from environment variable or use default
-	esURL := os.Getenv("ELASTICSEARCH_URL")
-	if esURL == "" {
-		esURL = "http://localhost:9200"
-	}
-
 	// Create Elasticsearch client
 	cfg := elasticsearch.Config{
-		Addresses: []string{esURL},
+		Addresses: []string{*config.ElasticsearchURL},
 	}
 
 	var err error
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"kuroko.com/analystics/internal/model"
+)
+
+// FindJaegerTraces returns the latest traces having a span that matches every filter
+// of the query
+func (s *Service) FindJaegerTraces(ctx context.Context, q *model.JaegerTraceQuery) ([]*model.JaegerTrace, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: jaegerSpanMatch(q)}},
+		{{Key: "$group", Value: bson.M{"_id": "$trace_id", "start": bson.M{"$min": "$timestamp"}}}},
+		{{Key: "$sort", Value: bson.M{"start": -1}}},
+		{{Key: "$limit", Value: q.Limit}},
+	}
+	var found []struct {
+		TraceID string `bson:"_id"`
+	}
+	if err := spanCollection.Aggregate(ctx, pipeline).All(&found); err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return []*model.JaegerTrace{}, nil
+	}
+
+	traceIds := make([]string, 0, len(found))
+	for _, f := range found {
+		traceIds = append(traceIds, f.TraceID)
+	}
+	var spans []*model.Span
+	err := spanCollection.Find(ctx, bson.M{"trace_id": bson.M{"$in": traceIds}}).Sort("timestamp").All(&spans)
+	if err != nil {
+		return nil, err
+	}
+	byTrace := make(map[string][]*model.Span)
+	for _, span := range spans {
+		byTrace[span.TraceID] = append(byTrace[span.TraceID], span)
+	}
+
+	res := make([]*model.JaegerTrace, 0, len(traceIds))
+	for _, traceId := range traceIds {
+		res = append(res, toJaegerTrace(traceId, byTrace[traceId]))
+	}
+	return res, nil
+}
+
+// jaegerSpanMatch filters the spans matching every filter of the query, the error tag
+// is the stored error flag
+func jaegerSpanMatch(q *model.JaegerTraceQuery) bson.M {
+	match := bson.M{
+		"timestamp": bson.M{"$gte": q.Start, "$lte": q.End},
+	}
+	if q.Service != "" {
+		match["service"] = q.Service
+	}
+	if q.Operation != "" {
+		match["operation"] = q.Operation
+	}
+	duration := bson.M{}
+	if q.MinDuration > 0 {
+		duration["$gte"] = q.MinDuration
+	}
+	if q.MaxDuration > 0 {
+		duration["$lte"] = q.MaxDuration
+	}
+	if len(duration) > 0 {
+		match["duration"] = duration
+	}
+	var tags bson.A
+	for key, value := range q.Tags {
+		if key == "error" {
+			match["has_error"] = value == "true"
+			continue
+		}
+		tags = append(tags, bson.M{"$elemMatch": bson.M{"key": key, "value": value}})
+	}
+	if len(tags) > 0 {
+		match["tags"] = bson.M{"$all": tags}
+	}
+	return match
+}
+
+// GetJaegerTrace returns nil when no span of the trace is stored
+func (s *Service) GetJaegerTrace(ctx context.Context, traceId string) (*model.JaegerTrace, error) {
+	var spans []*model.Span
+	err := spanCollection.Find(ctx, bson.M{"trace_id": traceId}).Sort("timestamp").All(&spans)
+	if err != nil {
+		return nil, err
+	}
+	if len(spans) == 0 {
+		return nil, nil
+	}
+	return toJaegerTrace(traceId, spans), nil
+}
+
+// GetJaegerDependencies counts the calls between services from hop events, from and
+// to are in milliseconds
+func (s *Service) GetJaegerDependencies(ctx context.Context, from, to int64) ([]*model.JaegerDependency, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"timestamp": bson.M{"$gte": from, "$lte": to}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$hop_id", "count": bson.M{"$sum": 1}}}},
+	}
+	var counts []struct {
+		HopID string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err := hopEventCollection.Aggregate(ctx, pipeline).All(&counts); err != nil {
+		return nil, err
+	}
+	if len(counts) == 0 {
+		return []*model.JaegerDependency{}, nil
+	}
+
+	hopIds := make([]string, 0, len(counts))
+	calls := make(map[string]int, len(counts))
+	for _, c := range counts {
+		hopIds = append(hopIds, c.HopID)
+		calls[c.HopID] = c.Count
+	}
+	var hops []*model.Hop
+	if err := hopCollection.Find(ctx, bson.M{"_id": bson.M{"$in": hopIds}}).All(&hops); err != nil {
+		return nil, err
+	}
+	return jaegerDependencies(hops, calls), nil
+}
+
+// jaegerDependencies merges the calls of the hops into calls between services
+func jaegerDependencies(hops []*model.Hop, calls map[string]int) []*model.JaegerDependency {
+	edges := make(map[string]*model.JaegerDependency)
+	res := []*model.JaegerDependency{}
+	for _, hop := range hops {
+		count, ok := calls[hop.ID]
+		// hops from the synthetic root mark entry points and the missing parents of
+		// repaired traces are no service, neither are calls
+		if !ok || hop.CallerService == "root" || hop.CallerService == missingParentService || hop.CalledService == missingParentService {
+			continue
+		}
+		key := hop.CallerService + "\x00" + hop.CalledService
+		edge, ok := edges[key]
+		if !ok {
+			edge = &model.JaegerDependency{Parent: hop.CallerService, Child: hop.CalledService}
+			edges[key] = edge
+			res = append(res, edge)
+		}
+		edge.CallCount += count
+	}
+	return res
+}
+
+var jaegerSpanKinds = map[string]string{
+	"SPAN_KIND_INTERNAL": "internal",
+	"SPAN_KIND_SERVER":   "server",
+	"SPAN_KIND_CLIENT":   "client",
+	"SPAN_KIND_PRODUCER": "producer",
+	"SPAN_KIND_CONSUMER": "consumer",
+}
+
+var jaegerStatusCodes = map[string]string{
+	"STATUS_CODE_OK":    "OK",
+	"STATUS_CODE_ERROR": "ERROR",
+}
+
+func toJaegerTrace(traceId string, spans []*model.Span) *model.JaegerTrace {
+	trace := &model.JaegerTrace{
+		TraceID:   traceId,
+		Spans:     make([]model.JaegerSpan, 0, len(spans)),
+		Processes: make(map[string]model.JaegerProcess),
+	}
+	processIds := make(map[string]string)
+	for _, span := range spans {
+		processId, ok := processIds[span.Service]
+		if !ok {
+			processId = fmt.Sprintf("p%d", len(processIds)+1)
+			processIds[span.Service] = processId
+			trace.Processes[processId] = model.JaegerProcess{
+				ServiceName: span.Service,
+				Tags:        []model.JaegerKeyValue{},
+			}
+		}
+
+		js := model.JaegerSpan{
+			TraceID:       traceId,
+			SpanID:        span.ID,
+			OperationName: span.Operation,
+			References:    []model.JaegerReference{},
+			StartTime:     span.Timestamp,
+			Duration:      int64(span.Duration),
+			Tags:          []model.JaegerKeyValue{},
+			Logs:          []model.JaegerLog{},
+			ProcessID:     processId,
+		}
+		if span.ParentID != "" {
+			js.References = append(js.References, model.JaegerReference{
+				RefType: "CHILD_OF",
+				TraceID: traceId,
+				SpanID:  span.ParentID,
+			})
+		}
+		if span.HasError {
+			js.Tags = append(js.Tags, model.JaegerKeyValue{Key: "error", Type: "bool", Value: true})
+			if msg := strings.TrimSpace(span.Error); len(span.Tags) == 0 && msg != "" && msg != "true" {
+				js.Tags = append(js.Tags, model.JaegerKeyValue{Key: "error.message", Type: "string", Value: msg})
+			}
+		}
+		for _, tag := range span.Tags {
+			if tag.Key == "error" {
+				continue
+			}
+			js.Tags = append(js.Tags, model.JaegerKeyValue{Key: tag.Key, Type: "string", Value: tag.Value})
+		}
+		if kind, ok := jaegerSpanKinds[span.Kind]; ok {
+			js.Tags = append(js.Tags, model.JaegerKeyValue{Key: "span.kind", Type: "string", Value: kind})
+		}
+		if code, ok := jaegerStatusCodes[span.StatusCode]; ok {
+			js.Tags = append(js.Tags, model.JaegerKeyValue{Key: "otel.status_code", Type: "string", Value: code})
+			if span.StatusMessage != "" {
+				js.Tags = append(js.Tags, model.JaegerKeyValue{Key: "otel.status_description", Type: "string", Value: span.StatusMessage})
+			}
+		}
+		for _, event := range span.Events {
+			fields := []model.JaegerKeyValue{{Key: "event", Type: "string", Value: event.Name}}
+			for _, attr := range event.Attributes {
+				fields = append(fields, model.JaegerKeyValue{Key: attr.Key, Type: "string", Value: attr.Value})
+			}
+			js.Logs = append(js.Logs, model.JaegerLog{Timestamp: event.Timestamp, Fields: fields})
+		}
+		for _, link := range span.Links {
+			js.References = append(js.References, model.JaegerReference{
+				RefType: "FOLLOWS_FROM",
+				TraceID: link.TraceID,
+				SpanID:  link.SpanID,
+			})
+		}
+		trace.Spans = append(trace.Spans, js)
+	}
+	return trace
+}
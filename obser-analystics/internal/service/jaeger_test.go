@@ -0,0 +1,108 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/analystics/internal/model"
+)
+
+func TestJaegerSpanMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		q    *model.JaegerTraceQuery
+		want bson.M
+	}{
+		{
+			"time range only",
+			&model.JaegerTraceQuery{Start: 1, End: 2},
+			bson.M{"timestamp": bson.M{"$gte": int64(1), "$lte": int64(2)}},
+		},
+		{
+			"error tag reads the error flag",
+			&model.JaegerTraceQuery{Start: 1, End: 2, Service: "order", Tags: map[string]string{"error": "false"}},
+			bson.M{"timestamp": bson.M{"$gte": int64(1), "$lte": int64(2)}, "service": "order", "has_error": false},
+		},
+		{
+			"tags and durations",
+			&model.JaegerTraceQuery{Start: 1, End: 2, Operation: "load", MinDuration: 10, Tags: map[string]string{"http.method": "GET"}},
+			bson.M{
+				"timestamp": bson.M{"$gte": int64(1), "$lte": int64(2)},
+				"operation": "load",
+				"duration":  bson.M{"$gte": int64(10)},
+				"tags":      bson.M{"$all": bson.A{bson.M{"$elemMatch": bson.M{"key": "http.method", "value": "GET"}}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jaegerSpanMatch(tt.q); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("jaegerSpanMatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToJaegerTrace(t *testing.T) {
+	spans := []*model.Span{
+		{ID: "1", Service: "gateway", Operation: "GET /order", Timestamp: 100, Duration: 50, Kind: "SPAN_KIND_SERVER"},
+		{
+			ID: "2", ParentID: "1", Service: "order", Operation: "load", Timestamp: 110, Duration: 20,
+			HasError: true, Error: "timeout", StatusCode: "STATUS_CODE_ERROR", StatusMessage: "deadline",
+			Events: []model.SpanEvent{{Name: "retry", Timestamp: 115, Attributes: []model.KeyValue{{Key: "attempt", Value: "2"}}}},
+			Links:  []model.SpanLink{{TraceID: "other", SpanID: "9"}},
+		},
+		{ID: "3", ParentID: "1", Service: "gateway", Operation: "auth", Timestamp: 105, Duration: 2, Tags: []model.KeyValue{{Key: "error", Value: "x"}, {Key: "user", Value: "u1"}}},
+	}
+	trace := toJaegerTrace("t", spans)
+
+	if len(trace.Processes) != 2 || trace.Processes["p1"].ServiceName != "gateway" || trace.Processes["p2"].ServiceName != "order" {
+		t.Fatalf("processes = %v", trace.Processes)
+	}
+	tags := func(span model.JaegerSpan) map[string]any {
+		res := make(map[string]any)
+		for _, tag := range span.Tags {
+			res[tag.Key] = tag.Value
+		}
+		return res
+	}
+
+	root, call, auth := trace.Spans[0], trace.Spans[1], trace.Spans[2]
+	if len(root.References) != 0 || root.ProcessID != "p1" || tags(root)["span.kind"] != "server" {
+		t.Errorf("root span %+v", root)
+	}
+	wantRefs := []model.JaegerReference{{RefType: "CHILD_OF", TraceID: "t", SpanID: "1"}, {RefType: "FOLLOWS_FROM", TraceID: "other", SpanID: "9"}}
+	if !reflect.DeepEqual(call.References, wantRefs) || call.ProcessID != "p2" {
+		t.Errorf("call references %v, process %s", call.References, call.ProcessID)
+	}
+	wantTags := map[string]any{"error": true, "error.message": "timeout", "otel.status_code": "ERROR", "otel.status_description": "deadline"}
+	if got := tags(call); !reflect.DeepEqual(got, wantTags) {
+		t.Errorf("call tags %v, want %v", got, wantTags)
+	}
+	if len(call.Logs) != 1 || call.Logs[0].Timestamp != 115 || len(call.Logs[0].Fields) != 2 || call.Logs[0].Fields[0].Value != "retry" {
+		t.Errorf("call logs %+v", call.Logs)
+	}
+	// a stored error tag is replaced by the error flag
+	if got := tags(auth); !reflect.DeepEqual(got, map[string]any{"user": "u1"}) {
+		t.Errorf("auth tags %v", got)
+	}
+}
+
+func TestJaegerDependencies(t *testing.T) {
+	hops := []*model.Hop{
+		{ID: "entry", CallerService: "root", CalledService: "gateway"},
+		{ID: "load", CallerService: "gateway", CallerOperation: "GET", CalledService: "order", CalledOperation: "load"},
+		{ID: "store", CallerService: "gateway", CallerOperation: "POST", CalledService: "order", CalledOperation: "store"},
+		{ID: "auth", CallerService: "gateway", CalledService: "user"},
+		{ID: "orphan", CallerService: missingParentService, CalledService: "order"},
+		{ID: "lost", CallerService: "order", CalledService: missingParentService},
+	}
+	calls := map[string]int{"entry": 9, "load": 5, "store": 2, "orphan": 1, "lost": 1}
+
+	got := jaegerDependencies(hops, calls)
+	want := []*model.JaegerDependency{{Parent: "gateway", Child: "order", CallCount: 7}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("jaegerDependencies() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/analystics/internal/model"
+)
+
+// ErrPathNotFound is returned when the path does not exist
+var ErrPathNotFound = errors.New("path not found")
+
+// pathTraceBatch is how many traces have their spans loaded at once
+const pathTraceBatch = 200
+
+// latencyAgg folds latencies into a sketch and a sum, so any number of traces fits in
+// bounded memory
+type latencyAgg struct {
+	sketch *Sketch
+	sum    int64
+}
+
+func newLatencyAgg() *latencyAgg {
+	return &latencyAgg{sketch: NewSketch()}
+}
+
+func (a *latencyAgg) add(v int64) {
+	a.sketch.Add(v)
+	a.sum += v
+}
+
+func (a *latencyAgg) stats(quantiles []float64) model.LatencyStats {
+	if a.sketch.Count() == 0 {
+		return model.LatencyStats{Quantiles: map[string]int{}}
+	}
+	return model.LatencyStats{
+		Avg:       a.sum / a.sketch.Count(),
+		P50:       a.sketch.Quantile(0.5),
+		P95:       a.sketch.Quantile(0.95),
+		P99:       a.sketch.Quantile(0.99),
+		Quantiles: a.sketch.Quantiles(quantiles),
+	}
+}
+
+// GetPathLatencyBreakdown computes the critical path of the traces of the path in the
+// time range, the latest limit ones when limit is positive, and aggregates self time and
+// critical path time per operation
+func (s *Service) GetPathLatencyBreakdown(ctx context.Context, _pathId string, _from, _to string, limit int64, quantiles []float64) (*model.PathLatencyBreakdown, error) {
+	pathId, _ := strconv.ParseUint(_pathId, 10, 64)
+	from, to := ParseFromToStringToInt(_from, _to)
+
+	var path *model.Path
+	err := pathCollection.Find(ctx, bson.M{"path_id": pathId}).One(&path)
+	if qmgo.IsErrNoDocuments(err) {
+		return nil, ErrPathNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := &model.PathLatencyBreakdown{PathID: pathId, Operations: []*model.OperationLatencyBreakdown{}}
+	ops := make(map[string]*model.OperationLatencyBreakdown, len(path.Operations))
+	selfTimes := make(map[string]*latencyAgg, len(path.Operations))
+	criticalTimes := make(map[string]*latencyAgg, len(path.Operations))
+	for _, op := range path.Operations {
+		breakdown := &model.OperationLatencyBreakdown{PathOperation: op}
+		ops[op.ID] = breakdown
+		selfTimes[op.ID], criticalTimes[op.ID] = newLatencyAgg(), newLatencyAgg()
+		res.Operations = append(res.Operations, breakdown)
+	}
+
+	durations := newLatencyAgg()
+	err = forEachPathTrace(ctx, pathId, from, to, limit, func(traceId string, spans []*model.Span) {
+		cp := buildCriticalPath(traceId, spans)
+		durations.add(cp.Duration)
+
+		// an operation called several times in a trace is summed
+		self := make(map[string]int64)
+		critical := make(map[string]int64)
+		for _, span := range cp.Spans {
+			id := strings.ToUpper(span.Service + "_" + span.Operation)
+			self[id] += span.SelfTime
+			critical[id] += span.CriticalTime
+		}
+		for id := range self {
+			if _, ok := ops[id]; !ok {
+				continue
+			}
+			selfTimes[id].add(self[id])
+			criticalTimes[id].add(critical[id])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res.TraceCount = int(durations.sketch.Count())
+	res.Duration = durations.stats(quantiles)
+	for id, op := range ops {
+		op.TraceCount = int(selfTimes[id].sketch.Count())
+		op.SelfTime = selfTimes[id].stats(quantiles)
+		op.CriticalTime = criticalTimes[id].stats(quantiles)
+		if durations.sum > 0 {
+			op.CriticalShare = float32(criticalTimes[id].sum) * 100 / float32(durations.sum)
+		}
+	}
+	sort.Slice(res.Operations, func(i, j int) bool {
+		return res.Operations[i].CriticalShare > res.Operations[j].CriticalShare
+	})
+	return res, nil
+}
+
+// forEachPathTrace streams the sampled traces of a path in [from, to], the latest limit
+// ones when limit is positive, and calls fn with the spans of each. Spans are loaded
+// pathTraceBatch traces at a time
+func forEachPathTrace(ctx context.Context, pathId uint64, from, to, limit int64, fn func(traceId string, spans []*model.Span)) error {
+	// sampled out traces have no spans to analyse
+	find := pathEventCollection.Find(ctx, bson.M{
+		"path_id":     pathId,
+		"timestamp":   bson.M{"$gte": from, "$lte": to},
+		"sampled_out": bson.M{"$ne": true},
+	}).Select(bson.M{"trace_id": 1}).Sort("-timestamp")
+	if limit > 0 {
+		find = find.Limit(limit)
+	}
+	cursor := find.Cursor()
+	defer cursor.Close()
+
+	traceIds := make([]string, 0, pathTraceBatch)
+	flush := func() error {
+		if len(traceIds) == 0 {
+			return nil
+		}
+		var spans []*model.Span
+		if err := spanCollection.Find(ctx, bson.M{"trace_id": bson.M{"$in": traceIds}}).All(&spans); err != nil {
+			return err
+		}
+		byTrace := make(map[string][]*model.Span)
+		for _, span := range spans {
+			byTrace[span.TraceID] = append(byTrace[span.TraceID], span)
+		}
+		for traceId, traceSpans := range byTrace {
+			fn(traceId, traceSpans)
+		}
+		traceIds = traceIds[:0]
+		return nil
+	}
+	var pe model.PathEvent
+	for cursor.Next(&pe) {
+		traceIds = append(traceIds, pe.TraceID)
+		if len(traceIds) == pathTraceBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
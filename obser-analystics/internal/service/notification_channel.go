@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"kuroko.com/analystics/internal/config"
+	"kuroko.com/analystics/internal/model"
+)
+
+// ErrInvalidChannel is returned for a notification channel that cannot deliver
+var ErrInvalidChannel = errors.New("invalid notification channel")
+
+func validateNotificationChannel(ch *model.NotificationChannel) error {
+	if ch.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidChannel)
+	}
+	// the name goes in the subject of emails
+	if strings.ContainsAny(ch.Name, "\r\n") {
+		return fmt.Errorf("%w: name must be a single line", ErrInvalidChannel)
+	}
+	switch ch.Type {
+	case model.ChannelWebhook, model.ChannelSlack:
+		u, err := url.Parse(ch.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: %s channel needs an http or https url", ErrInvalidChannel, ch.Type)
+		}
+	case model.ChannelEmail:
+		if len(ch.To) == 0 {
+			return fmt.Errorf("%w: email channel needs at least one recipient in to", ErrInvalidChannel)
+		}
+		for _, to := range ch.To {
+			if addr, err := mail.ParseAddress(to); err != nil || addr.Address != to {
+				return fmt.Errorf("%w: %q is not an email address", ErrInvalidChannel, to)
+			}
+		}
+		if *config.SmtpAddr == "" || *config.SmtpFrom == "" {
+			return fmt.Errorf("%w: smtp.addr and smtp.from are not configured", ErrInvalidChannel)
+		}
+	case model.ChannelNats:
+		if ch.Subject == "" {
+			return fmt.Errorf("%w: nats channel needs a subject", ErrInvalidChannel)
+		}
+		if *config.NatsURL == "" {
+			return fmt.Errorf("%w: nats.url is not configured", ErrInvalidChannel)
+		}
+	default:
+		return fmt.Errorf("%w: type must be webhook, slack, email or nats", ErrInvalidChannel)
+	}
+	return nil
+}
+
+func (s *Service) FindAllNotificationChannels(ctx context.Context) ([]*model.NotificationChannel, error) {
+	channels := []*model.NotificationChannel{}
+	err := notificationChannelCollection.Find(ctx, bson.M{}).Sort("name").All(&channels)
+	return channels, err
+}
+
+func (s *Service) GetNotificationChannel(ctx context.Context, id string) (*model.NotificationChannel, error) {
+	var ch *model.NotificationChannel
+	err := notificationChannelCollection.Find(ctx, bson.M{"_id": id}).One(&ch)
+	if qmgo.IsErrNoDocuments(err) {
+		return nil, ErrAlertNotFound
+	}
+	return ch, err
+}
+
+func (s *Service) CreateNotificationChannel(ctx context.Context, ch *model.NotificationChannel) (*model.NotificationChannel, error) {
+	if err := validateNotificationChannel(ch); err != nil {
+		return nil, err
+	}
+	ch.ID = primitive.NewObjectID().Hex()
+	ch.CreatedAt = time.Now().UnixMilli()
+	ch.UpdatedAt = ch.CreatedAt
+	if _, err := notificationChannelCollection.InsertOne(ctx, ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (s *Service) UpdateNotificationChannel(ctx context.Context, id string, ch *model.NotificationChannel) (*model.NotificationChannel, error) {
+	old, err := s.GetNotificationChannel(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNotificationChannel(ch); err != nil {
+		return nil, err
+	}
+	ch.ID = id
+	ch.CreatedAt = old.CreatedAt
+	ch.UpdatedAt = time.Now().UnixMilli()
+	if err := notificationChannelCollection.ReplaceOne(ctx, bson.M{"_id": id}, ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// DeleteNotificationChannel removes the channel, rules still routing to it skip it and
+// its undelivered notifications fail on their next attempt
+func (s *Service) DeleteNotificationChannel(ctx context.Context, id string) error {
+	err := notificationChannelCollection.RemoveId(ctx, id)
+	if qmgo.IsErrNoDocuments(err) {
+		return ErrAlertNotFound
+	}
+	return err
+}
+
+// checkAlertChannels verifies that the channels a rule routes to exist
+func (s *Service) checkAlertChannels(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	n, err := notificationChannelCollection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}).Count()
+	if err != nil {
+		return err
+	}
+	if int(n) != len(uniqueStrings(ids)) {
+		return fmt.Errorf("%w: unknown notification channel in channels", ErrInvalidAlertRule)
+	}
+	return nil
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	res := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			res = append(res, v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,408 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	qmgoopts "github.com/qiniu/qmgo/options"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"kuroko.com/analystics/internal/config"
+	"kuroko.com/analystics/internal/model"
+)
+
+// notifier delivers the events of a notification to a channel
+type notifier func(ctx context.Context, ch *model.NotificationChannel, n *model.Notification) error
+
+// notifiers are the delivery of every channel type
+var notifiers = map[string]notifier{
+	model.ChannelWebhook: sendWebhook,
+	model.ChannelSlack:   sendSlack,
+	model.ChannelEmail:   sendEmail,
+	model.ChannelNats:    sendNats,
+}
+
+// notificationPayload is the JSON body of webhook and nats notifications
+type notificationPayload struct {
+	ID        string              `json:"id"`
+	Channel   string              `json:"channel"`
+	Firing    int                 `json:"firing"`
+	Resolved  int                 `json:"resolved"`
+	Events    []*model.AlertEvent `json:"events"`
+	Timestamp int64               `json:"timestamp"`
+}
+
+func newNotificationPayload(ch *model.NotificationChannel, n *model.Notification) *notificationPayload {
+	p := &notificationPayload{ID: n.ID, Channel: ch.Name, Events: n.Events, Timestamp: time.Now().UnixMilli()}
+	for _, e := range n.Events {
+		if e.State == model.AlertStateFiring {
+			p.Firing++
+		} else {
+			p.Resolved++
+		}
+	}
+	return p
+}
+
+// alertEventText is the one line summary of an event
+func alertEventText(e *model.AlertEvent) string {
+	state := strings.ToUpper(e.State)
+	if e.Repeat {
+		state += ", STILL"
+	}
+	return fmt.Sprintf("[%s] %s: %s is %.2f, threshold %.2f (%s)", state, e.RuleName, e.Metric, e.Value, e.Threshold, alertTargetText(&e.Target))
+}
+
+func alertTargetText(t *model.AlertTarget) string {
+	switch t.Kind {
+	case "api":
+		return fmt.Sprintf("api %s %s %s", t.ServiceName, t.Method, t.URIPath)
+	case "path":
+		return fmt.Sprintf("path %d", t.PathID)
+	}
+	return "hop " + t.HopID
+}
+
+func postJSON(ctx context.Context, ch *model.NotificationChannel, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ch.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range ch.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s", ch.URL, resp.Status)
+	}
+	return nil
+}
+
+func sendWebhook(ctx context.Context, ch *model.NotificationChannel, n *model.Notification) error {
+	return postJSON(ctx, ch, newNotificationPayload(ch, n))
+}
+
+// sendSlack posts an incoming webhook message with one attachment per event
+func sendSlack(ctx context.Context, ch *model.NotificationChannel, n *model.Notification) error {
+	type attachment struct {
+		Color string `json:"color"`
+		Text  string `json:"text"`
+		Ts    int64  `json:"ts"`
+	}
+	p := newNotificationPayload(ch, n)
+	msg := struct {
+		Text        string       `json:"text"`
+		Attachments []attachment `json:"attachments"`
+	}{Text: fmt.Sprintf("%d firing, %d resolved alerts", p.Firing, p.Resolved)}
+	for _, e := range n.Events {
+		color := "good"
+		if e.State == model.AlertStateFiring {
+			color = "danger"
+		}
+		msg.Attachments = append(msg.Attachments, attachment{Color: color, Text: alertEventText(e), Ts: e.Timestamp / 1000})
+	}
+	return postJSON(ctx, ch, msg)
+}
+
+// sendEmail sends a plain text mail through smtp.addr, with STARTTLS when the server
+// offers it
+func sendEmail(ctx context.Context, ch *model.NotificationChannel, n *model.Notification) error {
+	if *config.SmtpAddr == "" || *config.SmtpFrom == "" {
+		return errors.New("smtp.addr and smtp.from are not configured")
+	}
+	from, err := mail.ParseAddress(*config.SmtpFrom)
+	if err != nil {
+		return fmt.Errorf("invalid smtp.from: %w", err)
+	}
+	p := newNotificationPayload(ch, n)
+	subject := fmt.Sprintf("[%s] %d firing, %d resolved alerts", ch.Name, p.Firing, p.Resolved)
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\n", from, strings.Join(ch.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	// retries of a notification keep its message id so receivers can drop duplicates
+	fmt.Fprintf(&body, "Message-ID: <%s@%s>\r\n", n.ID, from.Address[strings.LastIndex(from.Address, "@")+1:])
+	body.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, e := range n.Events {
+		fmt.Fprintf(&body, "%s at %s\r\n", alertEventText(e), time.UnixMilli(e.Timestamp).UTC().Format(time.RFC3339))
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", *config.SmtpAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(*config.SmtpAddr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if *config.SmtpUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", *config.SmtpUsername, *config.SmtpPassword, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range ch.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(body.String())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+var (
+	natsMu   sync.Mutex
+	natsConn *nats.Conn
+)
+
+// sendNats publishes the JSON payload on the subject of the channel, the connection is
+// opened on first use
+func sendNats(ctx context.Context, ch *model.NotificationChannel, n *model.Notification) error {
+	if *config.NatsURL == "" {
+		return errors.New("nats.url is not configured")
+	}
+	natsMu.Lock()
+	if natsConn == nil || natsConn.IsClosed() {
+		nc, err := nats.Connect(*config.NatsURL, nats.Timeout(*config.NotifyTimeout))
+		if err != nil {
+			natsMu.Unlock()
+			return err
+		}
+		natsConn = nc
+	}
+	nc := natsConn
+	natsMu.Unlock()
+
+	data, err := json.Marshal(newNotificationPayload(ch, n))
+	if err != nil {
+		return err
+	}
+	if err := nc.Publish(ch.Subject, data); err != nil {
+		return err
+	}
+	return nc.FlushWithContext(ctx)
+}
+
+// notifyAlertEvent queues the event for the enabled channels among channelIds. Events
+// of a channel are grouped into one notification until notify.group-wait after the first
+func (s *Service) notifyAlertEvent(ctx context.Context, channelIds []string, event *model.AlertEvent) error {
+	if len(channelIds) == 0 {
+		return nil
+	}
+	var channels []*model.NotificationChannel
+	err := notificationChannelCollection.Find(ctx, bson.M{"_id": bson.M{"$in": channelIds}, "enabled": true}).All(&channels)
+	if err != nil {
+		return err
+	}
+	groupUntil := event.Timestamp + config.NotifyGroupWait.Milliseconds()
+	upsert := qmgoopts.UpdateOptions{UpdateOptions: options.Update().SetUpsert(true)}
+	for _, ch := range channels {
+		err := notificationCollection.UpdateOne(ctx,
+			bson.M{"channel_id": ch.ID, "status": model.NotificationGrouping},
+			bson.M{
+				"$push": bson.M{"events": event},
+				"$setOnInsert": bson.M{
+					"_id":             primitive.NewObjectID().Hex(),
+					"channel_type":    ch.Type,
+					"attempts":        0,
+					"group_until":     groupUntil,
+					"next_attempt_at": groupUntil,
+					"created_at":      event.Timestamp,
+				},
+			}, upsert)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartNotifier delivers the due notifications every notify.interval until the context
+// is cancelled
+func (s *Service) StartNotifier(ctx context.Context) {
+	if *config.NotifyInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(*config.NotifyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.DeliverNotifications(ctx, time.Now().UnixMilli()); err != nil {
+				log.Printf("Failed to deliver notifications: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// DeliverNotifications closes the groups whose wait is over and sends every pending
+// notification that is due at now, in milliseconds
+func (s *Service) DeliverNotifications(ctx context.Context, now int64) error {
+	// events arriving from here on open a new group
+	_, err := notificationCollection.UpdateAll(ctx,
+		bson.M{"status": model.NotificationGrouping, "group_until": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"status": model.NotificationPending}})
+	if err != nil {
+		return err
+	}
+	var due []*model.Notification
+	err = notificationCollection.Find(ctx, bson.M{"status": model.NotificationPending, "next_attempt_at": bson.M{"$lte": now}}).
+		Sort("next_attempt_at").All(&due)
+	if err != nil {
+		return err
+	}
+	for _, n := range due {
+		s.deliverNotification(ctx, n, now)
+		if err := notificationCollection.ReplaceOne(ctx, bson.M{"_id": n.ID}, n); err != nil {
+			log.Printf("Failed to save notification %s: %v", n.ID, err)
+		}
+	}
+	return nil
+}
+
+// deliverNotification makes one attempt, a failed attempt is retried after
+// notify.retry-backoff doubled on every attempt until notify.max-attempts
+func (s *Service) deliverNotification(ctx context.Context, n *model.Notification, now int64) {
+	n.Attempts++
+	err := s.sendNotification(ctx, n)
+	if err == nil {
+		n.Status, n.SentAt, n.LastError = model.NotificationSent, time.Now().UnixMilli(), ""
+		return
+	}
+	n.LastError = err.Error()
+	if n.Attempts >= *config.NotifyMaxAttempts || errors.Is(err, ErrAlertNotFound) {
+		n.Status = model.NotificationFailed
+		log.Printf("Gave up notification %s to channel %s: %v", n.ID, n.ChannelID, err)
+		return
+	}
+	n.Status = model.NotificationPending
+	n.NextAttemptAt = now + config.NotifyRetryBackoff.Milliseconds()<<(n.Attempts-1)
+}
+
+func (s *Service) sendNotification(ctx context.Context, n *model.Notification) error {
+	ch, err := s.GetNotificationChannel(ctx, n.ChannelID)
+	if err != nil {
+		return err
+	}
+	send, ok := notifiers[ch.Type]
+	if !ok {
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidChannel, ch.Type)
+	}
+	ctx, cancel := context.WithTimeout(ctx, *config.NotifyTimeout)
+	defer cancel()
+	return send(ctx, ch, n)
+}
+
+// TestNotificationChannel sends a sample firing event to the channel right away, the
+// attempt is kept in the delivery log
+func (s *Service) TestNotificationChannel(ctx context.Context, id string) (*model.Notification, error) {
+	ch, err := s.GetNotificationChannel(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixMilli()
+	n := &model.Notification{
+		ID:          primitive.NewObjectID().Hex(),
+		ChannelID:   ch.ID,
+		ChannelType: ch.Type,
+		Events: []*model.AlertEvent{{
+			ID:        primitive.NewObjectID().Hex(),
+			RuleName:  "Test notification",
+			Target:    model.AlertTarget{Kind: "api", ServiceName: "test", URIPath: "/test", Method: "GET"},
+			Metric:    model.AlertMetricErrorRate,
+			State:     model.AlertStateFiring,
+			Timestamp: now,
+		}},
+		CreatedAt: now,
+	}
+	// a test is not retried
+	n.Attempts = 1
+	n.Status = model.NotificationSent
+	n.SentAt = now
+	if err := s.sendNotification(ctx, n); err != nil {
+		n.Status, n.SentAt, n.LastError = model.NotificationFailed, 0, err.Error()
+	}
+	if _, err := notificationCollection.InsertOne(ctx, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// FindNotifications returns the delivery log in [from, to] by creation, latest first
+func (s *Service) FindNotifications(ctx context.Context, channelId, status string, from, to, limit int64) ([]*model.Notification, error) {
+	filter := bson.M{"created_at": bson.M{"$gte": from, "$lte": to}}
+	if channelId != "" {
+		filter["channel_id"] = channelId
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+	res := []*model.Notification{}
+	err := notificationCollection.Find(ctx, filter).Sort("-created_at").Limit(limit).All(&res)
+	return res, err
+}
+
+// notifyStillFiring sends a reminder for a rule firing since notify.repeat-interval
+// without a notification
+func (s *Service) notifyStillFiring(ctx context.Context, rule *model.AlertRule, state *model.AlertState, now int64) {
+	if *config.NotifyRepeatInterval <= 0 || state.State != model.AlertStateFiring || state.Silenced ||
+		now-state.NotifiedAt < config.NotifyRepeatInterval.Milliseconds() {
+		return
+	}
+	event := newAlertEvent(rule, state, model.AlertStateFiring, now)
+	event.Repeat = true
+	if err := s.notifyAlertEvent(ctx, rule.Channels, event); err != nil {
+		log.Printf("Failed to notify alert rule %s: %v", rule.ID, err)
+		return
+	}
+	state.NotifiedAt = now
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"kuroko.com/analystics/internal/config"
+	"kuroko.com/analystics/internal/model"
+)
+
+func testNotification() *model.Notification {
+	return &model.Notification{
+		ID: "n1",
+		Events: []*model.AlertEvent{
+			{RuleName: "checkout errors", Metric: model.AlertMetricErrorRate, State: model.AlertStateFiring, Value: 12, Threshold: 5,
+				Target: model.AlertTarget{Kind: "api", ServiceName: "shop", Method: "POST", URIPath: "/checkout"}, Timestamp: 1700000000000},
+			{RuleName: "path latency", Metric: model.AlertMetricLatency, State: model.AlertStateResolved, Value: 80, Threshold: 100,
+				Target: model.AlertTarget{Kind: "path", PathID: 42}, Timestamp: 1700000000000},
+		},
+	}
+}
+
+func TestSendHTTPNotification(t *testing.T) {
+	var got struct {
+		header http.Header
+		body   map[string]any
+	}
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.header = r.Header.Clone()
+		data, _ := io.ReadAll(r.Body)
+		got.body = nil
+		json.Unmarshal(data, &got.body)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer sink.Close()
+
+	tests := []struct {
+		name    string
+		ch      *model.NotificationChannel
+		wantErr bool
+		check   func(t *testing.T)
+	}{
+		{
+			name: "webhook posts the payload with the channel headers",
+			ch:   &model.NotificationChannel{Name: "hook", Type: model.ChannelWebhook, URL: sink.URL, Headers: map[string]string{"X-Token": "secret"}},
+			check: func(t *testing.T) {
+				if got.header.Get("X-Token") != "secret" || got.header.Get("Content-Type") != "application/json" {
+					t.Errorf("headers = %v", got.header)
+				}
+				if got.body["id"] != "n1" || got.body["firing"] != 1.0 || got.body["resolved"] != 1.0 {
+					t.Errorf("body = %v", got.body)
+				}
+			},
+		},
+		{
+			name: "slack posts one attachment per event",
+			ch:   &model.NotificationChannel{Name: "slack", Type: model.ChannelSlack, URL: sink.URL},
+			check: func(t *testing.T) {
+				attachments, _ := got.body["attachments"].([]any)
+				if got.body["text"] != "1 firing, 1 resolved alerts" || len(attachments) != 2 {
+					t.Fatalf("body = %v", got.body)
+				}
+				if first := attachments[0].(map[string]any); first["color"] != "danger" || !strings.Contains(first["text"].(string), "api shop POST /checkout") {
+					t.Errorf("first attachment = %v", first)
+				}
+			},
+		},
+		{
+			name:    "a non 2xx answer fails the delivery",
+			ch:      &model.NotificationChannel{Name: "hook", Type: model.ChannelWebhook, URL: sink.URL + "/fail"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := notifiers[tt.ch.Type](context.Background(), tt.ch, testNotification())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t)
+			}
+		})
+	}
+}
+
+// smtpStub accepts one mail and returns the envelope and data it received
+func smtpStub(t *testing.T) (string, <-chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		var lines []string
+		tp.PrintfLine("220 stub")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				received <- lines
+				return
+			}
+			cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				lines = append(lines, line)
+				tp.PrintfLine("250 ok")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				data, _ := tp.ReadDotLines()
+				lines = append(lines, data...)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				received <- lines
+				return
+			default:
+				tp.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func TestSendEmail(t *testing.T) {
+	addr, received := smtpStub(t)
+	defer func(addr, from string) { *config.SmtpAddr, *config.SmtpFrom = addr, from }(*config.SmtpAddr, *config.SmtpFrom)
+	*config.SmtpAddr, *config.SmtpFrom = addr, "Alerts <alerts@example.com>"
+
+	ch := &model.NotificationChannel{Name: "oncall", Type: model.ChannelEmail, To: []string{"a@example.com", "b@example.com"}}
+	if err := sendEmail(context.Background(), ch, testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	lines := <-received
+	mail := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"MAIL FROM:<alerts@example.com>",
+		"RCPT TO:<a@example.com>",
+		"RCPT TO:<b@example.com>",
+		"To: a@example.com, b@example.com",
+		"Subject: [oncall] 1 firing, 1 resolved alerts",
+		"Message-ID: <n1@example.com>",
+		"Date: ",
+		"[FIRING] checkout errors",
+		"[RESOLVED] path latency",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("mail lacks %q:\n%s", want, mail)
+		}
+	}
+}
+
+func TestValidateNotificationChannel(t *testing.T) {
+	defer func(addr, from string) { *config.SmtpAddr, *config.SmtpFrom = addr, from }(*config.SmtpAddr, *config.SmtpFrom)
+	*config.SmtpAddr, *config.SmtpFrom = "localhost:25", "alerts@example.com"
+
+	tests := []struct {
+		name  string
+		ch    model.NotificationChannel
+		valid bool
+	}{
+		{"webhook", model.NotificationChannel{Name: "hook", Type: model.ChannelWebhook, URL: "https://example.com/hook"}, true},
+		{"webhook without http url", model.NotificationChannel{Name: "hook", Type: model.ChannelWebhook, URL: "ftp://example.com"}, false},
+		{"email", model.NotificationChannel{Name: "oncall", Type: model.ChannelEmail, To: []string{"a@example.com"}}, true},
+		{"email without recipient", model.NotificationChannel{Name: "oncall", Type: model.ChannelEmail}, false},
+		{"name with a line break", model.NotificationChannel{Name: "x\r\nBcc: evil@example.com", Type: model.ChannelEmail, To: []string{"a@example.com"}}, false},
+		{"recipient with a line break", model.NotificationChannel{Name: "oncall", Type: model.ChannelEmail, To: []string{"a@example.com\r\nBcc: evil@example.com"}}, false},
+		{"recipient with a display name", model.NotificationChannel{Name: "oncall", Type: model.ChannelEmail, To: []string{"A <a@example.com>"}}, false},
+		{"unknown type", model.NotificationChannel{Name: "x", Type: "pager"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateNotificationChannel(&tt.ch)
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidChannel) {
+				t.Errorf("err = %v, want ErrInvalidChannel", err)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package service
 
 import (
 	"context"
-	"sort"
 	"strconv"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -25,8 +24,8 @@ func (s *Service) GetAllPathsFromOperations(ctx context.Context, pairs []model.S
 	return &model.PathResponse{Paths: paths, TotalCount: len(paths)}, nil
 }
 
-func (s *Service) GetPathDetailById(ctx context.Context, _pathId string, _from, _to, unit string) (*model.PathDetail, error) {
-	pathId, _ := strconv.ParseUint(_pathId, 10, 32)
+func (s *Service) GetPathDetailById(ctx context.Context, _pathId string, _from, _to, unit string, quantiles []float64) (*model.PathDetail, error) {
+	pathId, _ := strconv.ParseUint(_pathId, 10, 64)
 	from, to := ParseFromToStringToInt(_from, _to)
 	interval := ParseUnitToInterval(unit)
 
@@ -38,6 +37,31 @@ func (s *Service) GetPathDetailById(ctx context.Context, _pathId string, _from,
 	}
 	res.PathInfo = pathInfo
 
+	if unitName, ok := rollupUnitFor(interval); ok {
+		rollups, err := findRollups(ctx, pathRollupSource(), bson.M{"path_id": pathId}, unitName, from, to)
+		if err != nil {
+			return nil, err
+		}
+		total, buckets := sumRollups(rollups, from, to, interval)
+		if total.count == 0 {
+			return res, nil
+		}
+		res.Count, res.ErrorCount = int(total.count), int(total.errorCount)
+		res.Distribution, res.ErrorDist, res.Latency = map[int64]int{}, map[int64]int{}, map[int64]int{}
+		for k, b := range buckets {
+			res.Distribution[k] = int(b.count)
+			res.ErrorDist[k] = int(b.errorCount)
+			res.Latency[k] = 0
+			if b.count > 0 {
+				res.Latency[k] = int(b.latencySum / b.count)
+			}
+		}
+		res.Quantiles = total.quantiles(quantiles)
+		res.Frequency = float32(res.Count) * float32(interval) / float32(to-from)
+		res.ErrorRate = float32(res.ErrorCount) / float32(res.Count)
+		return res, nil
+	}
+
 	filter := bson.M{
 		"path_id": pathId,
 		"timestamp": bson.M{
@@ -53,34 +77,47 @@ func (s *Service) GetPathDetailById(ctx context.Context, _pathId string, _from,
 	if len(pathEvents) == 0 {
 		return res, nil
 	}
-	res.Count, res.ErrorCount, res.Distribution, res.ErrorDist = buildPathEventDistribution(pathEvents, from, to, interval)
+	res.Count, res.ErrorCount, res.Distribution, res.ErrorDist, res.Latency = buildPathEventDistribution(pathEvents, from, to, interval)
+	sketch := NewSketch()
+	for _, e := range pathEvents {
+		sketch.Add(int64(e.Duration))
+	}
+	res.Quantiles = sketch.Quantiles(quantiles)
 	res.Frequency = float32(res.Count) * float32(interval) / float32(to-from)
 	res.ErrorRate = float32(res.ErrorCount) / float32(res.Count)
 	return res, nil
 }
 
-func buildPathEventDistribution(pathEvents []*model.PathEvent, from, to, interval int64) (count, errCount int, pathDist, errDist map[int64]int) {
+func buildPathEventDistribution(pathEvents []*model.PathEvent, from, to, interval int64) (count, errCount int, pathDist, errDist, latency map[int64]int) {
 	pathDist = map[int64]int{}
 	errDist = map[int64]int{}
+	latency = map[int64]int{}
 	_from := (from / interval) * interval
 	_to := (to / interval) * interval
 	for i := _from; i <= _to; i += interval {
 		pathDist[i] = 0
 		errDist[i] = 0
+		latency[i] = 0
 	}
 	for _, e := range pathEvents {
 		count++
 		key := (e.Timestamp / interval) * interval
 		pathDist[key]++
+		latency[key] += e.Duration
 		if e.HasError {
 			errCount++
 			errDist[key]++
 		}
 	}
-	return count, errCount, pathDist, errDist
+	for k, n := range pathDist {
+		if n > 0 {
+			latency[k] /= n
+		}
+	}
+	return count, errCount, pathDist, errDist, latency
 }
 
-func (s *Service) GetHopDetailById(ctx context.Context, hopID, _from, _to, unit string) (*model.HopDetail, error) {
+func (s *Service) GetHopDetailById(ctx context.Context, hopID, _from, _to, unit string, quantiles []float64) (*model.HopDetail, error) {
 	from, to := ParseFromToStringToInt(_from, _to)
 	interval := ParseUnitToInterval(unit)
 
@@ -92,6 +129,33 @@ func (s *Service) GetHopDetailById(ctx context.Context, hopID, _from, _to, unit
 	}
 	res.HopInfo = hopInfo
 
+	if unitName, ok := rollupUnitFor(interval); ok {
+		rollups, err := findRollups(ctx, hopRollupSource(), bson.M{"hop_id": hopID}, unitName, from, to)
+		if err != nil {
+			return nil, err
+		}
+		total, buckets := sumRollups(rollups, from, to, interval)
+		if total.count == 0 {
+			return res, nil
+		}
+		res.Count, res.ErrorCount = int(total.count), int(total.errorCount)
+		res.Distribution, res.ErrorDist, res.Latency = map[int64]int{}, map[int64]int{}, map[int64]int{}
+		for k, b := range buckets {
+			res.Distribution[k] = int(b.count)
+			res.ErrorDist[k] = 0
+			res.Latency[k] = 0
+			if b.count > 0 {
+				// error dist of hops is a percentage
+				res.ErrorDist[k] = int(b.errorCount * 100 / b.count)
+				res.Latency[k] = int(b.latencySum / b.count)
+			}
+		}
+		res.Quantiles = total.quantiles(quantiles)
+		res.Frequency = float32(res.Count) * float32(interval) / float32(to-from)
+		res.ErrorRate = float32(res.ErrorCount) / float32(res.Count)
+		return res, nil
+	}
+
 	filter := bson.M{
 		"hop_id": hopID,
 		"timestamp": bson.M{
@@ -108,6 +172,11 @@ func (s *Service) GetHopDetailById(ctx context.Context, hopID, _from, _to, unit
 		return res, nil
 	}
 	res.Count, res.ErrorCount, res.Distribution, res.ErrorDist, res.Latency = buildHopEventDistribution(hopEvents, from, to, interval)
+	sketch := NewSketch()
+	for _, e := range hopEvents {
+		sketch.Add(int64(e.Duration))
+	}
+	res.Quantiles = sketch.Quantiles(quantiles)
 	res.Frequency = float32(res.Count) * float32(interval) / float32(to-from)
 	res.ErrorRate = float32(res.ErrorCount) / float32(res.Count)
 	return res, nil
@@ -125,9 +194,6 @@ func buildHopEventDistribution(hopEvents []*model.HopEvent, from, to, interval i
 		errDist[i] = 0
 		_latency[i] = []int{}
 	}
-	sort.Slice(hopEvents, func(i, j int) bool {
-		return hopEvents[i].Duration < hopEvents[j].Duration
-	})
 	var sum int = 0
 	for _, e := range hopEvents {
 		count++
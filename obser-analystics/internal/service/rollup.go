@@ -0,0 +1,306 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"kuroko.com/analystics/internal/config"
+	"kuroko.com/analystics/internal/model"
+)
+
+// rollupUnits are the bucket sizes in milliseconds of the processor rollups, coarsest
+// first
+var rollupUnits = []struct {
+	name string
+	size int64
+}{
+	{"day", 24 * 60 * 60 * 1000},
+	{"hour", 60 * 60 * 1000},
+	{"minute", 60 * 1000},
+}
+
+// rollupUnitFor returns the coarsest rollup whose buckets tile the interval, ok is
+// false when raw events have to be read
+func rollupUnitFor(interval int64) (unit string, ok bool) {
+	if !*config.StatisticRollups {
+		return "", false
+	}
+	for _, u := range rollupUnits {
+		if u.size <= interval && interval%u.size == 0 {
+			return u.name, true
+		}
+	}
+	return "", false
+}
+
+// rollupUnitForRange returns the coarsest rollup that splits the range into at least
+// 24 buckets, so that few queries are spent on the finer edges
+func rollupUnitForRange(from, to int64) (unit string, ok bool) {
+	if !*config.StatisticRollups {
+		return "", false
+	}
+	for _, u := range rollupUnits {
+		if u.size*24 <= to-from {
+			return u.name, true
+		}
+	}
+	return "", false
+}
+
+// rollupSource ties the rollups of a kind of target to the raw events they count
+type rollupSource struct {
+	rollups  *qmgo.Collection
+	raw      *qmgo.Collection
+	time     string   // time field of the raw events, millisecond
+	key      []string // fields identifying a target
+	hasError any      // expression telling whether a raw event failed
+	status   string   // status code field of the raw events, empty when not counted
+}
+
+func apiRollupSource() rollupSource {
+	return rollupSource{apiRollupCollection, httpLogEntryCollection, "start_time",
+		[]string{"service_name", "uri_path", "method"}, bson.M{"$gte": bson.A{"$status_code", 400}}, "status_code"}
+}
+
+func pathRollupSource() rollupSource {
+	return rollupSource{pathRollupCollection, pathEventCollection, "timestamp", []string{"path_id"}, "$has_error", ""}
+}
+
+func hopRollupSource() rollupSource {
+	return rollupSource{hopRollupCollection, hopEventCollection, "timestamp", []string{"hop_id"}, "$has_error", ""}
+}
+
+// rollupPart is a part of a range read from the buckets of one unit, or from the raw
+// events when unit is empty
+type rollupPart struct {
+	unit       string
+	start, end int64 // [start, end)
+}
+
+// planRollups splits [start, end) into the whole buckets of unit and, at the edges
+// those buckets do not cover, of the finer units. What is left of the edge minutes
+// is read from raw events
+func planRollups(unit string, start, end int64) []rollupPart {
+	for i, u := range rollupUnits {
+		if u.name == unit {
+			return planRollupUnits(i, start, end)
+		}
+	}
+	return planRollupUnits(len(rollupUnits), start, end)
+}
+
+func planRollupUnits(i int, start, end int64) []rollupPart {
+	if start >= end {
+		return nil
+	}
+	if i == len(rollupUnits) {
+		return []rollupPart{{start: start, end: end}}
+	}
+	size := rollupUnits[i].size
+	first, last := (start+size-1)/size*size, end/size*size
+	if first >= last {
+		return planRollupUnits(i+1, start, end)
+	}
+	parts := planRollupUnits(i+1, start, first)
+	parts = append(parts, rollupPart{unit: rollupUnits[i].name, start: first, end: last})
+	return append(parts, planRollupUnits(i+1, last, end)...)
+}
+
+// findRollups loads the rollups of the key that make up [from, to]: the buckets of
+// unit, finer rollups at the edges and rollups of the raw events of the edge minutes,
+// so totals match counting the raw events. A nil key loads every target
+func findRollups(ctx context.Context, src rollupSource, key bson.M, unit string, from, to int64) ([]*model.Rollup, error) {
+	var rollups []*model.Rollup
+	for _, part := range planRollups(unit, from, to+1) {
+		if part.unit == "" {
+			raw, err := rawRollups(ctx, src, key, "minute", minuteMs, part.start, part.end)
+			if err != nil {
+				return nil, err
+			}
+			rollups = append(rollups, raw...)
+			continue
+		}
+		filter := bson.M{
+			"unit":   part.unit,
+			"bucket": bson.M{"$gte": part.start, "$lt": part.end},
+		}
+		for k, v := range key {
+			filter[k] = v
+		}
+		var found []*model.Rollup
+		if err := src.rollups.Find(ctx, filter).All(&found); err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, found...)
+	}
+	return rollups, nil
+}
+
+// rawRollups aggregates the raw events of src in [start, end) matching key into
+// rollups of unit by target, latencies are binned in the sketch the way the processor
+// does
+func rawRollups(ctx context.Context, src rollupSource, key bson.M, unit string, size, start, end int64) ([]*model.Rollup, error) {
+	match := bson.M{src.time: bson.M{"$gte": start, "$lt": end}}
+	for k, v := range key {
+		match[k] = v
+	}
+	bucket := bson.M{"$subtract": bson.A{"$" + src.time, bson.M{"$mod": bson.A{"$" + src.time, size}}}}
+	binId := bson.M{"bucket": "$bucket", "bin": "$bin"}
+	bucketId := bson.M{"bucket": "$_id.bucket"}
+	fields := bson.M{
+		"_id":         0,
+		"unit":        unit,
+		"bucket":      "$_id.bucket",
+		"count":       1,
+		"error_count": 1,
+		"latency_sum": 1,
+		"latency_min": 1,
+		"latency_max": 1,
+		"sketch":      bson.M{"$arrayToObject": "$sketch"},
+	}
+	for _, k := range src.key {
+		binId[k], bucketId[k], fields[k] = "$"+k, "$_id."+k, "$_id."+k
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$set", Value: bson.M{
+			"bucket": bucket,
+			"bin":    bson.M{"$ceil": bson.M{"$divide": bson.A{bson.M{"$ln": bson.M{"$max": bson.A{"$duration", 1}}}, sketchLogGamma}}},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   binId,
+			"n":     bson.M{"$sum": 1},
+			"error": bson.M{"$sum": bson.M{"$cond": bson.A{src.hasError, 1, 0}}},
+			"sum":   bson.M{"$sum": "$duration"},
+			"min":   bson.M{"$min": "$duration"},
+			"max":   bson.M{"$max": "$duration"},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":         bucketId,
+			"count":       bson.M{"$sum": "$n"},
+			"error_count": bson.M{"$sum": "$error"},
+			"latency_sum": bson.M{"$sum": "$sum"},
+			"latency_min": bson.M{"$min": "$min"},
+			"latency_max": bson.M{"$max": "$max"},
+			"sketch":      bson.M{"$push": bson.M{"k": bson.M{"$toString": bson.M{"$toLong": "$_id.bin"}}, "v": "$n"}},
+		}}},
+		{{Key: "$project", Value: fields}},
+	}
+	var rollups []*model.Rollup
+	if err := src.raw.Aggregate(ctx, pipeline).All(&rollups); err != nil {
+		return nil, err
+	}
+	if src.status == "" || len(rollups) == 0 {
+		return rollups, nil
+	}
+
+	// status codes are counted apart, a group by bin and status would split the bins
+	statusId := bson.M{"bucket": bucket, "status": "$" + src.status}
+	for _, k := range src.key {
+		statusId[k] = "$" + k
+	}
+	var codes []struct {
+		ID struct {
+			model.Rollup `bson:",inline"`
+			Status       int `bson:"status"`
+		} `bson:"_id"`
+		N int64 `bson:"n"`
+	}
+	err := src.raw.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{"_id": statusId, "n": bson.M{"$sum": 1}}}},
+	}).All(&codes)
+	if err != nil {
+		return nil, err
+	}
+	byTarget := make(map[string]*model.Rollup, len(rollups))
+	for _, r := range rollups {
+		byTarget[rollupTargetKey(r)] = r
+	}
+	for _, c := range codes {
+		if r := byTarget[rollupTargetKey(&c.ID.Rollup)]; r != nil {
+			if r.StatusCodes == nil {
+				r.StatusCodes = make(map[string]int64)
+			}
+			r.StatusCodes[strconv.Itoa(c.ID.Status)] += c.N
+		}
+	}
+	return rollups, nil
+}
+
+// rollupTargetKey identifies the target and bucket of a rollup
+func rollupTargetKey(r *model.Rollup) string {
+	return fmt.Sprintf("%d|%s|%s|%s|%d|%s", r.Bucket, r.ServiceName, r.URIPath, r.Method, r.PathID, r.HopID)
+}
+
+// rollupTotal merges rollups
+type rollupTotal struct {
+	count       int64
+	errorCount  int64
+	latencySum  int64
+	latencyMin  int64
+	latencyMax  int64
+	sketch      *Sketch
+	statusCodes map[int]int64
+}
+
+func newRollupTotal() *rollupTotal {
+	return &rollupTotal{
+		sketch:      NewSketch(),
+		statusCodes: make(map[int]int64),
+	}
+}
+
+func (t *rollupTotal) add(r *model.Rollup) {
+	if r.Count <= 0 {
+		return
+	}
+	if t.count == 0 || r.LatencyMin < t.latencyMin {
+		t.latencyMin = r.LatencyMin
+	}
+	if r.LatencyMax > t.latencyMax {
+		t.latencyMax = r.LatencyMax
+	}
+	t.count += r.Count
+	t.errorCount += r.ErrorCount
+	t.latencySum += r.LatencySum
+	t.sketch.AddBins(r.Sketch)
+	for k, v := range r.StatusCodes {
+		if code, err := strconv.Atoi(k); err == nil {
+			t.statusCodes[code] += v
+		}
+	}
+}
+
+// quantiles estimates the quantiles from the merged sketch, kept within the observed
+// min and max
+func (t *rollupTotal) quantiles(qs []float64) map[string]int {
+	res := t.sketch.Quantiles(qs)
+	for k, v := range res {
+		res[k] = max(int(t.latencyMin), min(v, int(t.latencyMax)))
+	}
+	return res
+}
+
+// sumRollups merges rollups into the total of the range and the totals of every
+// interval bucket, buckets without data are present with empty totals
+func sumRollups(rollups []*model.Rollup, from, to, interval int64) (*rollupTotal, map[int64]*rollupTotal) {
+	total := newRollupTotal()
+	buckets := make(map[int64]*rollupTotal)
+	for i := from / interval * interval; i <= to/interval*interval; i += interval {
+		buckets[i] = newRollupTotal()
+	}
+	for _, r := range rollups {
+		total.add(r)
+		key := r.Bucket / interval * interval
+		if buckets[key] == nil {
+			buckets[key] = newRollupTotal()
+		}
+		buckets[key].add(r)
+	}
+	return total, buckets
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestPlanRollupsMatchesRawEvents(t *testing.T) {
+	const dayMs = 24 * hourMs
+	// events over three days, the rollups count them by bucket like the processor
+	rng := rand.New(rand.NewSource(1))
+	origin := int64(1_700_000_000_000) / dayMs * dayMs
+	events := make([]int64, 20000)
+	rollups := make(map[string]map[int64]int)
+	for i := range events {
+		events[i] = origin + rng.Int63n(3*dayMs)
+		for _, u := range rollupUnits {
+			if rollups[u.name] == nil {
+				rollups[u.name] = make(map[int64]int)
+			}
+			rollups[u.name][events[i]/u.size*u.size]++
+		}
+	}
+
+	tests := []struct {
+		name     string
+		unit     string
+		from, to int64
+	}{
+		{"aligned days", "day", origin, origin + 2*dayMs - 1},
+		{"days from mid morning to mid afternoon", "day", origin + 9*hourMs + 17*minuteMs + 4321, origin + 2*dayMs + 15*hourMs + 3*minuteMs + 99},
+		{"days shorter than a day", "day", origin + 3*hourMs + 5, origin + 20*hourMs + 7},
+		{"hours within a minute", "hour", origin + 10*minuteMs + 100, origin + 10*minuteMs + 5000},
+		{"hours over midnight", "hour", origin + dayMs - 90*minuteMs - 1, origin + dayMs + 61*minuteMs + 1},
+		{"minutes", "minute", origin + 12345, origin + 3*hourMs + 6789},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := 0
+			for _, e := range events {
+				if e >= tt.from && e <= tt.to {
+					want++
+				}
+			}
+
+			got, next := 0, tt.from
+			for _, part := range planRollups(tt.unit, tt.from, tt.to+1) {
+				if part.start != next || part.end <= part.start {
+					t.Fatalf("part %+v does not follow %d", part, next)
+				}
+				next = part.end
+				if part.unit == "" {
+					if part.end-part.start >= minuteMs {
+						t.Errorf("raw part %+v spans a whole minute", part)
+					}
+					for _, e := range events {
+						if e >= part.start && e < part.end {
+							got++
+						}
+					}
+					continue
+				}
+				for bucket, n := range rollups[part.unit] {
+					if bucket >= part.start && bucket < part.end {
+						got += n
+					}
+				}
+			}
+			if next != tt.to+1 {
+				t.Fatalf("parts end at %d, want %d", next, tt.to+1)
+			}
+			if got != want {
+				t.Errorf("rollups count %d events, raw events %d", got, want)
+			}
+		})
+	}
+}
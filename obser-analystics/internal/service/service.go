@@ -23,6 +23,19 @@ var svcObjectCollection *qmgo.Collection
 // var statisticDoneCollection *qmgo.Collection
 var serviceStatisticObjectCollection *qmgo.Collection
 var uriStatisticObjectCollection *qmgo.Collection
+var apiRollupCollection *qmgo.Collection
+var pathRollupCollection *qmgo.Collection
+var hopRollupCollection *qmgo.Collection
+var alertRuleCollection *qmgo.Collection
+var alertStateCollection *qmgo.Collection
+var alertHistoryCollection *qmgo.Collection
+var alertSilenceCollection *qmgo.Collection
+var notificationChannelCollection *qmgo.Collection
+var notificationCollection *qmgo.Collection
+var sloCollection *qmgo.Collection
+var sloStateCollection *qmgo.Collection
+var sloBucketCollection *qmgo.Collection
+var sloHistoryCollection *qmgo.Collection
 
 func NewService(db *qmgo.Database) *Service {
 	s := &Service{db}
@@ -36,10 +49,23 @@ func NewService(db *qmgo.Database) *Service {
 	httpLogEntryCollection = s.Collection("http_log_entry")
 	spanCollection = s.Collection("span")
 	uriObjectCollection = s.Collection("uri_object")
-	svcObjectCollection = s.Collection("svc_object")
+	svcObjectCollection = s.Collection("service_object")
 	// statisticDoneCollection = s.Collection("statistic_done")
-	serviceStatisticObjectCollection = s.Collection("svc_statistic_object")
+	serviceStatisticObjectCollection = s.Collection("service_statistic_object")
 	uriStatisticObjectCollection = s.Collection("uri_statistic_object")
+	apiRollupCollection = s.Collection("api_rollup")
+	pathRollupCollection = s.Collection("path_rollup")
+	hopRollupCollection = s.Collection("hop_rollup")
+	alertRuleCollection = s.Collection("alert_rule")
+	alertStateCollection = s.Collection("alert_state")
+	alertHistoryCollection = s.Collection("alert_history")
+	alertSilenceCollection = s.Collection("alert_silence")
+	notificationChannelCollection = s.Collection("notification_channel")
+	notificationCollection = s.Collection("alert_notification")
+	sloCollection = s.Collection("slo")
+	sloStateCollection = s.Collection("slo_state")
+	sloBucketCollection = s.Collection("slo_bucket")
+	sloHistoryCollection = s.Collection("slo_history")
 
 	return s
 }
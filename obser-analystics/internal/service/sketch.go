@@ -0,0 +1,107 @@
+package service
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// sketchAccuracy is the relative accuracy of latency sketches, it must match the
+// processor's
+const sketchAccuracy = 0.01
+
+var (
+	sketchGamma    = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// Sketch is a DDSketch of latencies in microseconds: a value v is counted in bin
+// ceil(log_gamma(v)), so any quantile is estimated within sketchAccuracy of its true
+// value and sketches merge by adding bins
+type Sketch struct {
+	bins  map[int]int64
+	count int64
+}
+
+func NewSketch() *Sketch {
+	return &Sketch{bins: make(map[int]int64)}
+}
+
+func sketchIndex(v int64) int {
+	// latencies under a microsecond share the first bin
+	if v < 1 {
+		v = 1
+	}
+	return int(math.Ceil(math.Log(float64(v)) / sketchLogGamma))
+}
+
+func (s *Sketch) Add(v int64) {
+	s.bins[sketchIndex(v)]++
+	s.count++
+}
+
+// AddBins merges bins stored in a rollup, keyed by the decimal bin index
+func (s *Sketch) AddBins(bins map[string]int64) {
+	for k, n := range bins {
+		i, err := strconv.Atoi(k)
+		if err != nil || n == 0 {
+			continue
+		}
+		s.bins[i] += n
+		s.count += n
+	}
+}
+
+func (s *Sketch) Merge(o *Sketch) {
+	for i, n := range o.bins {
+		s.bins[i] += n
+	}
+	s.count += o.count
+}
+
+func (s *Sketch) Count() int64 {
+	return s.count
+}
+
+// Quantile returns the estimated q quantile, 0 for an empty sketch
+func (s *Sketch) Quantile(q float64) int64 {
+	if s.count <= 0 {
+		return 0
+	}
+	indexes := make([]int, 0, len(s.bins))
+	for i, n := range s.bins {
+		if n > 0 {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	rank := int64(math.Ceil(q * float64(s.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for _, i := range indexes {
+		seen += s.bins[i]
+		if seen >= rank {
+			return sketchValue(i)
+		}
+	}
+	return sketchValue(indexes[len(indexes)-1])
+}
+
+// sketchValue is the estimate of the values in bin i, within sketchAccuracy of each
+func sketchValue(i int) int64 {
+	return int64(math.Round(2 * math.Pow(sketchGamma, float64(i)) / (sketchGamma + 1)))
+}
+
+// Quantiles returns the estimates keyed by the quantile as written in the request
+func (s *Sketch) Quantiles(qs []float64) map[string]int {
+	res := make(map[string]int, len(qs))
+	for _, q := range qs {
+		res[strconv.FormatFloat(q, 'f', -1, 64)] = int(s.Quantile(q))
+	}
+	return res
+}
+
+// DefaultQuantiles are returned when a request does not ask for quantiles
+var DefaultQuantiles = []float64{0.5, 0.95, 0.99}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"kuroko.com/analystics/internal/model"
+)
+
+// ErrInvalidSLO is returned for an SLO that cannot be evaluated
+var ErrInvalidSLO = errors.New("invalid slo")
+
+// ErrSLONotFound is returned when the SLO does not exist
+var ErrSLONotFound = errors.New("slo not found")
+
+func validateSLO(slo *model.SLO) error {
+	if slo.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidSLO)
+	}
+	if slo.ServiceName == "" || slo.URIPath == "" || slo.Method == "" {
+		return fmt.Errorf("%w: service_name, uri_path and method are required", ErrInvalidSLO)
+	}
+	if slo.Objective <= 0 || slo.Objective >= 100 {
+		return fmt.Errorf("%w: objective must be a percent in (0, 100)", ErrInvalidSLO)
+	}
+	if slo.LatencyThreshold < 0 {
+		return fmt.Errorf("%w: latency_threshold must not be negative", ErrInvalidSLO)
+	}
+	if slo.ErrorStatus == 0 {
+		slo.ErrorStatus = 500
+	}
+	if slo.ErrorStatus < 100 || slo.ErrorStatus > 599 {
+		return fmt.Errorf("%w: error_status must be an http status", ErrInvalidSLO)
+	}
+	if slo.WindowDays == 0 {
+		slo.WindowDays = 28
+	}
+	if slo.WindowDays < 1 || slo.WindowDays > 90 {
+		return fmt.Errorf("%w: window_days must be in [1, 90]", ErrInvalidSLO)
+	}
+	if slo.FastBurnRate == 0 {
+		slo.FastBurnRate = 14.4
+	}
+	if slo.SlowBurnRate == 0 {
+		slo.SlowBurnRate = 6
+	}
+	if slo.FastBurnRate < 0 || slo.SlowBurnRate < 0 {
+		return fmt.Errorf("%w: burn rates must be positive", ErrInvalidSLO)
+	}
+	return nil
+}
+
+// FindSLOStatuses returns every SLO with its latest state, SLOs never evaluated have a
+// nil state
+func (s *Service) FindSLOStatuses(ctx context.Context) ([]*model.SLOStatus, error) {
+	slos := []*model.SLO{}
+	if err := sloCollection.Find(ctx, bson.M{}).Sort("name").All(&slos); err != nil {
+		return nil, err
+	}
+	var states []*model.SLOState
+	if err := sloStateCollection.Find(ctx, bson.M{}).All(&states); err != nil {
+		return nil, err
+	}
+	bySLO := make(map[string]*model.SLOState, len(states))
+	for _, state := range states {
+		bySLO[state.SLOID] = state
+	}
+	res := make([]*model.SLOStatus, 0, len(slos))
+	for _, slo := range slos {
+		res = append(res, &model.SLOStatus{SLO: slo, State: bySLO[slo.ID]})
+	}
+	return res, nil
+}
+
+func (s *Service) GetSLO(ctx context.Context, id string) (*model.SLO, error) {
+	var slo *model.SLO
+	err := sloCollection.Find(ctx, bson.M{"_id": id}).One(&slo)
+	if qmgo.IsErrNoDocuments(err) {
+		return nil, ErrSLONotFound
+	}
+	return slo, err
+}
+
+func (s *Service) GetSLOStatus(ctx context.Context, id string) (*model.SLOStatus, error) {
+	slo, err := s.GetSLO(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var state *model.SLOState
+	err = sloStateCollection.Find(ctx, bson.M{"_id": id}).One(&state)
+	if err != nil && !qmgo.IsErrNoDocuments(err) {
+		return nil, err
+	}
+	return &model.SLOStatus{SLO: slo, State: state}, nil
+}
+
+func (s *Service) CreateSLO(ctx context.Context, slo *model.SLO) (*model.SLO, error) {
+	if err := validateSLO(slo); err != nil {
+		return nil, err
+	}
+	if err := s.checkAlertChannels(ctx, slo.Channels); err != nil {
+		return nil, err
+	}
+	slo.ID = primitive.NewObjectID().Hex()
+	slo.CreatedAt = time.Now().UnixMilli()
+	slo.UpdatedAt = slo.CreatedAt
+	if _, err := sloCollection.InsertOne(ctx, slo); err != nil {
+		return nil, err
+	}
+	return slo, nil
+}
+
+// UpdateSLO replaces the SLO, its counts and state start over since what is a good
+// request may have changed. The history is kept
+func (s *Service) UpdateSLO(ctx context.Context, id string, slo *model.SLO) (*model.SLO, error) {
+	old, err := s.GetSLO(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSLO(slo); err != nil {
+		return nil, err
+	}
+	if err := s.checkAlertChannels(ctx, slo.Channels); err != nil {
+		return nil, err
+	}
+	slo.ID = id
+	slo.CreatedAt = old.CreatedAt
+	slo.UpdatedAt = time.Now().UnixMilli()
+	if err := sloCollection.ReplaceOne(ctx, bson.M{"_id": id}, slo); err != nil {
+		return nil, err
+	}
+	if err := s.resetSLOState(ctx, old); err != nil {
+		return nil, err
+	}
+	return slo, nil
+}
+
+func (s *Service) DeleteSLO(ctx context.Context, id string) error {
+	slo, err := s.GetSLO(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := sloCollection.RemoveId(ctx, id); err != nil {
+		return err
+	}
+	if err := s.resetSLOState(ctx, slo); err != nil {
+		return err
+	}
+	_, err = sloHistoryCollection.RemoveAll(ctx, bson.M{"slo_id": id})
+	return err
+}
+
+// resetSLOState drops the counts and state of an SLO, a burn being alerted is recorded
+// as resolved
+func (s *Service) resetSLOState(ctx context.Context, slo *model.SLO) error {
+	if _, err := sloBucketCollection.RemoveAll(ctx, bson.M{"slo_id": slo.ID}); err != nil {
+		return err
+	}
+	var state *model.SLOState
+	err := sloStateCollection.Find(ctx, bson.M{"_id": slo.ID}).One(&state)
+	if qmgo.IsErrNoDocuments(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if slo.Alert {
+		now := time.Now().UnixMilli()
+		if err := s.recordBurnChange(ctx, slo, state, &model.SLOState{}, now, false); err != nil {
+			return err
+		}
+	}
+	return sloStateCollection.RemoveId(ctx, slo.ID)
+}
+
+// FindSLOHistory returns the evaluations of an SLO in [from, to], latest first
+func (s *Service) FindSLOHistory(ctx context.Context, id string, from, to, limit int64) ([]*model.SLOSnapshot, error) {
+	if _, err := s.GetSLO(ctx, id); err != nil {
+		return nil, err
+	}
+	res := []*model.SLOSnapshot{}
+	err := sloHistoryCollection.Find(ctx, bson.M{"slo_id": id, "timestamp": bson.M{"$gte": from, "$lte": to}}).
+		Sort("-timestamp").Limit(limit).All(&res)
+	return res, err
+}
@@ -0,0 +1,296 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"kuroko.com/analystics/internal/config"
+	"kuroko.com/analystics/internal/model"
+)
+
+const (
+	dayMs = 24 * hourMs
+
+	// sloLateMs is how long after the end of an hour its requests are still expected to
+	// arrive before the hour is counted in slo_bucket
+	sloLateMs = 5 * minuteMs
+)
+
+// sloBurnWindows are the windows burn rates are computed over, the fast burn pairs 1h
+// with 5m and the slow burn 6h with 30m
+var sloBurnWindows = []struct {
+	name string
+	size int64
+}{
+	{"5m", 5 * minuteMs},
+	{"30m", 30 * minuteMs},
+	{"1h", hourMs},
+	{"6h", 6 * hourMs},
+}
+
+// StartSLOEvaluator evaluates the enabled SLOs every slo.interval until the context is
+// cancelled
+func (s *Service) StartSLOEvaluator(ctx context.Context) {
+	if *config.SLOInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(*config.SLOInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.EvaluateSLOs(ctx, time.Now().UnixMilli()); err != nil {
+				log.Printf("Failed to evaluate slos: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// EvaluateSLOs updates the state of every enabled SLO at now, in milliseconds, and
+// keeps it in the history
+func (s *Service) EvaluateSLOs(ctx context.Context, now int64) error {
+	var slos []*model.SLO
+	if err := sloCollection.Find(ctx, bson.M{"enabled": true}).All(&slos); err != nil {
+		return err
+	}
+	if len(slos) == 0 {
+		return nil
+	}
+	var silences []*model.AlertSilence
+	if err := alertSilenceCollection.Find(ctx, bson.M{}).All(&silences); err != nil {
+		return err
+	}
+	for _, slo := range slos {
+		if err := s.evaluateSLO(ctx, slo, silences, now); err != nil {
+			log.Printf("Failed to evaluate slo %s: %v", slo.ID, err)
+		}
+	}
+	if *config.SLOHistoryRetention > 0 {
+		_, err := sloHistoryCollection.RemoveAll(ctx, bson.M{"timestamp": bson.M{"$lt": now - config.SLOHistoryRetention.Milliseconds()}})
+		return err
+	}
+	return nil
+}
+
+type sloCount struct {
+	Bucket int64 `bson:"_id"`
+	Total  int64 `bson:"total"`
+	Good   int64 `bson:"good"`
+}
+
+func (s *Service) evaluateSLO(ctx context.Context, slo *model.SLO, silences []*model.AlertSilence, now int64) error {
+	var old *model.SLOState
+	err := sloStateCollection.Find(ctx, bson.M{"_id": slo.ID}).One(&old)
+	if qmgo.IsErrNoDocuments(err) {
+		old = &model.SLOState{SLOID: slo.ID}
+	} else if err != nil {
+		return err
+	}
+
+	// complete hours of the window are counted once in slo_bucket, the minutes before
+	// the first complete hour and after the last counted one are read from the requests.
+	// A new window is counted slo.bucket-hours at a time, until it is caught up the
+	// totals miss hours, so neither the SLI nor the burns are reported
+	windowStart := now - int64(slo.WindowDays)*dayMs
+	firstHour := (windowStart + hourMs - 1) / hourMs * hourMs
+	bucketedUntil := max(old.BucketedUntil, firstHour)
+	hourEnd := min((now-sloLateMs)/hourMs*hourMs, bucketedUntil+int64(*config.SLOBucketHours)*hourMs)
+	if bucketedUntil < hourEnd {
+		counts, err := s.sloCounts(ctx, slo, bucketedUntil, hourEnd, hourMs)
+		if err != nil {
+			return err
+		}
+		for _, c := range counts {
+			id := slo.ID + "|" + strconv.FormatInt(c.Bucket, 10)
+			_, err := sloBucketCollection.UpsertId(ctx, id, &model.SLOBucket{ID: id, SLOID: slo.ID, Bucket: c.Bucket, Total: c.Total, Good: c.Good})
+			if err != nil {
+				return err
+			}
+		}
+		bucketedUntil = hourEnd
+	}
+	if _, err := sloBucketCollection.RemoveAll(ctx, bson.M{"slo_id": slo.ID, "bucket": bson.M{"$lt": firstHour}}); err != nil {
+		return err
+	}
+	var buckets []*model.SLOBucket
+	err = sloBucketCollection.Find(ctx, bson.M{"slo_id": slo.ID, "bucket": bson.M{"$gte": firstHour, "$lt": bucketedUntil}}).All(&buckets)
+	if err != nil {
+		return err
+	}
+	head, err := s.sloCounts(ctx, slo, windowStart, firstHour, hourMs)
+	if err != nil {
+		return err
+	}
+	longest := sloBurnWindows[len(sloBurnWindows)-1].size
+	minutesFrom := (now - longest) / minuteMs * minuteMs
+	catchingUp := bucketedUntil < (now-sloLateMs)/hourMs*hourMs
+	if !catchingUp {
+		minutesFrom = min(minutesFrom, bucketedUntil)
+	}
+	minutes, err := s.sloCounts(ctx, slo, minutesFrom, now, minuteMs)
+	if err != nil {
+		return err
+	}
+
+	state := &model.SLOState{SLOID: slo.ID, Timestamp: now, CatchingUp: catchingUp, BucketedUntil: bucketedUntil}
+	for _, b := range buckets {
+		state.Total += b.Total
+		state.Good += b.Good
+	}
+	for _, c := range head {
+		state.Total += c.Total
+		state.Good += c.Good
+	}
+	fillSLOState(state, slo, minutes, now)
+	if catchingUp {
+		// the burns keep their last value, they change once the window is counted
+		state.FastBurn, state.SlowBurn = old.FastBurn, old.SlowBurn
+	}
+
+	if slo.Alert && !catchingUp {
+		silenced := false
+		rule := &model.AlertRule{ID: slo.ID, Target: sloTarget(slo)}
+		for _, silence := range silences {
+			if silenceMatches(silence, rule, now) {
+				silenced = true
+				break
+			}
+		}
+		if err := s.recordBurnChange(ctx, slo, old, state, now, silenced); err != nil {
+			return err
+		}
+	}
+	if _, err := sloStateCollection.UpsertId(ctx, slo.ID, state); err != nil {
+		return err
+	}
+	if catchingUp {
+		return nil
+	}
+	_, err = sloHistoryCollection.InsertOne(ctx, &model.SLOSnapshot{
+		ID:              primitive.NewObjectID().Hex(),
+		SLOID:           slo.ID,
+		Timestamp:       now,
+		Total:           state.Total,
+		Good:            state.Good,
+		SLI:             state.SLI,
+		BudgetRemaining: state.BudgetRemaining,
+		BurnRates:       state.BurnRates,
+		FastBurn:        state.FastBurn,
+		SlowBurn:        state.SlowBurn,
+	})
+	return err
+}
+
+// fillSLOState computes the burn rates from the counts by minute of the longest burn
+// window, adds the minutes from state.BucketedUntil on to the totals and, unless the
+// state is catching up, computes the SLI, the error budget and the burns
+func fillSLOState(state *model.SLOState, slo *model.SLO, minutes []*sloCount, now int64) {
+	budget := 1 - slo.Objective/100
+	state.BurnRates = make(map[string]float64, len(sloBurnWindows))
+	for _, w := range sloBurnWindows {
+		var total, good int64
+		for _, m := range minutes {
+			if m.Bucket >= (now-w.size)/minuteMs*minuteMs {
+				total += m.Total
+				good += m.Good
+			}
+		}
+		state.BurnRates[w.name] = 0
+		if total > 0 {
+			state.BurnRates[w.name] = float64(total-good) / float64(total) / budget
+		}
+	}
+	for _, m := range minutes {
+		if m.Bucket >= state.BucketedUntil {
+			state.Total += m.Total
+			state.Good += m.Good
+		}
+	}
+	if state.CatchingUp {
+		return
+	}
+	state.SLI, state.BudgetRemaining = 100, 100
+	if state.Total > 0 {
+		state.SLI = float64(state.Good) * 100 / float64(state.Total)
+		state.ErrorBudget = budget * float64(state.Total)
+		state.BudgetRemaining = (1 - float64(state.Total-state.Good)/state.ErrorBudget) * 100
+	}
+	state.FastBurn = state.BurnRates["1h"] >= slo.FastBurnRate && state.BurnRates["5m"] >= slo.FastBurnRate
+	state.SlowBurn = state.BurnRates["6h"] >= slo.SlowBurnRate && state.BurnRates["30m"] >= slo.SlowBurnRate
+}
+
+// sloCounts counts the requests and the good requests of the SLO in [from, to) by
+// bucket of size milliseconds
+func (s *Service) sloCounts(ctx context.Context, slo *model.SLO, from, to, size int64) ([]*sloCount, error) {
+	good := bson.M{"$lt": bson.A{"$status_code", slo.ErrorStatus}}
+	if slo.LatencyThreshold > 0 {
+		good = bson.M{"$and": bson.A{good, bson.M{"$lte": bson.A{"$duration", slo.LatencyThreshold * 1000}}}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"service_name": slo.ServiceName,
+			"uri_path":     slo.URIPath,
+			"method":       slo.Method,
+			"start_time":   bson.M{"$gte": from, "$lt": to},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"$subtract": bson.A{"$start_time", bson.M{"$mod": bson.A{"$start_time", size}}}},
+			"total": bson.M{"$sum": 1},
+			"good":  bson.M{"$sum": bson.M{"$cond": bson.A{good, 1, 0}}},
+		}}},
+	}
+	var counts []*sloCount
+	err := httpLogEntryCollection.Aggregate(ctx, pipeline).All(&counts)
+	return counts, err
+}
+
+func sloTarget(slo *model.SLO) model.AlertTarget {
+	return model.AlertTarget{Kind: "api", ServiceName: slo.ServiceName, URIPath: slo.URIPath, Method: slo.Method}
+}
+
+// recordBurnChange records a firing or resolved alert event for the fast and slow burns
+// that changed between the states
+func (s *Service) recordBurnChange(ctx context.Context, slo *model.SLO, old, cur *model.SLOState, now int64, silenced bool) error {
+	burns := []struct {
+		metric    string
+		was, is   bool
+		window    string
+		threshold float64
+	}{
+		{model.AlertMetricSLOFastBurn, old.FastBurn, cur.FastBurn, "1h", slo.FastBurnRate},
+		{model.AlertMetricSLOSlowBurn, old.SlowBurn, cur.SlowBurn, "6h", slo.SlowBurnRate},
+	}
+	for _, b := range burns {
+		if b.was == b.is {
+			continue
+		}
+		state := model.AlertStateResolved
+		if b.is {
+			state = model.AlertStateFiring
+		}
+		err := s.publishAlertEvent(ctx, slo.Channels, &model.AlertEvent{
+			ID:        primitive.NewObjectID().Hex(),
+			RuleID:    slo.ID,
+			RuleName:  slo.Name,
+			Target:    sloTarget(slo),
+			Metric:    b.metric,
+			State:     state,
+			Value:     cur.BurnRates[b.window],
+			Threshold: b.threshold,
+			Silenced:  silenced,
+			Timestamp: now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
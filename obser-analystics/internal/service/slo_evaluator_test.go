@@ -0,0 +1,109 @@
+package service
+
+import (
+	"math"
+	"testing"
+
+	"kuroko.com/analystics/internal/model"
+)
+
+func TestFillSLOState(t *testing.T) {
+	const now = int64(480_000)*hourMs + 30*minuteMs
+	// a 99% objective allows 1 bad request in 100
+	slo := &model.SLO{Objective: 99, FastBurnRate: 14.4, SlowBurnRate: 6}
+	minute := func(ago, total, good int64) *sloCount {
+		return &sloCount{Bucket: (now - ago*minuteMs) / minuteMs * minuteMs, Total: total, Good: good}
+	}
+
+	tests := []struct {
+		name       string
+		counted    [2]int64 // total and good requests already counted from slo_bucket
+		catchingUp bool
+		minutes    []*sloCount
+		wantTotal  int64
+		wantSLI    float64
+		wantBudget float64 // percent remaining
+		wantBurn   map[string]float64
+		fast, slow bool
+	}{
+		{
+			name:       "no requests",
+			wantSLI:    100,
+			wantBudget: 100,
+			wantBurn:   map[string]float64{"5m": 0, "6h": 0},
+		},
+		{
+			name:       "half the budget spent",
+			counted:    [2]int64{1000, 995},
+			wantTotal:  1000,
+			wantSLI:    99.5,
+			wantBudget: 50,
+		},
+		{
+			name:       "budget exhausted twice over",
+			counted:    [2]int64{1000, 970},
+			wantTotal:  1000,
+			wantSLI:    97,
+			wantBudget: -200,
+		},
+		{
+			name:       "bad requests in every window burn fast and slow",
+			counted:    [2]int64{100_000, 100_000},
+			minutes:    []*sloCount{minute(1, 100, 80)},
+			wantTotal:  100_100,
+			wantSLI:    100_080 * 100 / 100_100.0,
+			wantBudget: (1 - 20/1001.0) * 100,
+			wantBurn:   map[string]float64{"5m": 20, "30m": 20, "1h": 20, "6h": 20},
+			fast:       true,
+			slow:       true,
+		},
+		{
+			name:       "a spike diluted over the hour burns only the short windows",
+			counted:    [2]int64{100_000, 100_000},
+			minutes:    []*sloCount{minute(2, 100, 80), minute(50, 100_000, 100_000)},
+			wantTotal:  100_100,
+			wantSLI:    100_080 * 100 / 100_100.0,
+			wantBudget: (1 - 20/1001.0) * 100,
+			wantBurn:   map[string]float64{"5m": 20, "30m": 20, "1h": 20 / 1001.0, "6h": 20 / 1001.0},
+		},
+		{
+			name:       "minutes counted in slo_bucket are not added twice",
+			counted:    [2]int64{500, 500},
+			minutes:    []*sloCount{minute(120, 50, 50), minute(10, 100, 99)},
+			wantTotal:  600,
+			wantSLI:    599 * 100 / 600.0,
+			wantBudget: (1 - 1/6.0) * 100,
+		},
+		{
+			name:       "catching up reports no SLI nor burn",
+			counted:    [2]int64{10, 10},
+			catchingUp: true,
+			minutes:    []*sloCount{minute(1, 100, 0)},
+			wantTotal:  110,
+			wantBurn:   map[string]float64{"5m": 100, "6h": 100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &model.SLOState{
+				Total:         tt.counted[0],
+				Good:          tt.counted[1],
+				CatchingUp:    tt.catchingUp,
+				BucketedUntil: now / hourMs * hourMs,
+			}
+			fillSLOState(state, slo, tt.minutes, now)
+			near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+			if state.Total != tt.wantTotal || !near(state.SLI, tt.wantSLI) || !near(state.BudgetRemaining, tt.wantBudget) {
+				t.Errorf("total %d, sli %v, budget %v, want %d, %v, %v", state.Total, state.SLI, state.BudgetRemaining, tt.wantTotal, tt.wantSLI, tt.wantBudget)
+			}
+			for window, want := range tt.wantBurn {
+				if !near(state.BurnRates[window], want) {
+					t.Errorf("burn rate %s = %v, want %v", window, state.BurnRates[window], want)
+				}
+			}
+			if state.FastBurn != tt.fast || state.SlowBurn != tt.slow {
+				t.Errorf("fast %v slow %v, want %v %v", state.FastBurn, state.SlowBurn, tt.fast, tt.slow)
+			}
+		})
+	}
+}
@@ -8,7 +8,7 @@ import (
 )
 
 func (s *Service) FindServiceStatisticByDate(ctx context.Context, date string) ([]model.ServiceStatisticObject, error) {
-	var res []model.ServiceStatisticObject
+	res := []model.ServiceStatisticObject{}
 	err := serviceStatisticObjectCollection.Find(ctx, bson.M{"date": date}).All(&res)
 	if err != nil {
 		return nil, err
@@ -17,7 +17,7 @@ func (s *Service) FindServiceStatisticByDate(ctx context.Context, date string) (
 }
 
 func (s *Service) FindServiceStatisticByDateAndName(ctx context.Context, date string, svcName string) ([]model.ServiceStatisticObject, error) {
-	var res []model.ServiceStatisticObject
+	res := []model.ServiceStatisticObject{}
 	err := serviceStatisticObjectCollection.Find(ctx, bson.M{"date": date, "service_name": svcName}).All(&res)
 	if err != nil {
 		return nil, err
@@ -26,7 +26,7 @@ func (s *Service) FindServiceStatisticByDateAndName(ctx context.Context, date st
 }
 
 func (s *Service) FindURIStatisticByDate(ctx context.Context, date string) ([]model.URIStatisticObject, error) {
-	var res []model.URIStatisticObject
+	res := []model.URIStatisticObject{}
 	err := uriStatisticObjectCollection.Find(ctx, bson.M{"date": date}).All(&res)
 	if err != nil {
 		return nil, err
@@ -35,7 +35,7 @@ func (s *Service) FindURIStatisticByDate(ctx context.Context, date string) ([]mo
 }
 
 func (s *Service) FindURIStatisticByDateAndUri(ctx context.Context, date string, uriPath string) ([]model.URIStatisticObject, error) {
-	var res []model.URIStatisticObject
+	res := []model.URIStatisticObject{}
 	err := uriStatisticObjectCollection.Find(ctx, bson.M{"date": date, "uri_path": uriPath}).All(&res)
 	if err != nil {
 		return nil, err
@@ -2,18 +2,24 @@ package service
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"kuroko.com/analystics/internal/model"
 )
 
-func (s *Service) GetAllTracesOfPath(ctx context.Context, pathId uint32, _from, _to string) ([]*model.TraceSummaryResponse, error) {
+func (s *Service) GetAllTracesOfPath(ctx context.Context, pathId uint64, _from, _to string) ([]*model.TraceSummaryResponse, error) {
 	from, to := ParseFromToStringToInt(_from, _to)
 	var pe []*model.PathEvent
 	err := pathEventCollection.Find(ctx, bson.M{
-		"path_id":   pathId,
-		"timestamp": bson.M{"$gte": from, "$lte": to}},
+		"path_id":     pathId,
+		"timestamp":   bson.M{"$gte": from, "$lte": to},
+		"sampled_out": bson.M{"$ne": true}},
 	).Limit(10).All(&pe)
 	if err != nil {
 		return nil, err
@@ -55,6 +61,173 @@ func (s *Service) GetAllTracesOfPath(ctx context.Context, pathId uint32, _from,
 	return response, nil
 }
 
+// ErrInvalidTraceQuery is returned for a sort order or cursor SearchTraces cannot use
+var ErrInvalidTraceQuery = errors.New("invalid trace query")
+
+// traceSortFields maps the sort orders of SearchTraces to the summary field sorted on
+var traceSortFields = map[string]string{
+	"latest":  "start",
+	"slowest": "duration",
+	"spans":   "span_num",
+}
+
+// traceCursor is the position after the last trace of a page
+type traceCursor struct {
+	Value   int64  `json:"v"`
+	TraceID string `json:"id"`
+}
+
+// SearchTraces summarizes the traces with spans in the time range and returns one
+// page of those matching the query, ordered by the sort field then trace id
+func (s *Service) SearchTraces(ctx context.Context, q *model.TraceSearchQuery) (*model.TraceSearchResponse, error) {
+	sortField, ok := traceSortFields[q.Sort]
+	if !ok {
+		return nil, fmt.Errorf("%w: sort must be latest, slowest or spans", ErrInvalidTraceQuery)
+	}
+
+	// a trace matches when one of its spans satisfies every span filter
+	var spanConds bson.A
+	if q.Service != "" {
+		spanConds = append(spanConds, bson.M{"$eq": bson.A{"$service", q.Service}})
+	}
+	if q.Operation != "" {
+		spanConds = append(spanConds, bson.M{"$eq": bson.A{"$operation", q.Operation}})
+	}
+	for _, tag := range q.Tags {
+		spanConds = append(spanConds, spanTagMatch(tag))
+	}
+	var matched any = true
+	if len(spanConds) > 0 {
+		matched = bson.M{"$and": spanConds}
+	}
+
+	group := bson.M{
+		"_id":       "$trace_id",
+		"start":     bson.M{"$min": "$timestamp"},
+		"duration":  bson.M{"$max": "$duration"},
+		"span_num":  bson.M{"$sum": 1},
+		"has_error": bson.M{"$max": "$has_error"},
+		"root_service": bson.M{"$max": bson.M{
+			"$cond": bson.A{bson.M{"$eq": bson.A{"$parent_id", ""}}, "$service", nil},
+		}},
+		"root_operation": bson.M{"$max": bson.M{
+			"$cond": bson.A{bson.M{"$eq": bson.A{"$parent_id", ""}}, "$operation", nil},
+		}},
+		"matched": bson.M{"$max": matched},
+	}
+
+	traceFilter := bson.M{"matched": true}
+	duration := bson.M{}
+	if q.MinDuration > 0 {
+		duration["$gte"] = q.MinDuration
+	}
+	if q.MaxDuration > 0 {
+		duration["$lte"] = q.MaxDuration
+	}
+	if len(duration) > 0 {
+		traceFilter["duration"] = duration
+	}
+	if q.HasError != nil {
+		traceFilter["has_error"] = *q.HasError
+	}
+	if q.Cursor != "" {
+		cursor, err := decodeTraceCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		traceFilter["$or"] = traceCursorFilter(sortField, cursor)
+	}
+
+	pipeline := mongo.Pipeline{
+		// span timestamps are in microseconds
+		{{Key: "$match", Value: bson.M{"timestamp": bson.M{"$gte": q.From * 1000, "$lte": q.To * 1000}}}},
+		{{Key: "$group", Value: group}},
+		{{Key: "$match", Value: traceFilter}},
+		{{Key: "$sort", Value: bson.D{{Key: sortField, Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: q.Limit + 1}},
+	}
+	var summaries []*traceSummary
+	if err := spanCollection.Aggregate(ctx, pipeline).All(&summaries); err != nil {
+		return nil, err
+	}
+	return traceSearchPage(summaries, q.Limit, sortField), nil
+}
+
+// traceSummary is a trace grouped by SearchTraces
+type traceSummary struct {
+	TraceID       string `bson:"_id"`
+	Start         int64  `bson:"start"`
+	Duration      int64  `bson:"duration"`
+	SpanNum       int64  `bson:"span_num"`
+	HasError      bool   `bson:"has_error"`
+	RootService   string `bson:"root_service"`
+	RootOperation string `bson:"root_operation"`
+}
+
+// spanTagMatch is an expression true when a span has the tag, it compares the fields
+// by name so it does not depend on their order in the stored documents
+func spanTagMatch(tag model.KeyValue) bson.M {
+	return bson.M{"$anyElementTrue": bson.A{bson.M{"$map": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$tags", bson.A{}}},
+		"as":    "tag",
+		"in": bson.M{"$and": bson.A{
+			bson.M{"$eq": bson.A{"$$tag.key", tag.Key}},
+			bson.M{"$eq": bson.A{"$$tag.value", tag.Value}},
+		}},
+	}}}}
+}
+
+// traceCursorFilter matches the traces after the cursor in the order of SearchTraces,
+// sortField descending then trace id ascending
+func traceCursorFilter(sortField string, cursor *traceCursor) bson.A {
+	return bson.A{
+		bson.M{sortField: bson.M{"$lt": cursor.Value}},
+		bson.M{sortField: cursor.Value, "_id": bson.M{"$gt": cursor.TraceID}},
+	}
+}
+
+// traceSearchPage returns the first limit summaries, with a cursor after the last one
+// when more were found
+func traceSearchPage(summaries []*traceSummary, limit int, sortField string) *model.TraceSearchResponse {
+	res := &model.TraceSearchResponse{Traces: []*model.TraceSummaryResponse{}}
+	for i, sum := range summaries {
+		if i == limit {
+			last := summaries[i-1]
+			value := map[string]int64{"start": last.Start, "duration": last.Duration, "span_num": last.SpanNum}[sortField]
+			res.NextCursor = encodeTraceCursor(traceCursor{Value: value, TraceID: last.TraceID})
+			break
+		}
+		res.Traces = append(res.Traces, &model.TraceSummaryResponse{
+			TraceId:       sum.TraceID,
+			RootService:   sum.RootService,
+			RootOperation: sum.RootOperation,
+			StartTime:     sum.Start,
+			SpanNum:       int(sum.SpanNum),
+			Duration:      int(sum.Duration),
+			HasError:      sum.HasError,
+		})
+	}
+	return res
+}
+
+func encodeTraceCursor(c traceCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeTraceCursor(s string) (*traceCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidTraceQuery)
+	}
+	var c traceCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidTraceQuery)
+	}
+	return &c, nil
+}
+
+// GetTraceById returns nil when the trace has no stored span, as sampled out traces
 func (s *Service) GetTraceById(ctx context.Context, traceId string) (*model.TraceResponse, error) {
 	var trace = &model.TraceResponse{}
 	var spans []*model.Span
@@ -62,6 +235,9 @@ func (s *Service) GetTraceById(ctx context.Context, traceId string) (*model.Trac
 	if err != nil {
 		return nil, err
 	}
+	if len(spans) == 0 {
+		return nil, nil
+	}
 	trace.Spans = spans
 	spanErrMap := make(map[string]bool)
 	for _, span := range spans {
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/analystics/internal/model"
+)
+
+// operationAgg accumulates the spans of one service_operation ID on a comparison side
+type operationAgg struct {
+	service   string
+	operation string
+	traces    int
+	spans     int
+	errors    int
+	duration  int64
+	durations *Sketch // summed duration per trace
+}
+
+type compareSide struct {
+	info       model.TraceCompareSide
+	duration   int64
+	durations  *Sketch
+	operations map[string]*operationAgg
+}
+
+func newCompareSide(info model.TraceCompareSide) *compareSide {
+	return &compareSide{info: info, durations: NewSketch(), operations: make(map[string]*operationAgg)}
+}
+
+// add folds the spans of one trace into the side
+func (cs *compareSide) add(spans []*model.Span) {
+	var start, end int64
+	durations := make(map[string]int64)
+	for i, span := range spans {
+		if i == 0 || span.Timestamp < start {
+			start = span.Timestamp
+		}
+		if e := span.Timestamp + int64(span.Duration); e > end {
+			end = e
+		}
+		id := strings.ToUpper(span.Service + "_" + span.Operation)
+		op, ok := cs.operations[id]
+		if !ok {
+			op = &operationAgg{service: span.Service, operation: span.Operation, durations: NewSketch()}
+			cs.operations[id] = op
+		}
+		if _, seen := durations[id]; !seen {
+			op.traces++
+		}
+		op.spans++
+		op.duration += int64(span.Duration)
+		durations[id] += int64(span.Duration)
+		if span.HasError {
+			op.errors++
+			cs.info.ErrorCount++
+		}
+	}
+	cs.info.TraceCount++
+	cs.info.SpanCount += len(spans)
+	cs.duration += end - start
+	cs.durations.Add(end - start)
+	for id, d := range durations {
+		cs.operations[id].durations.Add(d)
+	}
+}
+
+// CompareTraces diffs two traces span by span, it returns nil when either trace has no
+// stored span
+func (s *Service) CompareTraces(ctx context.Context, traceA, traceB string) (*model.TraceComparison, error) {
+	var spans []*model.Span
+	err := spanCollection.Find(ctx, bson.M{"trace_id": bson.M{"$in": bson.A{traceA, traceB}}}).All(&spans)
+	if err != nil {
+		return nil, err
+	}
+	byTrace := make(map[string][]*model.Span)
+	for _, span := range spans {
+		byTrace[span.TraceID] = append(byTrace[span.TraceID], span)
+	}
+	if len(byTrace[traceA]) == 0 || len(byTrace[traceB]) == 0 {
+		return nil, nil
+	}
+
+	a := newCompareSide(model.TraceCompareSide{TraceID: traceA, PathID: byTrace[traceA][0].PathID})
+	a.add(byTrace[traceA])
+	b := newCompareSide(model.TraceCompareSide{TraceID: traceB, PathID: byTrace[traceB][0].PathID})
+	b.add(byTrace[traceB])
+	return compareSides(a, b, nil), nil
+}
+
+// ComparePathWindows diffs the traces of a path in two time windows, the latest limit
+// ones of each when limit is positive, from and to are in milliseconds
+func (s *Service) ComparePathWindows(ctx context.Context, pathId uint64, aFrom, aTo, bFrom, bTo, limit int64, quantiles []float64) (*model.TraceComparison, error) {
+	a := newCompareSide(model.TraceCompareSide{PathID: pathId, From: aFrom, To: aTo})
+	if err := forEachPathTrace(ctx, pathId, aFrom, aTo, limit, func(_ string, spans []*model.Span) { a.add(spans) }); err != nil {
+		return nil, err
+	}
+	b := newCompareSide(model.TraceCompareSide{PathID: pathId, From: bFrom, To: bTo})
+	if err := forEachPathTrace(ctx, pathId, bFrom, bTo, limit, func(_ string, spans []*model.Span) { b.add(spans) }); err != nil {
+		return nil, err
+	}
+	return compareSides(a, b, quantiles), nil
+}
+
+// compareSides diffs two sides, with the given latency quantiles when they are not nil
+func compareSides(a, b *compareSide, quantiles []float64) *model.TraceComparison {
+	res := &model.TraceComparison{
+		A:           a.info,
+		B:           b.info,
+		Operations:  []*model.OperationDiff{},
+		Added:       []string{},
+		Missing:     []string{},
+		NewErrors:   []string{},
+		FixedErrors: []string{},
+	}
+	if a.info.TraceCount > 0 {
+		res.A.Duration = a.duration / int64(a.info.TraceCount)
+	}
+	if b.info.TraceCount > 0 {
+		res.B.Duration = b.duration / int64(b.info.TraceCount)
+	}
+	res.DurationDelta = res.B.Duration - res.A.Duration
+	if quantiles != nil {
+		res.A.Quantiles = a.durations.Quantiles(quantiles)
+		res.B.Quantiles = b.durations.Quantiles(quantiles)
+	}
+
+	ids := make(map[string]bool)
+	for id := range a.operations {
+		ids[id] = true
+	}
+	for id := range b.operations {
+		ids[id] = true
+	}
+	for id := range ids {
+		diff := &model.OperationDiff{ID: id, Status: "common"}
+		opA, inA := a.operations[id]
+		opB, inB := b.operations[id]
+		if inA {
+			diff.Service, diff.Operation = opA.service, opA.operation
+			diff.ATraces, diff.ASpans, diff.AErrors = opA.traces, opA.spans, opA.errors
+			diff.ADuration = opA.duration / int64(opA.traces)
+			if quantiles != nil {
+				diff.AQuantiles = opA.durations.Quantiles(quantiles)
+			}
+		}
+		if inB {
+			diff.Service, diff.Operation = opB.service, opB.operation
+			diff.BTraces, diff.BSpans, diff.BErrors = opB.traces, opB.spans, opB.errors
+			diff.BDuration = opB.duration / int64(opB.traces)
+			if quantiles != nil {
+				diff.BQuantiles = opB.durations.Quantiles(quantiles)
+			}
+		}
+		diff.DurationDelta = diff.BDuration - diff.ADuration
+		switch {
+		case !inA:
+			diff.Status = "added"
+			res.Added = append(res.Added, id)
+		case !inB:
+			diff.Status = "missing"
+			res.Missing = append(res.Missing, id)
+		}
+		if diff.AErrors == 0 && diff.BErrors > 0 {
+			res.NewErrors = append(res.NewErrors, id)
+		}
+		if diff.AErrors > 0 && diff.BErrors == 0 && inB {
+			res.FixedErrors = append(res.FixedErrors, id)
+		}
+		res.Operations = append(res.Operations, diff)
+	}
+
+	// the largest regressions first
+	sort.Slice(res.Operations, func(i, j int) bool {
+		if res.Operations[i].DurationDelta != res.Operations[j].DurationDelta {
+			return res.Operations[i].DurationDelta > res.Operations[j].DurationDelta
+		}
+		return res.Operations[i].ID < res.Operations[j].ID
+	})
+	sort.Strings(res.Added)
+	sort.Strings(res.Missing)
+	sort.Strings(res.NewErrors)
+	sort.Strings(res.FixedErrors)
+	return res
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"kuroko.com/analystics/internal/model"
+)
+
+func TestCompareSides(t *testing.T) {
+	span := func(service, operation string, start int64, duration int, hasError bool) *model.Span {
+		return &model.Span{Service: service, Operation: operation, Timestamp: start, Duration: duration, HasError: hasError}
+	}
+	// the baseline calls order twice, one call failing, the compared trace calls it
+	// once for longer and calls user instead of failing
+	baseline := []*model.Span{
+		span("gateway", "GET", 0, 100, false),
+		span("order", "load", 10, 30, true),
+		span("order", "load", 50, 10, false),
+		span("cart", "read", 60, 20, false),
+	}
+	compared := []*model.Span{
+		span("gateway", "GET", 0, 150, false),
+		span("order", "load", 10, 120, false),
+		span("user", "auth", 130, 10, true),
+	}
+
+	a := newCompareSide(model.TraceCompareSide{TraceID: "a"})
+	a.add(baseline)
+	b := newCompareSide(model.TraceCompareSide{TraceID: "b"})
+	b.add(compared)
+	res := compareSides(a, b, nil)
+
+	if res.A.Duration != 100 || res.B.Duration != 150 || res.DurationDelta != 50 {
+		t.Errorf("durations %d and %d, delta %d, want 100, 150 and 50", res.A.Duration, res.B.Duration, res.DurationDelta)
+	}
+	if res.A.SpanCount != 4 || res.A.ErrorCount != 1 || res.B.SpanCount != 3 || res.B.ErrorCount != 1 {
+		t.Errorf("sides %+v and %+v", res.A, res.B)
+	}
+	for name, got := range map[string][]string{"added": res.Added, "missing": res.Missing, "new errors": res.NewErrors, "fixed errors": res.FixedErrors} {
+		want := map[string][]string{
+			"added":        {"USER_AUTH"},
+			"missing":      {"CART_READ"},
+			"new errors":   {"USER_AUTH"},
+			"fixed errors": {"ORDER_LOAD"},
+		}[name]
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+
+	// the largest regression first, the summed calls of an operation compared
+	want := []struct {
+		id                   string
+		status               string
+		aDuration, bDuration int64
+		aSpans, bSpans       int
+	}{
+		{"ORDER_LOAD", "common", 40, 120, 2, 1},
+		{"GATEWAY_GET", "common", 100, 150, 1, 1},
+		{"USER_AUTH", "added", 0, 10, 0, 1},
+		{"CART_READ", "missing", 20, 0, 1, 0},
+	}
+	if len(res.Operations) != len(want) {
+		t.Fatalf("got %d operations, want %d", len(res.Operations), len(want))
+	}
+	for i, w := range want {
+		op := res.Operations[i]
+		if op.ID != w.id || op.Status != w.status || op.ADuration != w.aDuration || op.BDuration != w.bDuration || op.ASpans != w.aSpans || op.BSpans != w.bSpans {
+			t.Errorf("operation %d = %+v, want %+v", i, op, w)
+		}
+		if op.DurationDelta != w.bDuration-w.aDuration {
+			t.Errorf("operation %s delta %d", op.ID, op.DurationDelta)
+		}
+		if op.AQuantiles != nil || op.BQuantiles != nil {
+			t.Errorf("operation %s of single traces has quantiles", op.ID)
+		}
+	}
+}
+
+func TestCompareWindowsQuantiles(t *testing.T) {
+	a := newCompareSide(model.TraceCompareSide{PathID: 1})
+	b := newCompareSide(model.TraceCompareSide{PathID: 1})
+	// 100 traces per window, one slow trace in the baseline and ten in the compared one
+	for i := 0; i < 100; i++ {
+		durationA, durationB := 1000, 1000
+		if i == 0 {
+			durationA = 50_000
+		}
+		if i < 10 {
+			durationB = 50_000
+		}
+		a.add([]*model.Span{{Service: "s", Operation: "o", Duration: durationA}})
+		b.add([]*model.Span{{Service: "s", Operation: "o", Duration: durationB}})
+	}
+	res := compareSides(a, b, []float64{0.5, 0.95})
+
+	near := func(got map[string]int, q string, want int) bool {
+		return got[q] >= want*99/100 && got[q] <= want*101/100
+	}
+	if !near(res.A.Quantiles, "0.5", 1000) || !near(res.A.Quantiles, "0.95", 1000) {
+		t.Errorf("baseline quantiles %v, want p50 and p95 of 1000", res.A.Quantiles)
+	}
+	if !near(res.B.Quantiles, "0.5", 1000) || !near(res.B.Quantiles, "0.95", 50_000) {
+		t.Errorf("compared quantiles %v, want p50 of 1000 and p95 of 50000", res.B.Quantiles)
+	}
+	op := res.Operations[0]
+	if !reflect.DeepEqual(op.AQuantiles, res.A.Quantiles) || !reflect.DeepEqual(op.BQuantiles, res.B.Quantiles) {
+		t.Errorf("operation quantiles %v and %v, want those of the traces", op.AQuantiles, op.BQuantiles)
+	}
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"cmp"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/analystics/internal/model"
+)
+
+// lookup reads a field of a bson.M or bson.D document
+func lookup(doc any, name string) any {
+	switch d := doc.(type) {
+	case bson.M:
+		return d[name]
+	case bson.D:
+		for _, e := range d {
+			if e.Key == name {
+				return e.Value
+			}
+		}
+	}
+	return nil
+}
+
+// evalExpr evaluates the few aggregation expressions SearchTraces builds
+func evalExpr(t *testing.T, expr any, doc any, vars map[string]any) any {
+	switch e := expr.(type) {
+	case string:
+		if path, ok := strings.CutPrefix(e, "$$"); ok {
+			name, field, _ := strings.Cut(path, ".")
+			return lookup(vars[name], field)
+		}
+		if field, ok := strings.CutPrefix(e, "$"); ok {
+			return lookup(doc, field)
+		}
+		return e
+	case bson.A:
+		res := make(bson.A, len(e))
+		for i, v := range e {
+			res[i] = evalExpr(t, v, doc, vars)
+		}
+		return res
+	case bson.M:
+		if len(e) != 1 {
+			t.Fatalf("expression %v has several operators", e)
+		}
+		for op, arg := range e {
+			switch op {
+			case "$and":
+				for _, v := range arg.(bson.A) {
+					if evalExpr(t, v, doc, vars) != true {
+						return false
+					}
+				}
+				return true
+			case "$eq":
+				args := evalExpr(t, arg, doc, vars).(bson.A)
+				return reflect.DeepEqual(args[0], args[1])
+			case "$ifNull":
+				args := arg.(bson.A)
+				if v := evalExpr(t, args[0], doc, vars); v != nil {
+					return v
+				}
+				return evalExpr(t, args[1], doc, vars)
+			case "$anyElementTrue":
+				for _, v := range evalExpr(t, arg.(bson.A)[0], doc, vars).(bson.A) {
+					if v == true {
+						return true
+					}
+				}
+				return false
+			case "$map":
+				m := arg.(bson.M)
+				var res bson.A
+				for _, item := range evalExpr(t, m["input"], doc, vars).(bson.A) {
+					inner := map[string]any{m["as"].(string): item}
+					for k, v := range vars {
+						inner[k] = v
+					}
+					res = append(res, evalExpr(t, m["in"], doc, inner))
+				}
+				return res
+			}
+			t.Fatalf("unsupported operator %s", op)
+		}
+	}
+	return expr
+}
+
+// matches applies the equality, $lt, $gt and $or of a query filter to a summary
+func matches(t *testing.T, filter bson.M, doc bson.M) bool {
+	for field, cond := range filter {
+		if field == "$or" {
+			matched := false
+			for _, alt := range cond.(bson.A) {
+				matched = matched || matches(t, alt.(bson.M), doc)
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+		ops, ok := cond.(bson.M)
+		if !ok {
+			if doc[field] != cond {
+				return false
+			}
+			continue
+		}
+		for op, v := range ops {
+			var c int
+			switch a := doc[field].(type) {
+			case int64:
+				c = cmp.Compare(a, v.(int64))
+			case string:
+				c = cmp.Compare(a, v.(string))
+			default:
+				t.Fatalf("cannot compare %v", a)
+			}
+			if (op == "$lt" && c >= 0) || (op == "$gt" && c <= 0) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestSearchTracesPagesPastEqualSortValues(t *testing.T) {
+	// many traces share a duration, a page must end between two of them
+	var summaries []*traceSummary
+	for i := 0; i < 23; i++ {
+		summaries = append(summaries, &traceSummary{
+			TraceID:  fmt.Sprintf("t%02d", (i*7)%23),
+			Start:    int64(1000 + i),
+			Duration: int64(100 * (1 + i%3)),
+			SpanNum:  int64(1 + i%2),
+		})
+	}
+
+	for sortName, field := range traceSortFields {
+		for _, limit := range []int{1, 2, 5, 23, 50} {
+			t.Run(fmt.Sprintf("%s by %d", sortName, limit), func(t *testing.T) {
+				doc := func(s *traceSummary) bson.M {
+					return bson.M{"_id": s.TraceID, "start": s.Start, "duration": s.Duration, "span_num": s.SpanNum}
+				}
+				// the $sort of SearchTraces
+				sorted := append([]*traceSummary(nil), summaries...)
+				sort.Slice(sorted, func(i, j int) bool {
+					a, b := doc(sorted[i])[field].(int64), doc(sorted[j])[field].(int64)
+					if a != b {
+						return a > b
+					}
+					return sorted[i].TraceID < sorted[j].TraceID
+				})
+
+				var seen []string
+				cursor := ""
+				for pages := 0; pages <= len(summaries); pages++ {
+					var found []*traceSummary
+					for _, s := range sorted {
+						if cursor != "" {
+							c, err := decodeTraceCursor(cursor)
+							if err != nil {
+								t.Fatal(err)
+							}
+							if !matches(t, bson.M{"$or": traceCursorFilter(field, c)}, doc(s)) {
+								continue
+							}
+						}
+						if len(found) < limit+1 {
+							found = append(found, s)
+						}
+					}
+					page := traceSearchPage(found, limit, field)
+					for _, trace := range page.Traces {
+						seen = append(seen, trace.TraceId)
+					}
+					if cursor = page.NextCursor; cursor == "" {
+						break
+					}
+				}
+				if len(seen) != len(sorted) {
+					t.Fatalf("paged through %d traces %v, want %d", len(seen), seen, len(sorted))
+				}
+				for i, s := range sorted {
+					if seen[i] != s.TraceID {
+						t.Fatalf("trace %d is %s, want %s", i, seen[i], s.TraceID)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSpanTagMatch(t *testing.T) {
+	tag := model.KeyValue{Key: "http.status_code", Value: "500"}
+	tests := []struct {
+		name string
+		tags any
+		want bool
+	}{
+		{"key before value", bson.A{bson.D{{Key: "key", Value: "http.status_code"}, {Key: "value", Value: "500"}}}, true},
+		{"value before key", bson.A{bson.D{{Key: "value", Value: "500"}, {Key: "key", Value: "http.status_code"}}}, true},
+		{"among other tags", bson.A{bson.M{"key": "a", "value": "b"}, bson.M{"key": "http.status_code", "value": "500"}}, true},
+		{"value of another tag", bson.A{bson.M{"key": "http.status_code", "value": "200"}, bson.M{"key": "retry", "value": "500"}}, false},
+		{"extra fields", bson.A{bson.M{"key": "http.status_code", "value": "500", "type": "string"}}, true},
+		{"no tags", nil, false},
+		{"empty tags", bson.A{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span := bson.M{"service": "order"}
+			if tt.tags != nil {
+				span["tags"] = tt.tags
+			}
+			if got := evalExpr(t, spanTagMatch(tag), span, nil); got != tt.want {
+				t.Errorf("spanTagMatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
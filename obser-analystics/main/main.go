@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
 	"syscall"
@@ -23,12 +24,22 @@ import (
 // @host			localhost:8585
 // @BasePath		/api
 func main() {
-	client, err := qmgo.NewClient(context.Background(), &qmgo.Config{Uri: config.MONGO_URI})
+	if err := config.Load(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *config.PrintConfig {
+		if err := config.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	client, err := qmgo.NewClient(context.Background(), &qmgo.Config{Uri: *config.MongoURI})
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println("Connected to MongoDB")
-	db := client.Database(config.MONGO_DATABASE)
+	db := client.Database(*config.MongoDatabase)
 
 	s := service.NewService(db)
 
@@ -36,6 +47,10 @@ func main() {
 	if err := s.InitElasticsearch(); err != nil {
 		fmt.Printf("Failed to initialize Elasticsearch: %v", err)
 	}
+	go s.StartAlertEvaluator(context.Background())
+	go s.StartNotifier(context.Background())
+	go s.StartSLOEvaluator(context.Background())
+
 	// Create a channel to receive OS signals
 	signalChan := make(chan os.Signal, 1)
 	// Notify the channel of specific signals
@@ -69,8 +84,9 @@ func main() {
 	v1 := r.Group("/api")
 	apiHandler := handler.NewHandler(s)
 	apiHandler.RegisterRoutes(v1)
+	apiHandler.RegisterJaegerRoutes(r.Group("/jaeger/api"))
 	r.GET("/swagger/*", echoSwagger.WrapHandler)
-	r.Logger.Fatal(r.Start("127.0.0.1:8585"))
+	r.Logger.Fatal(r.Start(*config.HttpAddr))
 
 	// Main process logic
 	fmt.Println("Application is running. Press Ctrl+C to exit.")
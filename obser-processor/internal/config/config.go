@@ -1,20 +1,40 @@
 package config
 
+import (
+	"errors"
+	"flag"
+	"time"
+)
+
 const (
 	// ProjectName is the name of the project
 	ProjectName = "obser-processor"
 
 	// ProjectVersion is the version of the project
 	ProjectVersion = "1.0.0"
+)
 
-	MONGO_URI  = "mongodb://mongo-db:27017"
-	TRACE_HOST = "localhost"
-
-	MONGO_DATABASE = "kltn"
-	INTERVAL       = 60 // second
-	LOOKBACK       = 60 // second
-	LIMIT          = 99999
-
-	TRACE_PORT = 9411
-	NATS_URL   = "nats://nats:4222"
+var (
+	MongoURI      = flag.String("mongo.uri", "mongodb://mongo-db:27017", "MongoDB connection string")
+	MongoDatabase = flag.String("mongo.database", "kltn", "MongoDB database name")
+	NatsURL       = flag.String("nats.url", "nats://nats:4222", "NATS server url")
+	Interval      = flag.Duration("statistic.interval", 60*time.Second, "Interval between statistic updates")
 )
+
+func init() {
+	Validate(func() error {
+		if *MongoURI == "" {
+			return errors.New("mongo.uri must not be empty")
+		}
+		if *MongoDatabase == "" {
+			return errors.New("mongo.database must not be empty")
+		}
+		if *NatsURL == "" {
+			return errors.New("nats.url must not be empty")
+		}
+		if *Interval <= 0 {
+			return errors.New("statistic.interval must be positive")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,181 @@
+// This file is kept identical in obser-processor and obser-analystics. The two binaries
+// are separate Go modules released on their own, and sharing the loader would take a
+// third module required through replace directives by both, so change both copies
+// together.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Every setting is a flag. Load resolves each one from, in increasing precedence:
+//
+//  1. the flag default
+//  2. the YAML file given by -config or OBSER_CONFIG, keys are flag names and may be
+//     nested, so "mongo: {uri: ...}" sets mongo.uri
+//  3. the environment variable named by EnvName, OBSER_MONGO_URI sets mongo.uri, or
+//     when it is unset the variable registered with LegacyEnv
+//  4. the command line
+//
+// -print-config writes the resolved settings in the config file format.
+
+// EnvPrefix prefixes the environment variables overriding flags
+const EnvPrefix = "OBSER_"
+
+var (
+	configFile  = flag.String("config", "", "Path to a YAML config file")
+	PrintConfig = flag.Bool("print-config", false, "Print the effective configuration and exit")
+)
+
+var (
+	validators []func() error
+	legacyEnv  = make(map[string]string)
+)
+
+// Validate registers a check run by Load once every source has been applied
+func Validate(check func() error) {
+	validators = append(validators, check)
+}
+
+// LegacyEnv makes the environment variable env set the flag name when its OBSER_
+// variable is unset, for variables read before settings were flags
+func LegacyEnv(name, env string) {
+	legacyEnv[name] = env
+}
+
+// EnvName returns the environment variable overriding the flag name
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// Load parses the command line, applies the config file and the environment to the
+// flags not set on the command line and validates the result
+func Load() error {
+	flag.Parse()
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(EnvName("config"))
+	}
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if flag.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown setting %q", path, name)
+			}
+			if explicit[name] {
+				continue
+			}
+			if err := flag.Set(name, values[name]); err != nil {
+				return fmt.Errorf("%s: %s: %w", path, name, err)
+			}
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+		env := EnvName(f.Name)
+		value, ok := os.LookupEnv(env)
+		if !ok && legacyEnv[f.Name] != "" {
+			env = legacyEnv[f.Name]
+			value, ok = os.LookupEnv(env)
+		}
+		if ok {
+			if e := flag.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("%s: %w", env, e)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, check := range validators {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Print writes the effective settings as YAML
+func Print(w io.Writer) error {
+	values := make(map[string]any)
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		var value any = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value = getter.Get()
+		}
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		values[f.Name] = value
+	})
+	enc := yaml.NewEncoder(w)
+	defer enc.Close()
+	return enc.Encode(values)
+}
+
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := make(map[string]string)
+	if err := flatten("", doc, values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// flatten joins nested keys with dots
+func flatten(prefix string, doc map[string]any, values map[string]string) error {
+	for key, value := range doc {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			if err := flatten(key, v, values); err != nil {
+				return err
+			}
+		case []any:
+			return fmt.Errorf("setting %q must be a scalar", key)
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
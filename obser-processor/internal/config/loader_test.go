@@ -0,0 +1,66 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadWith loads the given config file and command line arguments
+func loadWith(t *testing.T, file string, args ...string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Args
+	os.Args = append([]string{"processor", "-config", path}, args...)
+	defer func() { os.Args = saved }()
+	return Load()
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	t.Setenv(EnvName("mongo.database"), "env")
+	t.Setenv(EnvName("nats.url"), "nats://env:4222")
+	err := loadWith(t, "mongo:\n  uri: mongodb://file\n  database: file\nnats:\n  url: nats://file:4222\n", "-nats.url", "nats://flag:4222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"file over default", *MongoURI, "mongodb://file"},
+		{"env over file", *MongoDatabase, "env"},
+		{"flag over env", *NatsURL, "nats://flag:4222"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %q, want %q", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"unknown key", "mongo:\n  url: mongodb://typo\n", `unknown setting "mongo.url"`},
+		{"invalid value", "statistic:\n  interval: soon\n", "statistic.interval"},
+		{"failed validation", "statistic:\n  interval: -1s\n", "statistic.interval must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := loadWith(t, tt.file)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/processor/internal/config"
+	"kuroko.com/processor/internal/types"
+)
+
+var (
+	bulkSize     = flag.Int("bulk.size", 500, "Number of queued documents that triggers a bulk write")
+	bulkInterval = flag.Duration("bulk.interval", time.Second, "Maximum time documents wait before a bulk write")
+)
+
+func init() {
+	config.Validate(func() error {
+		if *bulkSize <= 0 {
+			return errors.New("bulk.size must be positive")
+		}
+		if *bulkInterval <= 0 {
+			return errors.New("bulk.interval must be positive")
+		}
+		return nil
+	})
+}
+
+var (
+	bulkFlushDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pipeline_bulk_flush_duration_seconds",
+			Help:    "Thời gian ghi một batch vào MongoDB",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+	bulkBatchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pipeline_bulk_batch_size",
+			Help:    "Số document trong một batch",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+	)
+)
+
+// BulkWriter accumulates the documents produced by trace processing and writes them
+// with one unordered bulk write per collection
+type BulkWriter struct {
+	// traces being queued hold inflight for reading so a flush never splits a trace
+	inflight   sync.RWMutex
+	mu         sync.Mutex
+	spans      map[string]*types.Span
+	pathEvents []*types.PathEvent
+	hopEvents  []*types.HopEvent
+	hops       map[string]*types.Hop
+	operations map[string]*types.Operation
+	// reconciled holds the events stored for traces rewritten in this batch
+	reconciled map[string]*reconciledTrace
+	callbacks  []func(error)
+	size       int
+}
+
+// reconciledTrace is a trace whose stored documents are replaced by the batch, the
+// documents it does not rewrite are removed and its old events taken back from the
+// rollups once the batch is written
+type reconciledTrace struct {
+	pathEvents []*types.PathEvent
+	hopEvents  []*types.HopEvent
+}
+
+// NewBulkWriter creates an empty bulk writer
+func NewBulkWriter() *BulkWriter {
+	w := &BulkWriter{}
+	w.reset()
+	return w
+}
+
+func (w *BulkWriter) reset() {
+	w.spans = make(map[string]*types.Span)
+	w.pathEvents = nil
+	w.hopEvents = nil
+	w.hops = make(map[string]*types.Hop)
+	w.operations = make(map[string]*types.Operation)
+	w.reconciled = make(map[string]*reconciledTrace)
+	w.callbacks = nil
+	w.size = 0
+}
+
+func (w *BulkWriter) AddSpan(span *types.Span) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.spans[span.ID] = span
+	w.size++
+}
+
+func (w *BulkWriter) AddPathEvent(pe *types.PathEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pathEvents = append(w.pathEvents, pe)
+	w.size++
+}
+
+func (w *BulkWriter) AddHopEvent(he *types.HopEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.hopEvents = append(w.hopEvents, he)
+	w.size++
+}
+
+// UpsertHop inserts the hop unless it already exists
+func (w *BulkWriter) UpsertHop(hop *types.Hop) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.hops[hop.ID]; !ok {
+		w.hops[hop.ID] = hop
+		w.size++
+	}
+}
+
+// UpsertOperation inserts the operation unless it already exists
+func (w *BulkWriter) UpsertOperation(op *types.Operation) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.operations[op.ID]; !ok {
+		w.operations[op.ID] = op
+		w.size++
+	}
+}
+
+// Reconcile marks a trace as rewritten by this batch, pathEvents and hopEvents are
+// the events already stored for it. Its documents still queued are dropped, the
+// rewrite replaces them
+func (w *BulkWriter) Reconcile(traceID string, pathEvents []*types.PathEvent, hopEvents []*types.HopEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for id, span := range w.spans {
+		if span.TraceID == traceID {
+			delete(w.spans, id)
+			w.size--
+		}
+	}
+	queuedPathEvents := w.pathEvents[:0]
+	for _, pe := range w.pathEvents {
+		if pe.TraceID != traceID {
+			queuedPathEvents = append(queuedPathEvents, pe)
+		}
+	}
+	queuedHopEvents := w.hopEvents[:0]
+	for _, he := range w.hopEvents {
+		if he.TraceID != traceID {
+			queuedHopEvents = append(queuedHopEvents, he)
+		}
+	}
+	w.size -= len(w.pathEvents) - len(queuedPathEvents) + len(w.hopEvents) - len(queuedHopEvents)
+	w.pathEvents, w.hopEvents = queuedPathEvents, queuedHopEvents
+	w.reconciled[traceID] = &reconciledTrace{pathEvents: pathEvents, hopEvents: hopEvents}
+	w.size++
+}
+
+// QueuedTrace returns the queued spans of a trace not flushed yet, sampledOut reports
+// whether the trace is queued as sampled out
+func (w *BulkWriter) QueuedTrace(traceID string) (spans []*types.Span, sampledOut bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, span := range w.spans {
+		if span.TraceID == traceID {
+			spans = append(spans, span)
+		}
+	}
+	for _, pe := range w.pathEvents {
+		if pe.TraceID == traceID && pe.SampledOut {
+			sampledOut = true
+		}
+	}
+	return spans, sampledOut
+}
+
+// Begin marks the start of queuing the writes of one trace, it must be followed by
+// End or Done
+func (w *BulkWriter) Begin() {
+	w.inflight.RLock()
+}
+
+// End finishes a trace that queued nothing
+func (w *BulkWriter) End() {
+	w.inflight.RUnlock()
+}
+
+// Done finishes a trace started with Begin and registers a callback run with the
+// result of the flush that writes it, the batch is flushed right away once full
+func (w *BulkWriter) Done(ctx context.Context, cb func(error)) {
+	w.mu.Lock()
+	w.callbacks = append(w.callbacks, cb)
+	full := w.size >= *bulkSize
+	w.mu.Unlock()
+	w.inflight.RUnlock()
+
+	if full {
+		w.Flush(ctx)
+	}
+}
+
+// Start flushes the writer every bulk.interval until the context is cancelled
+func (w *BulkWriter) Start(ctx context.Context) {
+	ticker := time.NewTicker(*bulkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Flush(context.Background())
+		case <-ctx.Done():
+			w.Flush(context.Background())
+			return
+		}
+	}
+}
+
+// Flush writes the queued documents and runs the registered callbacks
+func (w *BulkWriter) Flush(ctx context.Context) error {
+	w.inflight.Lock()
+	w.mu.Lock()
+	spans, pathEvents, hopEvents := w.spans, w.pathEvents, w.hopEvents
+	hops, operations, reconciled := w.hops, w.operations, w.reconciled
+	callbacks, size := w.callbacks, w.size
+	w.reset()
+	w.mu.Unlock()
+	w.inflight.Unlock()
+
+	if size == 0 && len(callbacks) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err := writeBulk(ctx, operationCollection, len(operations), func(b *qmgo.Bulk) {
+		for id, op := range operations {
+			b.UpsertOne(bson.M{"_id": id}, bson.M{"$setOnInsert": op})
+		}
+	})
+	if err == nil {
+		err = writeBulk(ctx, hopCollection, len(hops), func(b *qmgo.Bulk) {
+			for id, hop := range hops {
+				b.UpsertOne(bson.M{"_id": id}, bson.M{"$setOnInsert": hop})
+			}
+		})
+	}
+	// events have ids derived from the trace and are replaced, so a batch redelivered
+	// after a failed flush rewrites what was already written instead of duplicating it.
+	// The path event goes after the hop events since it marks a sampled out trace as
+	// stored
+	if err == nil {
+		err = writeBulk(ctx, hopEventCollection, len(hopEvents), func(b *qmgo.Bulk) {
+			for _, he := range hopEvents {
+				b.UpsertId(he.ID, he)
+			}
+		})
+	}
+	if err == nil {
+		err = writeBulk(ctx, pathEventCollection, len(pathEvents), func(b *qmgo.Bulk) {
+			for _, pe := range pathEvents {
+				b.UpsertId(pe.ID, pe)
+			}
+		})
+	}
+	if err == nil {
+		// spans are replaced so that a redelivered trace does not fail on duplicate ids
+		err = writeBulk(ctx, spanCollection, len(spans), func(b *qmgo.Bulk) {
+			for id, span := range spans {
+				b.UpsertId(id, span)
+			}
+		})
+	}
+	if err == nil {
+		err = removeStale(ctx, reconciled, spans, pathEvents, hopEvents)
+	}
+	if err == nil {
+		for _, r := range reconciled {
+			for _, pe := range r.pathEvents {
+				rollupWriter.AddPathEvent(pe, -1)
+			}
+			for _, he := range r.hopEvents {
+				rollupWriter.AddHopEvent(he, -1)
+			}
+		}
+		for _, pe := range pathEvents {
+			rollupWriter.AddPathEvent(pe, 1)
+		}
+		for _, he := range hopEvents {
+			rollupWriter.AddHopEvent(he, 1)
+		}
+	}
+	bulkFlushDuration.Observe(time.Since(start).Seconds())
+	bulkBatchSize.Observe(float64(size))
+	if err != nil {
+		log.Printf("Failed to flush %d documents: %v", size, err)
+	}
+
+	for _, cb := range callbacks {
+		cb(err)
+	}
+	return err
+}
+
+// removeStale deletes the stored documents of the reconciled traces that the batch
+// did not rewrite, it runs after the rewrite so a failed flush loses nothing
+func removeStale(ctx context.Context, reconciled map[string]*reconciledTrace, spans map[string]*types.Span, pathEvents []*types.PathEvent, hopEvents []*types.HopEvent) error {
+	if len(reconciled) == 0 {
+		return nil
+	}
+	spanIds, pathEventIds, hopEventIds := rewrittenIds(reconciled, spans, pathEvents, hopEvents)
+	for _, stale := range []struct {
+		coll *qmgo.Collection
+		ids  map[string][]string
+	}{{spanCollection, spanIds}, {pathEventCollection, pathEventIds}, {hopEventCollection, hopEventIds}} {
+		err := writeBulk(ctx, stale.coll, len(reconciled), func(b *qmgo.Bulk) {
+			for traceID := range reconciled {
+				b.RemoveAll(bson.M{"trace_id": traceID, "_id": bson.M{"$nin": stale.ids[traceID]}})
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrittenIds returns the ids of the spans, path events and hop events the batch
+// writes for each reconciled trace, every reconciled trace has a possibly empty list
+func rewrittenIds(reconciled map[string]*reconciledTrace, spans map[string]*types.Span, pathEvents []*types.PathEvent, hopEvents []*types.HopEvent) (spanIds, pathEventIds, hopEventIds map[string][]string) {
+	keep := func(ids map[string][]string, traceID, id string) {
+		if _, ok := reconciled[traceID]; ok {
+			ids[traceID] = append(ids[traceID], id)
+		}
+	}
+	spanIds, pathEventIds, hopEventIds = make(map[string][]string), make(map[string][]string), make(map[string][]string)
+	for traceID := range reconciled {
+		// $nin needs an array even when nothing is rewritten
+		spanIds[traceID], pathEventIds[traceID], hopEventIds[traceID] = []string{}, []string{}, []string{}
+	}
+	for id, span := range spans {
+		keep(spanIds, span.TraceID, id)
+	}
+	for _, pe := range pathEvents {
+		keep(pathEventIds, pe.TraceID, pe.ID)
+	}
+	for _, he := range hopEvents {
+		keep(hopEventIds, he.TraceID, he.ID)
+	}
+	return spanIds, pathEventIds, hopEventIds
+}
+
+func writeBulk(ctx context.Context, coll *qmgo.Collection, n int, fill func(*qmgo.Bulk)) error {
+	if n == 0 {
+		return nil
+	}
+	b := coll.Bulk().SetOrdered(false)
+	fill(b)
+	_, err := b.Run(ctx)
+	return err
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"kuroko.com/processor/internal/types"
+)
+
+func TestReconcileDropsQueuedDocumentsOfTheTrace(t *testing.T) {
+	w := NewBulkWriter()
+	for _, traceID := range []string{"t1", "t2"} {
+		w.AddSpan(&types.Span{ID: traceID + "-s1", TraceID: traceID})
+		w.AddSpan(&types.Span{ID: traceID + "-s2", TraceID: traceID})
+		w.AddPathEvent(&types.PathEvent{ID: traceID + "-pe", TraceID: traceID})
+		w.AddHopEvent(&types.HopEvent{ID: traceID + "-he", TraceID: traceID})
+	}
+	w.UpsertHop(&types.Hop{ID: "hop"})
+
+	stored := []*types.PathEvent{{ID: "t1-old", TraceID: "t1"}}
+	w.Reconcile("t1", stored, nil)
+
+	if spans, _ := w.QueuedTrace("t1"); len(spans) != 0 {
+		t.Errorf("t1 still has %d queued spans", len(spans))
+	}
+	if spans, _ := w.QueuedTrace("t2"); len(spans) != 2 {
+		t.Errorf("t2 has %d queued spans, want 2", len(spans))
+	}
+	if len(w.pathEvents) != 1 || w.pathEvents[0].TraceID != "t2" {
+		t.Errorf("queued path events %v, want only t2", w.pathEvents)
+	}
+	if len(w.hopEvents) != 1 || w.hopEvents[0].TraceID != "t2" {
+		t.Errorf("queued hop events %v, want only t2", w.hopEvents)
+	}
+	if r := w.reconciled["t1"]; r == nil || !reflect.DeepEqual(r.pathEvents, stored) {
+		t.Errorf("reconciled t1 = %v, want its stored path events", r)
+	}
+	// the t2 documents, the hop and the removal of the stale t1 documents
+	if w.size != 6 {
+		t.Errorf("size = %d, want 6", w.size)
+	}
+
+	// the rewrite of t1 is queued after the reconcile and kept
+	w.AddSpan(&types.Span{ID: "t1-s3", TraceID: "t1"})
+	if spans, _ := w.QueuedTrace("t1"); len(spans) != 1 || spans[0].ID != "t1-s3" {
+		t.Errorf("t1 queued spans %v, want the rewritten one", spans)
+	}
+	if w.size != 7 {
+		t.Errorf("size = %d, want 7", w.size)
+	}
+}
+
+func TestRewrittenIds(t *testing.T) {
+	reconciled := map[string]*reconciledTrace{"t1": {}, "t2": {}}
+	spans := map[string]*types.Span{
+		"a": {ID: "a", TraceID: "t1"},
+		"b": {ID: "b", TraceID: "t1"},
+		"c": {ID: "c", TraceID: "t3"},
+	}
+	pathEvents := []*types.PathEvent{{ID: "pe1", TraceID: "t1"}, {ID: "pe3", TraceID: "t3"}}
+	hopEvents := []*types.HopEvent{{ID: "he2", TraceID: "t2"}, {ID: "he3", TraceID: "t3"}}
+
+	spanIds, pathEventIds, hopEventIds := rewrittenIds(reconciled, spans, pathEvents, hopEvents)
+	sort.Strings(spanIds["t1"])
+
+	tests := []struct {
+		name string
+		got  map[string][]string
+		want map[string][]string
+	}{
+		// t2 rewrote no span, its stored spans are all stale
+		{"spans", spanIds, map[string][]string{"t1": {"a", "b"}, "t2": {}}},
+		{"path events", pathEventIds, map[string][]string{"t1": {"pe1"}, "t2": {}}},
+		{"hop events", hopEventIds, map[string][]string{"t1": {}, "t2": {"he2"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("rewrittenIds() = %v, want %v", tt.got, tt.want)
+			}
+			// $nin rejects a null array
+			for traceID, ids := range tt.got {
+				if ids == nil {
+					t.Errorf("trace %s has nil ids", traceID)
+				}
+			}
+		})
+	}
+}
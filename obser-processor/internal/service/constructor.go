@@ -3,19 +3,32 @@ package service
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"math"
 
 	"kuroko.com/processor/internal/types"
 )
 
-func (s *Service) ConvertTraceToGraph(ctx context.Context, trace []*types.SpanResponse) (*types.GraphNode, error) {
+// ErrBrokenTrace is returned when a span references a parent that is not part of the
+// trace, or when the trace has several root spans
+var ErrBrokenTrace = errors.New("broken trace")
+
+var repairTrace = flag.Bool("trace.repair", false, "Attach orphan spans under a synthetic missing parent instead of dropping broken traces")
+
+// missingParentName is the operation and service of synthetic nodes created by repair mode
+const missingParentName = "missing parent"
+
+// ConvertTraceToGraph builds the span tree of a trace, it also returns how many spans
+// had to be attached to a synthetic missing parent in repair mode
+func (s *Service) ConvertTraceToGraph(ctx context.Context, trace []*types.SpanResponse) (*types.GraphNode, int, error) {
 	if len(trace) == 0 {
-		return nil, nil
+		return nil, 0, nil
 	}
 
 	// Create a map to store nodes by their span ID
 	nodeMap := make(map[string]*types.GraphNode, len(trace))
-	var root *types.GraphNode
+	var roots []*types.GraphNode
 
 	// First pass: create all nodes
 	for _, span := range trace {
@@ -30,25 +43,105 @@ func (s *Service) ConvertTraceToGraph(ctx context.Context, trace []*types.SpanRe
 			node.Span = span
 		}
 
-		// Identify the root node (no parent)
+		// Identify the root nodes (no parent)
 		if span.ParentID == "" {
-			root = node
+			roots = append(roots, node)
 		}
 	}
 
 	// Second pass: build the tree structure
+	missing := make(map[string]*types.GraphNode)
+	var missingOrder []*types.GraphNode
+	orphans := 0
 	for _, span := range trace {
 		if span.ParentID != "" {
 			parent, exists := nodeMap[span.ParentID]
 			if !exists {
 				// broken trace if a parent doesn't exist, not process it
-				return nil, errors.New("broken trace")
+				if !*repairTrace {
+					return nil, 0, ErrBrokenTrace
+				}
+				parent, exists = missing[span.ParentID]
+				if !exists {
+					parent = newMissingParent(span.TraceID, span.ParentID)
+					missing[span.ParentID] = parent
+					missingOrder = append(missingOrder, parent)
+				}
+				orphans++
 			}
 			parent.Children = append(parent.Children, nodeMap[span.ID])
 		}
 	}
 
-	return root, nil
+	if !*repairTrace {
+		// without repair a trace needs exactly one root, picking one of several would
+		// drop the others
+		if len(roots) != 1 {
+			return nil, 0, ErrBrokenTrace
+		}
+		return roots[0], 0, nil
+	}
+
+	for _, node := range missingOrder {
+		fitMissingParent(node)
+	}
+	// a single real root adopts the missing parents, otherwise every fragment
+	// hangs under one synthetic root
+	var root *types.GraphNode
+	switch {
+	case len(roots) == 1:
+		root = roots[0]
+		root.Children = append(root.Children, missingOrder...)
+	case len(roots)+len(missingOrder) == 0:
+		return nil, 0, ErrBrokenTrace
+	case len(roots) == 0 && len(missingOrder) == 1:
+		root = missingOrder[0]
+	default:
+		root = newMissingParent(trace[0].TraceID, syntheticRootID(trace[0].TraceID))
+		root.Children = append(root.Children, roots...)
+		root.Children = append(root.Children, missingOrder...)
+		fitMissingParent(root)
+		if len(roots) > 1 {
+			orphans += len(roots) - 1
+		}
+	}
+	return root, orphans, nil
+}
+
+// syntheticRootID is the span id of the synthetic root of a trace with several
+// fragments, the same trace always gets the same id
+func syntheticRootID(traceID string) string {
+	return fmt.Sprintf("%016x", HashCode64("root:"+traceID))
+}
+
+func newMissingParent(traceID, spanID string) *types.GraphNode {
+	return &types.GraphNode{
+		Span: &types.SpanResponse{
+			TraceID: traceID,
+			ID:      spanID,
+			Name:    missingParentName,
+			LocalEndpoint: types.SpanEndpoint{
+				ServiceName: missingParentName,
+			},
+		},
+		Children: []*types.GraphNode{},
+	}
+}
+
+// fitMissingParent spans a synthetic node over the time range of its children
+func fitMissingParent(node *types.GraphNode) {
+	var start, end int64
+	for i, child := range node.Children {
+		childEnd := child.Span.Timestamp + int64(child.Span.Duration)
+		if i == 0 || child.Span.Timestamp < start {
+			start = child.Span.Timestamp
+		}
+		if childEnd > end {
+			end = childEnd
+		}
+	}
+	node.Span.Timestamp = start
+	node.Span.Duration = int(end - start)
 }
 
 func (s *Service) caculateLongestChain(ctx context.Context, root *types.GraphNode) int {
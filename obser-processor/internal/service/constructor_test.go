@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"kuroko.com/processor/internal/types"
+)
+
+func testSr(id, parentID string, timestamp int64, duration int) *types.SpanResponse {
+	return &types.SpanResponse{TraceID: "t", ID: id, ParentID: parentID, Name: id, Timestamp: timestamp, Duration: duration}
+}
+
+func TestConvertTraceToGraph(t *testing.T) {
+	defer func(repair bool) { *repairTrace = repair }(*repairTrace)
+
+	tests := []struct {
+		name    string
+		repair  bool
+		trace   []*types.SpanResponse
+		wantErr error
+		// root is the name of the root span, children its children in order
+		root     string
+		children []string
+		orphans  int
+	}{
+		{
+			name:     "complete trace",
+			trace:    []*types.SpanResponse{testSr("a", "", 0, 10), testSr("b", "a", 1, 5)},
+			root:     "a",
+			children: []string{"b"},
+		},
+		{
+			name:    "missing parent without repair",
+			trace:   []*types.SpanResponse{testSr("a", "", 0, 10), testSr("c", "x", 2, 3)},
+			wantErr: ErrBrokenTrace,
+		},
+		{
+			name:    "several roots without repair",
+			trace:   []*types.SpanResponse{testSr("a", "", 0, 10), testSr("d", "", 20, 5)},
+			wantErr: ErrBrokenTrace,
+		},
+		{
+			name:     "missing parent hangs under the root",
+			repair:   true,
+			trace:    []*types.SpanResponse{testSr("a", "", 0, 10), testSr("b", "a", 1, 5), testSr("c", "x", 2, 3)},
+			root:     "a",
+			children: []string{"b", missingParentName},
+			orphans:  1,
+		},
+		{
+			name:     "no root, one missing parent becomes the root",
+			repair:   true,
+			trace:    []*types.SpanResponse{testSr("b", "x", 4, 2), testSr("c", "x", 1, 2)},
+			root:     missingParentName,
+			children: []string{"b", "c"},
+			orphans:  2,
+		},
+		{
+			name:     "several fragments hang under a synthetic root",
+			repair:   true,
+			trace:    []*types.SpanResponse{testSr("a", "", 0, 10), testSr("d", "", 20, 5), testSr("c", "x", 2, 3)},
+			root:     missingParentName,
+			children: []string{"a", "d", missingParentName},
+			orphans:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*repairTrace = tt.repair
+			root, orphans, err := (&Service{}).ConvertTraceToGraph(context.Background(), tt.trace)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if root.Span.Name != tt.root || orphans != tt.orphans {
+				t.Errorf("got root %q with %d orphans, want %q with %d", root.Span.Name, orphans, tt.root, tt.orphans)
+			}
+			var children []string
+			for _, child := range root.Children {
+				children = append(children, child.Span.Name)
+			}
+			if len(children) != len(tt.children) {
+				t.Fatalf("children = %v, want %v", children, tt.children)
+			}
+			for i := range children {
+				if children[i] != tt.children[i] {
+					t.Errorf("children = %v, want %v", children, tt.children)
+				}
+			}
+			if root.Span.ID == "" {
+				t.Error("root has no span id")
+			}
+			if root.Span.Name == missingParentName {
+				// a synthetic root spans the time range of its children
+				var end int64
+				for _, span := range tt.trace {
+					end = max(end, span.Timestamp+int64(span.Duration))
+				}
+				if root.Span.Timestamp+int64(root.Span.Duration) != end {
+					t.Errorf("synthetic root ends at %d, want %d", root.Span.Timestamp+int64(root.Span.Duration), end)
+				}
+			}
+		})
+	}
+}
@@ -2,14 +2,13 @@ package service
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
+	"sort"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -28,49 +27,211 @@ var (
 
 // TraceStore stores spans by trace ID
 type TraceStore struct {
-	mu     sync.RWMutex
-	traces map[string][]*tracepb.Span
-	times  map[string]time.Time
+	mu       sync.RWMutex
+	traces   map[string][]*tracepb.Span
+	times    map[string]time.Time
+	acks     map[string][]*pendingAck
+	attempts map[string]int
+	backend  SpanBackend
+
+	spanCount int
+	maxSpans  int
 }
 
-// NewTraceStore creates a new trace store
-func NewTraceStore() *TraceStore {
+// BufferedTrace holds the spans of a trace together with the messages waiting for it to be persisted
+type BufferedTrace struct {
+	Spans    []*tracepb.Span
+	acks     []*pendingAck
+	attempts int // failed attempts at processing the trace
+}
+
+// Done settles every message that carried spans of the trace
+func (bt *BufferedTrace) Done(err error) {
+	for _, ack := range bt.acks {
+		ack.done(err)
+	}
+}
+
+// NewTraceStore creates a new trace store holding at most maxSpans spans, 0 means unbounded
+func NewTraceStore(backend SpanBackend, maxSpans int) *TraceStore {
 	return &TraceStore{
-		traces: make(map[string][]*tracepb.Span),
-		times:  make(map[string]time.Time),
+		traces:   make(map[string][]*tracepb.Span),
+		times:    make(map[string]time.Time),
+		acks:     make(map[string][]*pendingAck),
+		attempts: make(map[string]int),
+		backend:  backend,
+		maxSpans: maxSpans,
 	}
 }
 
-// AddSpan adds a span to the store
-func (ts *TraceStore) AddSpan(span *tracepb.Span) {
-	traceID := fmt.Sprintf("%x", span.TraceId)
+// SpanCount returns the number of buffered spans
+func (ts *TraceStore) SpanCount() int {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.spanCount
+}
+
+// Full reports whether the span budget is used up once pending more spans are added
+func (ts *TraceStore) Full(pending int) bool {
+	return ts.maxSpans > 0 && ts.SpanCount()+pending >= ts.maxSpans
+}
+
+// Durable reports whether buffered spans survive a restart
+func (ts *TraceStore) Durable() bool {
+	return ts.backend.Durable()
+}
+
+// AddSpans saves the spans of a message to the backend in one write and adds them to
+// the store
+func (ts *TraceStore) AddSpans(ctx context.Context, spans []*tracepb.Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	if err := ts.backend.Save(ctx, spans); err != nil {
+		return err
+	}
 
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
+	now := time.Now()
+	for _, span := range spans {
+		traceID := fmt.Sprintf("%x", span.TraceId)
+		ts.times[traceID] = now
+		ts.add(traceID, span)
+	}
+	return nil
+}
+
+// add appends a span to its trace unless a redelivered message already brought it,
+// ts.mu must be held
+func (ts *TraceStore) add(traceID string, span *tracepb.Span) {
+	for _, existing := range ts.traces[traceID] {
+		if string(existing.SpanId) == string(span.SpanId) {
+			return
+		}
+	}
 	ts.traces[traceID] = append(ts.traces[traceID], span)
+	ts.spanCount++
+	bufferedSpanCount.Set(float64(ts.spanCount))
+}
+
+// AddAck registers a message to be settled when the trace is processed
+func (ts *TraceStore) AddAck(traceID string, ack *pendingAck) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.acks[traceID] = append(ts.acks[traceID], ack)
+}
+
+// Restore reloads the spans left in the backend by a previous run
+func (ts *TraceStore) Restore(ctx context.Context) (int, error) {
+	traces, err := ts.backend.Load(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	now := time.Now()
+	for traceID, spans := range traces {
+		for _, span := range spans {
+			ts.add(traceID, span)
+		}
+		ts.times[traceID] = now
+	}
+	return len(traces), nil
+}
+
+// Retry puts back a trace that failed to be processed, it expires again after
+// buffer.time. It returns false once the trace failed buffer.max-attempts times, it
+// then stays in the backend until the next start. Only a durable backend retries,
+// otherwise the messages of the trace are redelivered
+func (ts *TraceStore) Retry(traceID string, trace *BufferedTrace) bool {
+	if !ts.backend.Durable() || trace.attempts+1 >= *bufferAttempts {
+		return false
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	// spans that arrived meanwhile are kept, the retried ones are deduplicated
+	for _, span := range trace.Spans {
+		ts.add(traceID, span)
+	}
 	ts.times[traceID] = time.Now()
+	ts.acks[traceID] = append(ts.acks[traceID], trace.acks...)
+	ts.attempts[traceID] = max(ts.attempts[traceID], trace.attempts+1)
+	return true
+}
+
+// Release removes a processed trace from the backend
+func (ts *TraceStore) Release(ctx context.Context, traceID string) error {
+	return ts.backend.Delete(ctx, traceID)
 }
 
 // GetExpiredTraces returns traces that have not been updated for the given duration
-func (ts *TraceStore) GetExpiredTraces(d time.Duration) map[string][]*tracepb.Span {
+func (ts *TraceStore) GetExpiredTraces(d time.Duration) map[string]*BufferedTrace {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
-	expired := make(map[string][]*tracepb.Span)
+	expired := make(map[string]*BufferedTrace)
 	now := time.Now()
 
 	for traceID, lastUpdate := range ts.times {
 		if now.Sub(lastUpdate) > d {
-			expired[traceID] = ts.traces[traceID]
-			delete(ts.traces, traceID)
-			delete(ts.times, traceID)
+			expired[traceID] = ts.take(traceID)
 		}
 	}
 
 	return expired
 }
 
+// Spill takes the least recently updated traces until the store is back under 90%
+// of its span budget
+func (ts *TraceStore) Spill() map[string]*BufferedTrace {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	spilled := make(map[string]*BufferedTrace)
+	if ts.maxSpans <= 0 || ts.spanCount < ts.maxSpans {
+		return spilled
+	}
+
+	traceIDs := make([]string, 0, len(ts.times))
+	for traceID := range ts.times {
+		traceIDs = append(traceIDs, traceID)
+	}
+	sort.Slice(traceIDs, func(i, j int) bool {
+		return ts.times[traceIDs[i]].Before(ts.times[traceIDs[j]])
+	})
+	target := ts.maxSpans * 9 / 10
+	for _, traceID := range traceIDs {
+		if ts.spanCount <= target {
+			break
+		}
+		spilled[traceID] = ts.take(traceID)
+	}
+	return spilled
+}
+
+// take removes a trace from the store, the caller holds the lock
+func (ts *TraceStore) take(traceID string) *BufferedTrace {
+	trace := &BufferedTrace{
+		Spans:    ts.traces[traceID],
+		acks:     ts.acks[traceID],
+		attempts: ts.attempts[traceID],
+	}
+	ts.spanCount -= len(trace.Spans)
+	bufferedSpanCount.Set(float64(ts.spanCount))
+	delete(ts.traces, traceID)
+	delete(ts.times, traceID)
+	delete(ts.acks, traceID)
+	delete(ts.attempts, traceID)
+	return trace
+}
+
 // ConvertSpanToDocument converts a span to an Elasticsearch document
 func convertSpanToSpanResponse(span *tracepb.Span) *types.SpanResponse {
 	traceID := fmt.Sprintf("%x", span.TraceId)
@@ -142,9 +303,11 @@ func convertSpanToSpanResponse(span *tracepb.Span) *types.SpanResponse {
 		LocalEndpoint: types.SpanEndpoint{
 			ServiceName: attributes["service.name"].(string),
 		},
-		Tags:   convertAttrributes(attributes),
-		Events: events,
-		Links:  links,
+		Tags:          convertAttrributes(attributes),
+		Events:        events,
+		Links:         links,
+		StatusCode:    span.GetStatus().GetCode().String(),
+		StatusMessage: span.GetStatus().GetMessage(),
 	}
 }
 func convertAttrributes(attributes map[string]any) map[string]string {
@@ -188,27 +351,52 @@ func convertAnyValue(value *v1.AnyValue) any {
 	}
 }
 
-func (s *Service) StartProcessTrace(nc *nats.Conn) {
-	flag.Parse()
+func (s *Service) StartProcessTrace(ctx context.Context, js nats.JetStreamContext) {
+	backend, err := NewSpanBackend(*bufferBackend)
+	if err != nil {
+		log.Fatalf("Failed to create span buffer: %v", err)
+	}
 
 	// Create trace store
-	store := NewTraceStore()
+	store := NewTraceStore(backend, *maxBufferSpans)
+	restored, err := store.Restore(ctx)
+	if err != nil {
+		log.Fatalf("Failed to restore buffered spans: %v", err)
+	}
+	if restored > 0 {
+		log.Printf("Restored %d buffered traces from %s", restored, *bufferBackend)
+	}
+
+	// Subscribe to the durable consumer, messages are acked once their traces are stored
+	sub, err := pullSubscribe(js, *traceStream, *natsSubj, *traceConsumer)
+	if err != nil {
+		log.Fatalf("Failed to subscribe to NATS: %v", err)
+	}
+	if !store.Durable() && *ackWait <= 2**bufferTime {
+		log.Printf("Warning: js.ack-wait %s should be longer than twice buffer.time %s", *ackWait, *bufferTime)
+	}
+
+	workers := s.NewTraceWorkers(store, *workerCount, *workerQueue)
 
-	// Subscribe to NATS subject
-	sub, err := nc.Subscribe(*natsSubj, func(msg *nats.Msg) {
+	handleMsg := func(msg *nats.Msg) {
 		// Unmarshal protobuf message
 		var tracesData tracepb.TracesData
 		if err := proto.Unmarshal(msg.Data, &tracesData); err != nil {
 			log.Printf("Failed to unmarshal message: %v", err)
+			settle(js, msg, fmt.Errorf("%w: %v", errPoisonMessage, err))
 			return
 		}
 		msgCount.Add(float64(len(tracesData.ResourceSpans)))
 
+		traceIDs := make(map[string]bool)
+		dropping := *overflowPolicy == "drop"
+		var spans []*tracepb.Span
+
 		// Process spans
 		for _, rs := range tracesData.ResourceSpans {
 			// Extract service name from resource
 			serviceName := "unknown"
-			for _, attr := range rs.Resource.Attributes {
+			for _, attr := range rs.GetResource().GetAttributes() {
 				if attr.Key == "service.name" {
 					if sv := attr.Value.GetStringValue(); sv != "" {
 						serviceName = sv
@@ -230,43 +418,59 @@ func (s *Service) StartProcessTrace(nc *nats.Conn) {
 							},
 						},
 					)
-					store.AddSpan(span)
+					if dropping && store.Full(len(spans)) {
+						droppedSpanCount.Inc()
+						continue
+					}
+					spans = append(spans, span)
+					traceIDs[fmt.Sprintf("%x", span.TraceId)] = true
 				}
 			}
 		}
-	})
-	if err != nil {
-		log.Fatalf("Failed to subscribe to NATS: %v", err)
+		if err := store.AddSpans(ctx, spans); err != nil {
+			settle(js, msg, err)
+			return
+		}
+
+		// a durable backend already holds the spans, otherwise wait for the traces to be stored
+		if len(traceIDs) == 0 || store.Durable() {
+			settle(js, msg, nil)
+		} else {
+			ack := newPendingAck(js, msg, len(traceIDs))
+			for traceID := range traceIDs {
+				store.AddAck(traceID, ack)
+			}
+		}
+
+		// over budget the oldest traces go to the workers early, a full queue blocks
+		// fetching until they catch up
+		if !dropping && store.Full(0) {
+			workers.Enqueue(ctx, store.Spill())
+		}
 	}
-	defer sub.Unsubscribe()
 
 	// Start background processor
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	consumeCtx, stopConsume := context.WithCancel(ctx)
+	defer stopConsume()
+
+	consumeDone := make(chan struct{})
+	go func() {
+		defer close(consumeDone)
+		consume(consumeCtx, sub, handleMsg)
+	}()
+	go bulkWriter.Start(consumeCtx)
 
+	processorDone := make(chan struct{})
 	go func() {
+		defer close(processorDone)
 		ticker := time.NewTicker(*bufferTime)
 		defer ticker.Stop()
 
 		for {
 			select {
 			case <-ticker.C:
-				// Get expired traces
-				expiredTraces := store.GetExpiredTraces(*bufferTime)
-
-				// Process each trace
-				for traceID, _spans := range expiredTraces {
-					log.Printf("Processing trace %s with %d spans", traceID, len(_spans))
-					spans := make([]*types.SpanResponse, 0, len(_spans))
-					for _, _span := range _spans {
-						span := convertSpanToSpanResponse(_span)
-						spans = append(spans, span)
-					}
-					if err := s.ProcessTrace(ctx, spans); err != nil {
-						log.Printf("Failed to process trace %s: %v", traceID, err)
-					}
-
-				}
+				// Get expired traces and hand them to the workers
+				workers.Enqueue(ctx, store.GetExpiredTraces(*bufferTime))
 			case <-ctx.Done():
 				return
 			}
@@ -274,15 +478,23 @@ func (s *Service) StartProcessTrace(nc *nats.Conn) {
 	}()
 
 	// Expose HTTP server để Prometheus scrape
-	http.Handle("/metrics", promhttp.Handler())
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.Handler())
 	go func() {
 		fmt.Println("Serving metrics at :2112/metrics")
-		http.ListenAndServe(":2112", nil)
+		http.ListenAndServe(":2112", metricsMux)
 	}()
 
+	// OTLP and Zipkin exports are republished on the span subject, the ingest
+	// endpoints get their own mux so they are not served on the metrics port
+	ingestMux := http.NewServeMux()
+	otlpServer := s.StartOTLPReceivers(js, ingestMux)
+	zipkinServer := s.StartZipkinReceiver(js)
+
 	// Start HTTP server
 	server := &http.Server{
-		Addr: *httpAddr,
+		Addr:    *httpAddr,
+		Handler: ingestMux,
 	}
 
 	go func() {
@@ -291,10 +503,8 @@ func (s *Service) StartProcessTrace(nc *nats.Conn) {
 		}
 	}()
 
-	// Wait for signal to shutdown
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	// Wait for shutdown
+	<-ctx.Done()
 
 	// Graceful shutdown
 	log.Println("Shutting down...")
@@ -306,14 +516,91 @@ func (s *Service) StartProcessTrace(nc *nats.Conn) {
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Printf("HTTP server shutdown error: %v", err)
 	}
+	if otlpServer != nil {
+		otlpServer.GracefulStop()
+	}
+	if zipkinServer != nil {
+		if err := zipkinServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Zipkin receiver shutdown error: %v", err)
+		}
+	}
+
+	// Stop pulling and wait for the ticker loop and workers before flushing what is left
+	stopConsume()
+	<-consumeDone
+	<-processorDone
+	workers.Close()
 
 	// Process remaining traces
 	expiredTraces := store.GetExpiredTraces(0)
 
 	// Process each trace
-	for traceID, spans := range expiredTraces {
-		log.Printf("Processing remaining trace %s with %d spans", traceID, len(spans))
+	for traceID, trace := range expiredTraces {
+		s.flushTrace(context.Background(), store, traceID, trace)
 	}
+	bulkWriter.Flush(context.Background())
 
 	log.Println("Shutdown complete")
 }
+
+// flushTrace processes a buffered trace, its messages are settled and it is released
+// from the backend once the bulk write holding it completes
+func (s *Service) flushTrace(ctx context.Context, store *TraceStore, traceID string, trace *BufferedTrace) {
+	log.Printf("Processing trace %s with %d spans", traceID, len(trace.Spans))
+	spans := make([]*types.SpanResponse, 0, len(trace.Spans))
+	for _, _span := range trace.Spans {
+		span := convertSpanToSpanResponse(_span)
+		spans = append(spans, span)
+	}
+	bulkWriter.Begin()
+	err := s.ProcessTrace(ctx, spans)
+	if errors.Is(err, errSampledOut) {
+		bulkWriter.End()
+		sampledCount.WithLabelValues("dropped", "late").Inc()
+		trace.Done(nil)
+		s.releaseTrace(ctx, store, traceID)
+		return
+	}
+	if err != nil {
+		bulkWriter.End()
+		log.Printf("Failed to process trace %s: %v", traceID, err)
+		if !errors.Is(err, ErrBrokenTrace) {
+			s.retryTrace(store, traceID, trace, err)
+			return
+		}
+		// redelivery cannot repair a broken trace
+		trace.Done(nil)
+		s.releaseTrace(ctx, store, traceID)
+		return
+	}
+
+	bulkWriter.Done(ctx, func(err error) {
+		if err != nil {
+			s.retryTrace(store, traceID, trace, err)
+			return
+		}
+		trace.Done(nil)
+		s.releaseTrace(ctx, store, traceID)
+	})
+}
+
+// retryTrace puts a failed trace back in a durable store, otherwise its messages are
+// nacked and redelivered
+func (s *Service) retryTrace(store *TraceStore, traceID string, trace *BufferedTrace, err error) {
+	if store.Retry(traceID, trace) {
+		bufferRetryCount.WithLabelValues("retried").Inc()
+		return
+	}
+	if store.Durable() {
+		// left in the backend, it is loaded again on the next start
+		bufferRetryCount.WithLabelValues("given_up").Inc()
+		log.Printf("Giving up on trace %s after %d attempts, it stays buffered until restart", traceID, trace.attempts+1)
+	}
+	trace.Done(err)
+}
+
+func (s *Service) releaseTrace(ctx context.Context, store *TraceStore, traceID string) {
+	if err := store.Release(ctx, traceID); err != nil {
+		log.Printf("Failed to release trace %s: %v", traceID, err)
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// loadedBackend is a memory backend that restores fixed spans
+type loadedBackend struct {
+	memoryBackend
+	spans map[string][]*tracepb.Span
+}
+
+func (b loadedBackend) Load(ctx context.Context) (map[string][]*tracepb.Span, error) {
+	return b.spans, nil
+}
+
+func testSpan(traceID, spanID byte) *tracepb.Span {
+	return &tracepb.Span{
+		TraceId: []byte{15: traceID},
+		SpanId:  []byte{7: spanID},
+	}
+}
+
+func TestTraceStoreDeduplicatesSpans(t *testing.T) {
+	tests := []struct {
+		name     string
+		restored []*tracepb.Span
+		messages [][]*tracepb.Span
+		want     int
+	}{
+		{
+			name:     "redelivered message",
+			messages: [][]*tracepb.Span{{testSpan(1, 1), testSpan(1, 2)}, {testSpan(1, 1), testSpan(1, 2)}},
+			want:     2,
+		},
+		{
+			name:     "duplicates in one message",
+			messages: [][]*tracepb.Span{{testSpan(1, 1), testSpan(1, 1), testSpan(2, 1)}},
+			want:     2,
+		},
+		{
+			name:     "restored spans redelivered",
+			restored: []*tracepb.Span{testSpan(1, 1), testSpan(1, 1)},
+			messages: [][]*tracepb.Span{{testSpan(1, 1), testSpan(1, 2)}},
+			want:     2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := loadedBackend{spans: map[string][]*tracepb.Span{}}
+			if len(tt.restored) > 0 {
+				backend.spans["00000000000000000000000000000001"] = tt.restored
+			}
+			store := NewTraceStore(backend, 0)
+			if _, err := store.Restore(ctx); err != nil {
+				t.Fatal(err)
+			}
+			for _, spans := range tt.messages {
+				if err := store.AddSpans(ctx, spans); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := store.SpanCount(); got != tt.want {
+				t.Errorf("SpanCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// durableBackend is a memory backend that claims to survive restarts
+type durableBackend struct {
+	memoryBackend
+}
+
+func (durableBackend) Durable() bool { return true }
+
+func TestTraceStoreRetriesFailedTraces(t *testing.T) {
+	defer func(attempts int) { *bufferAttempts = attempts }(*bufferAttempts)
+	*bufferAttempts = 3
+	const traceID = "00000000000000000000000000000001"
+	ctx := context.Background()
+
+	store := NewTraceStore(durableBackend{}, 0)
+	if err := store.AddSpans(ctx, []*tracepb.Span{testSpan(1, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		trace := store.GetExpiredTraces(0)[traceID]
+		if trace == nil {
+			t.Fatalf("attempt %d: trace is not buffered", attempt)
+		}
+		if trace.attempts != attempt-1 {
+			t.Errorf("attempt %d: trace has %d failed attempts", attempt, trace.attempts)
+		}
+		// a span arriving while the trace is processed is kept with the retried ones
+		if err := store.AddSpans(ctx, []*tracepb.Span{testSpan(1, 2)}); err != nil {
+			t.Fatal(err)
+		}
+		retried := store.Retry(traceID, trace)
+		if retried != (attempt < 3) {
+			t.Fatalf("attempt %d: Retry() = %v", attempt, retried)
+		}
+		if retried && store.SpanCount() != 2 {
+			t.Errorf("attempt %d: %d spans buffered, want 2", attempt, store.SpanCount())
+		}
+	}
+
+	memory := NewTraceStore(memoryBackend{}, 0)
+	if memory.Retry(traceID, &BufferedTrace{Spans: []*tracepb.Span{testSpan(1, 1)}}) {
+		t.Error("a memory store retries, its messages are redelivered instead")
+	}
+}
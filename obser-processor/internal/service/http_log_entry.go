@@ -2,18 +2,35 @@ package service
 
 import (
 	"context"
-	"time"
+	"encoding/json"
+	"strconv"
 
 	"kuroko.com/processor/internal/types"
 )
 
+// CreateHttpLogEntry stores a log entry under a stable id, a redelivered entry replaces
+// the stored one and is counted once in the rollups
 func (s *Service) CreateHttpLogEntry(ctx context.Context, http_log_entry *types.HttpLogEntry) (any, error) {
-	http_log_entry.StartTimeDate = time.Unix(http_log_entry.StartTime, 0).Local().Format("20030628")
+	http_log_entry.StartTimeDate = statisticDate(http_log_entry.StartTime)
+	http_log_entry.ID = httpLogEntryID(http_log_entry)
 
-	result, err := httpLogEntryCollection.InsertOne(ctx, http_log_entry)
+	result, err := httpLogEntryCollection.UpsertId(ctx, http_log_entry.ID, http_log_entry)
 	if err != nil {
 		return nil, err
 	}
+	if result.UpsertedCount > 0 {
+		rollupWriter.AddHttpLogEntry(http_log_entry)
+	}
+
+	return http_log_entry.ID, nil
+}
 
-	return result.InsertedID, nil
+// httpLogEntryID is the service and request id of the entry, or a hash of the entry
+// when the client sends no request id
+func httpLogEntryID(entry *types.HttpLogEntry) string {
+	if entry.RequestId != "" {
+		return entry.ServiceName + "_" + entry.RequestId
+	}
+	data, _ := json.Marshal(entry)
+	return strconv.FormatUint(HashCode64(string(data)), 16)
 }
@@ -0,0 +1,216 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"kuroko.com/processor/internal/config"
+)
+
+var (
+	httpLogSubj     = flag.String("nats.http-log-subject", "logs.http", "NATS subject for http logs")
+	traceStream     = flag.String("js.trace-stream", "TRACES", "JetStream stream capturing the span subject")
+	traceConsumer   = flag.String("js.trace-consumer", "obser-processor-traces", "Durable consumer name for spans")
+	httpLogStream   = flag.String("js.http-log-stream", "HTTP_LOGS", "JetStream stream capturing the http log subject")
+	httpLogConsumer = flag.String("js.http-log-consumer", "obser-processor-http-logs", "Durable consumer name for http logs")
+	dlqStream       = flag.String("js.dlq-stream", "DEAD_LETTER", "JetStream stream keeping dead-lettered messages")
+	dlqPrefix       = flag.String("js.dlq-prefix", "dlq", "Subject prefix for dead-lettered messages")
+	maxDeliver      = flag.Int("js.max-deliver", 5, "Maximum delivery attempts before a message is dead-lettered")
+	ackWait         = flag.Duration("js.ack-wait", 30*time.Second, "Time JetStream waits for an ack before redelivering")
+	nakDelay        = flag.Duration("js.nak-delay", time.Second, "Redelivery delay after a first failed attempt, doubled on each further attempt")
+	maxNakDelay     = flag.Duration("js.max-nak-delay", time.Minute, "Maximum redelivery delay of a failed message")
+	maxAckPending   = flag.Int("js.max-ack-pending", 20000, "Maximum unacknowledged messages per consumer")
+	fetchBatch      = flag.Int("js.fetch-batch", 100, "Number of messages pulled per fetch")
+)
+
+func init() {
+	config.Validate(func() error {
+		if *maxDeliver <= 0 {
+			return errors.New("js.max-deliver must be positive")
+		}
+		if *ackWait <= 0 {
+			return errors.New("js.ack-wait must be positive")
+		}
+		if *nakDelay <= 0 || *maxNakDelay < *nakDelay {
+			return errors.New("js.nak-delay must be positive and at most js.max-nak-delay")
+		}
+		if *maxAckPending <= 0 {
+			return errors.New("js.max-ack-pending must be positive")
+		}
+		if *fetchBatch <= 0 {
+			return errors.New("js.fetch-batch must be positive")
+		}
+		return nil
+	})
+}
+
+// errPoisonMessage marks a message that can never be processed, it is dead-lettered without redelivery
+var errPoisonMessage = errors.New("poison message")
+
+// EnsureStreams creates the trace, http log and dead letter streams when they do not exist yet
+func EnsureStreams(js nats.JetStreamContext) error {
+	if err := ensureStream(js, *traceStream, *natsSubj); err != nil {
+		return err
+	}
+	if err := ensureStream(js, *httpLogStream, *httpLogSubj); err != nil {
+		return err
+	}
+	return ensureStream(js, *dlqStream, *dlqPrefix+".>")
+}
+
+func ensureStream(js nats.JetStreamContext, name string, subjects ...string) error {
+	_, err := js.StreamInfo(name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return fmt.Errorf("failed to get stream %s: %w", name, err)
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     name,
+		Subjects: subjects,
+		Storage:  nats.FileStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create stream %s: %w", name, err)
+	}
+	log.Printf("Created JetStream stream %s on %v", name, subjects)
+	return nil
+}
+
+// pullSubscribe binds a durable pull consumer with explicit acks to the given stream
+func pullSubscribe(js nats.JetStreamContext, stream, subject, durable string) (*nats.Subscription, error) {
+	return js.PullSubscribe(subject, durable,
+		nats.BindStream(stream),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.DeliverAll(),
+		nats.MaxDeliver(*maxDeliver),
+		nats.AckWait(*ackWait),
+		nats.MaxAckPending(*maxAckPending),
+	)
+}
+
+// consume pulls messages in batches until the context is cancelled
+func consume(ctx context.Context, sub *nats.Subscription, handle func(*nats.Msg)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		msgs, err := sub.Fetch(*fetchBatch, nats.MaxWait(time.Second))
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
+			if errors.Is(err, nats.ErrConnectionClosed) || errors.Is(err, nats.ErrBadSubscription) {
+				return
+			}
+			log.Printf("Failed to fetch from %s: %v", sub.Subject, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, msg := range msgs {
+			handle(msg)
+		}
+	}
+}
+
+// settle acks the message when err is nil, otherwise it is redelivered with an
+// exponential backoff until max deliver is reached and then moved to the dead letter subject
+func settle(js nats.JetStreamContext, msg *nats.Msg, err error) {
+	if err == nil {
+		if err := msg.Ack(); err != nil {
+			log.Printf("Failed to ack message on %s: %v", msg.Subject, err)
+		}
+		return
+	}
+
+	delivered := uint64(1)
+	if meta, mErr := msg.Metadata(); mErr == nil {
+		delivered = meta.NumDelivered
+	}
+	if errors.Is(err, errPoisonMessage) || delivered >= uint64(*maxDeliver) {
+		deadLetter(js, msg, err)
+		return
+	}
+	delay := redeliveryDelay(delivered)
+	log.Printf("Redelivering message on %s in %s (attempt %d): %v", msg.Subject, delay, delivered, err)
+	if err := msg.NakWithDelay(delay); err != nil {
+		// the message is redelivered after ack wait anyway
+		log.Printf("Failed to nak message on %s: %v", msg.Subject, err)
+	}
+}
+
+// redeliveryDelay is js.nak-delay doubled for every attempt after the first, capped at
+// js.max-nak-delay
+func redeliveryDelay(delivered uint64) time.Duration {
+	delay := *nakDelay
+	for i := uint64(1); i < delivered && delay < *maxNakDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, *maxNakDelay)
+}
+
+func deadLetter(js nats.JetStreamContext, msg *nats.Msg, reason error) {
+	dlq := nats.NewMsg(*dlqPrefix + "." + msg.Subject)
+	dlq.Data = msg.Data
+	dlq.Header.Set("Obser-Original-Subject", msg.Subject)
+	dlq.Header.Set("Obser-Error", reason.Error())
+	if _, err := js.PublishMsg(dlq); err != nil {
+		// keep the message in the stream, it is redelivered after ack wait
+		log.Printf("Failed to dead-letter message on %s: %v", msg.Subject, err)
+		return
+	}
+	dlqCount.Inc()
+	log.Printf("Dead-lettered message on %s to %s: %v", msg.Subject, dlq.Subject, reason)
+	if err := msg.Term(); err != nil {
+		log.Printf("Failed to terminate dead-lettered message on %s: %v", msg.Subject, err)
+	}
+}
+
+// pendingAck settles a span message once every trace it carried spans for has been persisted
+type pendingAck struct {
+	mu        sync.Mutex
+	js        nats.JetStreamContext
+	msg       *nats.Msg
+	remaining int
+	err       error
+}
+
+func newPendingAck(js nats.JetStreamContext, msg *nats.Msg, traces int) *pendingAck {
+	return &pendingAck{js: js, msg: msg, remaining: traces}
+}
+
+func (p *pendingAck) done(err error) {
+	p.mu.Lock()
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+	p.remaining--
+	finished := p.remaining == 0
+	p.mu.Unlock()
+
+	if finished {
+		settle(p.js, p.msg, p.err)
+	}
+}
+
+// StartConsumeHttpLog consumes http logs from the durable consumer and acks each
+// message once the log entry is stored
+func (s *Service) StartConsumeHttpLog(ctx context.Context, js nats.JetStreamContext) error {
+	sub, err := pullSubscribe(js, *httpLogStream, *httpLogSubj, *httpLogConsumer)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", *httpLogSubj, err)
+	}
+	go func() {
+		consume(ctx, sub, func(msg *nats.Msg) {
+			settle(js, msg, s.ReceiveNATSMsg(msg))
+		})
+	}()
+	return nil
+}
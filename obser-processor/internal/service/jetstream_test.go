@@ -0,0 +1,28 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRedeliveryDelay(t *testing.T) {
+	defer func(delay, ceiling time.Duration) { *nakDelay, *maxNakDelay = delay, ceiling }(*nakDelay, *maxNakDelay)
+	*nakDelay, *maxNakDelay = time.Second, 10*time.Second
+
+	tests := []struct {
+		delivered uint64
+		want      time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{200, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := redeliveryDelay(tt.delivered); got != tt.want {
+			t.Errorf("redeliveryDelay(%d) = %s, want %s", tt.delivered, got, tt.want)
+		}
+	}
+}
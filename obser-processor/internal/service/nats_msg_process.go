@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 
 	"github.com/nats-io/nats.go"
 	"kuroko.com/processor/internal/types"
@@ -13,10 +14,9 @@ func (s *Service) ReceiveNATSMsg(m *nats.Msg) error {
 	entry := types.HttpLogEntry{}
 	err := json.Unmarshal(m.Data, &entry)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", errPoisonMessage, err)
 	}
-	s.ProcessHttpLogEntry(m.Subject, entry)
-	return nil
+	return s.ProcessHttpLogEntry(m.Subject, entry)
 }
 
 func (s *Service) ProcessHttpLogEntry(key string, entry types.HttpLogEntry) error {
@@ -27,6 +27,6 @@ func (s *Service) ProcessHttpLogEntry(key string, entry types.HttpLogEntry) erro
 	// if !strings.Contains(entry.Host, "abc.vn") {
 	// 	return nil
 	// }
-	s.CreateHttpLogEntry(context.Background(), &entry)
-	return nil
+	_, err := s.CreateHttpLogEntry(context.Background(), &entry)
+	return err
 }
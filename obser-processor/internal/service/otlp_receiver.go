@@ -0,0 +1,185 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+
+	"github.com/nats-io/nats.go"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	otlpGrpcAddr = flag.String("otlp.grpc-addr", ":4317", "Listen address of the OTLP/gRPC trace receiver, empty disables it")
+	otlpMaxBody  = flag.Int64("otlp.max-body", 16<<20, "Maximum size in bytes of an OTLP/HTTP request body")
+)
+
+// otlpReceiver accepts OTLP exports and republishes them on the span subject, an export
+// succeeds once JetStream has stored the spans so they reach TraceStore like any other
+// message
+type otlpReceiver struct {
+	collectortrace.UnimplementedTraceServiceServer
+	js nats.JetStreamContext
+}
+
+// StartOTLPReceivers serves OTLP/HTTP on /v1/traces of mux and starts the OTLP/gRPC
+// server, the returned server is nil when gRPC is disabled
+func (s *Service) StartOTLPReceivers(js nats.JetStreamContext, mux *http.ServeMux) *grpc.Server {
+	r := &otlpReceiver{js: js}
+	mux.Handle("/v1/traces", r)
+
+	if *otlpGrpcAddr == "" {
+		return nil
+	}
+	lis, err := net.Listen("tcp", *otlpGrpcAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen for OTLP/gRPC: %v", err)
+	}
+	server := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(server, r)
+	go func() {
+		log.Printf("Serving OTLP/gRPC at %s", *otlpGrpcAddr)
+		if err := server.Serve(lis); err != nil {
+			log.Printf("OTLP/gRPC server stopped: %v", err)
+		}
+	}()
+	return server
+}
+
+func (r *otlpReceiver) Export(ctx context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	if err := publishResourceSpans(ctx, r.js, req.ResourceSpans); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if contentType != "application/x-protobuf" && contentType != "application/json" {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, req.Body, *otlpMaxBody)
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, *otlpMaxBody)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exportReq collectortrace.ExportTraceServiceRequest
+	if contentType == "application/json" {
+		err = unmarshalOTLPJSON(data, &exportReq)
+	} else {
+		err = proto.Unmarshal(data, &exportReq)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := publishResourceSpans(req.Context(), r.js, exportReq.ResourceSpans); err != nil {
+		log.Printf("Failed to publish OTLP export: %v", err)
+		// 503 tells OTLP exporters to retry
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	var resp []byte
+	if contentType == "application/json" {
+		resp, err = protojson.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	} else {
+		resp, err = proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(resp)
+}
+
+// publishResourceSpans sends one message per resource on the span subject so a large
+// export stays under the NATS payload limit
+func publishResourceSpans(ctx context.Context, js nats.JetStreamContext, resourceSpans []*tracepb.ResourceSpans) error {
+	for _, rs := range resourceSpans {
+		data, err := proto.Marshal(&tracepb.TracesData{ResourceSpans: []*tracepb.ResourceSpans{rs}})
+		if err != nil {
+			return err
+		}
+		if _, err := js.Publish(*natsSubj, data, nats.Context(ctx)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalOTLPJSON decodes the OTLP JSON encoding, which differs from protojson by
+// writing trace and span ids as hex instead of base64
+func unmarshalOTLPJSON(data []byte, req *collectortrace.ExportTraceServiceRequest) error {
+	// numbers are kept verbatim, nanosecond timestamps do not fit a float64
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	hexIdsToBase64(doc)
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, req)
+}
+
+func hexIdsToBase64(doc any) {
+	switch v := doc.(type) {
+	case map[string]any:
+		for key, value := range v {
+			switch key {
+			case "traceId", "spanId", "parentSpanId", "trace_id", "span_id", "parent_span_id":
+				// hex ids are 16 or 32 characters, their base64 forms are 12 or 24
+				if id, ok := value.(string); ok && (len(id) == 16 || len(id) == 32) {
+					if raw, err := hex.DecodeString(id); err == nil {
+						v[key] = base64.StdEncoding.EncodeToString(raw)
+					}
+				}
+			default:
+				hexIdsToBase64(value)
+			}
+		}
+	case []any:
+		for _, value := range v {
+			hexIdsToBase64(value)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/processor/internal/types"
+)
+
+// MigratePathIds rewrites path, path_event, hop, hop_event and span documents from the
+// old summed hash to structural fingerprints. Every stored trace is rebuilt from its
+// spans, so traces that collided under one old id are split apart. The path and hop
+// rollups of the days holding rewritten events are rebuilt. Re-running is safe.
+func (s *Service) MigratePathIds(ctx context.Context) error {
+	var traceIDs []string
+	if err := spanCollection.Find(ctx, bson.M{}).Distinct("trace_id", &traceIDs); err != nil {
+		return err
+	}
+	log.Printf("Migrating path ids of %d traces", len(traceIDs))
+
+	// old path id -> new path ids it was split into
+	moved := make(map[uint64]map[uint64]bool)
+	newIds := make(map[uint64]bool)
+	migrated, skipped := 0, 0
+	// time range in milliseconds of the rewritten events, their rollups are stale
+	var first, last int64
+	rewritten := func(timestamp int64) {
+		if first == 0 || timestamp < first {
+			first = timestamp
+		}
+		last = max(last, timestamp)
+	}
+
+	for _, traceID := range traceIDs {
+		var stored []*types.Span
+		if err := spanCollection.Find(ctx, bson.M{"trace_id": traceID}).All(&stored); err != nil {
+			return err
+		}
+		if len(stored) == 0 {
+			continue
+		}
+		trace := make([]*types.SpanResponse, 0, len(stored))
+		for _, span := range stored {
+			trace = append(trace, convertSpanToSr(span))
+		}
+		root, _, err := s.ConvertTraceToGraph(ctx, trace)
+		if err != nil || root == nil {
+			skipped++
+			continue
+		}
+
+		oldId := stored[0].PathID
+		pathId, canonical := s.CaculatePathId(ctx, root)
+		pathId, pathStored, err := s.resolvePathId(ctx, pathId, canonical)
+		if err != nil {
+			return err
+		}
+		newIds[pathId] = true
+		if oldId == pathId {
+			continue
+		}
+		if moved[oldId] == nil {
+			moved[oldId] = make(map[uint64]bool)
+		}
+		moved[oldId][pathId] = true
+
+		if !pathStored {
+			if err := s.storePath(ctx, root, pathId, canonical); err != nil {
+				return err
+			}
+		}
+
+		filter := bson.M{"trace_id": traceID}
+		update := bson.M{"$set": bson.M{"path_id": pathId}}
+		if _, err := spanCollection.UpdateAll(ctx, filter, update); err != nil {
+			return err
+		}
+		if _, err := pathEventCollection.UpdateAll(ctx, filter, update); err != nil {
+			return err
+		}
+
+		if err := rewriteHopEvents(ctx, filter, oldId, pathId, rewritten); err != nil {
+			return err
+		}
+		for _, span := range stored {
+			rewritten(span.Timestamp / 1000)
+		}
+		migrated++
+	}
+
+	// entities of the new paths must be written before the old ones are retired
+	if err := bulkWriter.Flush(ctx); err != nil {
+		return err
+	}
+
+	for oldId, targets := range moved {
+		if newIds[oldId] {
+			// the old id is also a valid fingerprint of some trace, keep its entities
+			continue
+		}
+		// hop events written before trace ids were recorded follow the old id only
+		// when it maps to a single new path
+		if len(targets) == 1 {
+			for pathId := range targets {
+				if err := s.migrateLegacyHopEvents(ctx, oldId, pathId, rewritten); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := pathCollection.RemoveAll(ctx, bson.M{"path_id": oldId}); err != nil {
+			return err
+		}
+		if _, err := hopCollection.RemoveAll(ctx, bson.M{"path_id": oldId}); err != nil {
+			return err
+		}
+		if _, err := pathIdCollection.RemoveAll(ctx, bson.M{"_id": oldId}); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Migrated %d traces, skipped %d broken traces, retired %d path ids", migrated, skipped, len(moved))
+
+	// rollups are keyed by path and hop id, the days of the rewritten events are counted
+	// again under the new ids
+	if *rollupEnabled && last > 0 {
+		day := func(ms int64) time.Time {
+			return time.UnixMilli(ms).UTC().Truncate(24 * time.Hour)
+		}
+		if err := s.rebuildRollupDays(ctx, day(first), day(last)); err != nil {
+			return fmt.Errorf("rebuild rollups: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Service) migrateLegacyHopEvents(ctx context.Context, oldId, pathId uint64, rewritten func(int64)) error {
+	return rewriteHopEvents(ctx, bson.M{
+		"trace_id": bson.M{"$in": bson.A{nil, ""}},
+		"hop_id":   bson.M{"$regex": "_" + strconv.FormatUint(oldId, 10) + "$"},
+	}, oldId, pathId, rewritten)
+}
+
+// rewriteHopEvents moves the hop events matching filter from oldId to pathId in one
+// bulk write, rewritten is called with the timestamp of every event
+func rewriteHopEvents(ctx context.Context, filter bson.M, oldId, pathId uint64, rewritten func(int64)) error {
+	var hopEvents []*types.HopEvent
+	if err := hopEventCollection.Find(ctx, filter).All(&hopEvents); err != nil {
+		return err
+	}
+	for _, he := range hopEvents {
+		rewritten(he.Timestamp)
+	}
+	return writeBulk(ctx, hopEventCollection, len(hopEvents), func(b *qmgo.Bulk) {
+		for _, he := range hopEvents {
+			b.UpdateId(he.ID, bson.M{"$set": bson.M{"hop_id": rewriteHopID(he.HopID, oldId, pathId)}})
+		}
+	})
+}
+
+// rewriteHopID swaps the path id suffix written by generateHopID
+func rewriteHopID(hopID string, oldId, pathId uint64) string {
+	return strings.TrimSuffix(hopID, "_"+strconv.FormatUint(oldId, 10)) + "_" + strconv.FormatUint(pathId, 10)
+}
@@ -2,23 +2,27 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
-	"github.com/google/uuid"
-	"github.com/qiniu/qmgo"
-	"go.mongodb.org/mongo-driver/bson"
 	"kuroko.com/processor/internal/types"
 )
 
-func (s *Service) ProcessGraph(ctx context.Context, root *types.GraphNode, pathId uint32) {
+func (s *Service) ProcessGraph(ctx context.Context, root *types.GraphNode, pathId uint64, orphans int, sampledOut bool) {
 	pathEvent := &types.PathEvent{
-		ID:        uuid.New().String(),
-		PathID:    pathId,
-		TraceID:   root.Span.TraceID,
-		Timestamp: root.Span.Timestamp / 1000,
+		ID:          pathEventID(root.Span.TraceID, pathId),
+		PathID:      pathId,
+		TraceID:     root.Span.TraceID,
+		Timestamp:   root.Span.Timestamp / 1000,
+		Duration:    root.Span.Duration,
+		HasError:    s.hasSpanError(root),
+		Broken:      orphans > 0,
+		OrphanCount: orphans,
+		SampledOut:  sampledOut,
 	}
-	pathEventCollection.InsertOne(ctx, pathEvent)
+	bulkWriter.AddPathEvent(pathEvent)
 	newRoot := &types.GraphNode{
 		Span: &types.SpanResponse{
 			Name: "root",
@@ -32,53 +36,88 @@ func (s *Service) ProcessGraph(ctx context.Context, root *types.GraphNode, pathI
 	s.dfs(ctx, newRoot, pathId)
 }
 
-func (s *Service) CaculatePathId(ctx context.Context, root *types.GraphNode, level int) (uint32, error) {
-	hash := HashCode(root.Span.Name) + HashCode(root.Span.LocalEndpoint.ServiceName) + uint32(level)*31
-	for _, child := range root.Children {
-		h, err := s.CaculatePathId(ctx, child, level+1)
-		if err != nil {
-			return 0, err
-		}
-		hash += h
+// pathEventID is the id of the path event of a trace, stable across redeliveries
+func pathEventID(traceID string, pathId uint64) string {
+	return traceID + "_" + strconv.FormatUint(pathId, 10)
+}
+
+// hopEventID is the id of the hop event ending at a span, stable across redeliveries
+func hopEventID(traceID, spanID string) string {
+	return traceID + "_" + spanID
+}
+
+// CaculatePathId fingerprints the structure of the span tree, it returns the 53-bit
+// path id together with the canonical form that was hashed
+func (s *Service) CaculatePathId(ctx context.Context, root *types.GraphNode) (uint64, string) {
+	canonical := canonicalPath(root)
+	return HashCode64(canonical) & pathIdMask, canonical
+}
+
+// pathIdMask cuts the FNV-64a hash down to 53 bits. Path ids reach the frontend as
+// JSON numbers, and JavaScript only holds integers up to 2^53 exactly, a full 64-bit
+// id would be rounded and no longer match any stored path. The narrower hash collides
+// sooner, resolvePathId moves a colliding structure to another id
+const pathIdMask = 1<<53 - 1
+
+// canonicalPath serializes a span tree with children sorted, so sibling order does
+// not matter while the shape of the tree does
+func canonicalPath(node *types.GraphNode) string {
+	children := make([]string, 0, len(node.Children))
+	for _, child := range node.Children {
+		children = append(children, canonicalPath(child))
 	}
-	return hash, nil
+	sort.Strings(children)
+
+	service, name := node.Span.LocalEndpoint.ServiceName, node.Span.Name
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d:%s%d:%s(", len(service), service, len(name), name)
+	b.WriteString(strings.Join(children, ","))
+	b.WriteString(")")
+	return b.String()
 }
 
 // insert hop and hop event
-func (s *Service) dfs(ctx context.Context, root *types.GraphNode, pathId uint32) {
+func (s *Service) dfs(ctx context.Context, root *types.GraphNode, pathId uint64) {
 	if root == nil {
 		return
 	}
 
 	for _, child := range root.Children {
 		hopID := generateHopID(root, child, pathId)
-		var hop types.Hop
-		err := hopCollection.Find(ctx, bson.M{"_id": hopID}).One(&hop)
-		if err != nil {
-			if qmgo.IsErrNoDocuments(err) {
-				hop = types.Hop{
-					ID:              hopID,
-					PathID:          pathId,
-					CallerService:   root.Span.LocalEndpoint.ServiceName,
-					CallerOperation: root.Span.Name,
-					CalledService:   child.Span.LocalEndpoint.ServiceName,
-					CalledOperation: child.Span.Name,
-				}
-				hopCollection.InsertOne(ctx, &hop)
-			}
-		}
+		bulkWriter.UpsertHop(&types.Hop{
+			ID:              hopID,
+			PathID:          pathId,
+			CallerService:   root.Span.LocalEndpoint.ServiceName,
+			CallerOperation: root.Span.Name,
+			CalledService:   child.Span.LocalEndpoint.ServiceName,
+			CalledOperation: child.Span.Name,
+		})
 		hopEvent := &types.HopEvent{
-			ID:        uuid.NewString(),
+			ID:        hopEventID(child.Span.TraceID, child.Span.ID),
 			HopID:     hopID,
+			TraceID:   child.Span.TraceID,
 			Timestamp: child.Span.Timestamp / 1000,
 			Duration:  child.Span.Duration,
-			HasError:  s.isSpanError(child.Span),
+			HasError:  isSpanError(child.Span),
 		}
-		hopEventCollection.InsertOne(ctx, hopEvent)
+		bulkWriter.AddHopEvent(hopEvent)
 		s.dfs(ctx, child, pathId)
 	}
 }
 
-func generateHopID(parent, child *types.GraphNode, pathId uint32) string {
-	return strings.ToUpper(parent.Span.LocalEndpoint.ServiceName + "_" + parent.Span.Name + "_" + child.Span.LocalEndpoint.ServiceName + "_" + child.Span.Name + "_" + strconv.Itoa(int(pathId)))
+// hasSpanError reports whether a span of the tree failed
+func (s *Service) hasSpanError(node *types.GraphNode) bool {
+	if isSpanError(node.Span) {
+		return true
+	}
+	for _, child := range node.Children {
+		if s.hasSpanError(child) {
+			return true
+		}
+	}
+	return false
+}
+
+func generateHopID(parent, child *types.GraphNode, pathId uint64) string {
+	return strings.ToUpper(parent.Span.LocalEndpoint.ServiceName + "_" + parent.Span.Name + "_" + child.Span.LocalEndpoint.ServiceName + "_" + child.Span.Name + "_" + strconv.FormatUint(pathId, 10))
 }
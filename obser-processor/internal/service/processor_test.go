@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"kuroko.com/processor/internal/types"
+)
+
+func testNode(service, name string, children ...*types.GraphNode) *types.GraphNode {
+	return &types.GraphNode{
+		Span:     &types.SpanResponse{Name: name, LocalEndpoint: types.SpanEndpoint{ServiceName: service}},
+		Children: children,
+	}
+}
+
+func TestCaculatePathId(t *testing.T) {
+	tree := func() *types.GraphNode {
+		return testNode("gateway", "GET /order",
+			testNode("order", "load", testNode("db", "select")),
+			testNode("user", "auth"),
+		)
+	}
+
+	tests := []struct {
+		name  string
+		other *types.GraphNode
+		same  bool
+	}{
+		{"same tree", tree(), true},
+		{
+			"siblings in another order",
+			testNode("gateway", "GET /order",
+				testNode("user", "auth"),
+				testNode("order", "load", testNode("db", "select")),
+			),
+			true,
+		},
+		{
+			"child moved one level down",
+			testNode("gateway", "GET /order",
+				testNode("order", "load", testNode("db", "select"), testNode("user", "auth")),
+			),
+			false,
+		},
+		{
+			"another operation",
+			testNode("gateway", "GET /order",
+				testNode("order", "store", testNode("db", "select")),
+				testNode("user", "auth"),
+			),
+			false,
+		},
+		{
+			"repeated call",
+			testNode("gateway", "GET /order",
+				testNode("order", "load", testNode("db", "select")),
+				testNode("user", "auth"),
+				testNode("user", "auth"),
+			),
+			false,
+		},
+		{
+			// the length prefixes keep separators inside names from shifting fields
+			"separator moved between service and name",
+			testNode("gateway", "GET /order",
+				testNode("order", "load", testNode("db", "select")),
+				testNode("user5:auth", ""),
+			),
+			false,
+		},
+	}
+	s := &Service{}
+	ctx := context.Background()
+	id, canonical := s.CaculatePathId(ctx, tree())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otherId, otherCanonical := s.CaculatePathId(ctx, tt.other)
+			if (otherId == id) != tt.same || (otherCanonical == canonical) != tt.same {
+				t.Errorf("got %d %s, base %d %s, want same = %v", otherId, otherCanonical, id, canonical, tt.same)
+			}
+			if otherId > pathIdMask {
+				t.Errorf("path id %d does not fit in 53 bits", otherId)
+			}
+		})
+	}
+}
+
+func TestResolvePathIdMovesCollidingStructures(t *testing.T) {
+	ctx := context.Background()
+	s := &Service{}
+	id, canonical := s.CaculatePathId(ctx, testNode("a", "x", testNode("b", "y")))
+	probe := probePathId(canonical, 1)
+	if probe == id || probe > pathIdMask {
+		t.Fatalf("probe id %d, base id %d", probe, id)
+	}
+	// another structure holds the hashed id, the probed one is already ours
+	knownPaths.Store(id, "1:z1:z()")
+	knownPaths.Store(probe, canonical)
+	defer knownPaths.Delete(id)
+	defer knownPaths.Delete(probe)
+
+	got, stored, err := s.resolvePathId(ctx, id, canonical)
+	if err != nil || got != probe || !stored {
+		t.Errorf("resolvePathId() = %d, %v, %v, want %d, true, nil", got, stored, err, probe)
+	}
+	got, stored, err = s.resolvePathId(ctx, id, "1:z1:z()")
+	if err != nil || got != id || !stored {
+		t.Errorf("resolvePathId() of the holder = %d, %v, %v, want %d, true, nil", got, stored, err, id)
+	}
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/processor/internal/types"
+)
+
+var reconciledCount = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pipeline_traces_reconciled_total",
+		Help: "Tổng số trace được ghép thêm span đến muộn",
+	},
+)
+
+// mergeStoredSpans adds the spans already written or still queued for the trace to a
+// late fragment, it reports whether the trace had been processed before
+func (s *Service) mergeStoredSpans(ctx context.Context, trace []*types.SpanResponse) ([]*types.SpanResponse, bool, error) {
+	if len(trace) == 0 {
+		return trace, false, nil
+	}
+	var stored []*types.Span
+	err := spanCollection.Find(ctx, bson.M{"trace_id": trace[0].TraceID}).All(&stored)
+	if err != nil {
+		return nil, false, err
+	}
+	queued, queuedSampledOut := bulkWriter.QueuedTrace(trace[0].TraceID)
+	stored = append(queued, stored...)
+	if len(stored) == 0 {
+		// the earlier fragment of a sampled out trace left only its path event
+		if sampler.enabled {
+			if queuedSampledOut {
+				return nil, false, errSampledOut
+			}
+			n, err := pathEventCollection.Find(ctx, bson.M{"trace_id": trace[0].TraceID, "sampled_out": true}).Count()
+			if err != nil {
+				return nil, false, err
+			}
+			if n > 0 {
+				return nil, false, errSampledOut
+			}
+		}
+		return trace, false, nil
+	}
+
+	// spans of the late fragment win over stored ones with the same id
+	seen := make(map[string]bool, len(trace))
+	merged := make([]*types.SpanResponse, 0, len(trace)+len(stored))
+	for _, sr := range trace {
+		if seen[sr.ID] {
+			continue
+		}
+		seen[sr.ID] = true
+		merged = append(merged, sr)
+	}
+	for _, span := range stored {
+		if seen[span.ID] {
+			continue
+		}
+		seen[span.ID] = true
+		merged = append(merged, convertSpanToSr(span))
+	}
+	return merged, true, nil
+}
+
+// reconcileTrace queues the rewrite of a trace in the current batch, the documents
+// written or queued for it are replaced when the batch is flushed and its stored
+// events are taken back from the rollups
+func (s *Service) reconcileTrace(ctx context.Context, traceID string) error {
+	filter := bson.M{"trace_id": traceID}
+	var pathEvents []*types.PathEvent
+	if err := pathEventCollection.Find(ctx, filter).All(&pathEvents); err != nil {
+		return err
+	}
+	var hopEvents []*types.HopEvent
+	if err := hopEventCollection.Find(ctx, filter).All(&hopEvents); err != nil {
+		return err
+	}
+	bulkWriter.Reconcile(traceID, pathEvents, hopEvents)
+	reconciledCount.Inc()
+	log.Printf("Reconciling trace %s with late spans", traceID)
+	return nil
+}
+
+// convertSpanToSr rebuilds a span response from a stored span
+func convertSpanToSr(span *types.Span) *types.SpanResponse {
+	tags := make(map[string]string, len(span.Tags))
+	for _, tag := range span.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	// spans stored before tags were kept only have the error string
+	if span.HasError && len(span.Tags) == 0 {
+		tags["error"] = span.Error
+		if span.Error == "" {
+			tags["error"] = "true"
+		}
+	}
+	events := make([]map[string]any, 0, len(span.Events))
+	for _, event := range span.Events {
+		eventMap := map[string]any{
+			"name":      event.Name,
+			"timestamp": uint64(event.Timestamp) * 1000,
+		}
+		if len(event.Attributes) > 0 {
+			eventMap["attributes"] = fromKeyValues(event.Attributes)
+		}
+		events = append(events, eventMap)
+	}
+	links := make([]map[string]any, 0, len(span.Links))
+	for _, link := range span.Links {
+		linkMap := map[string]any{
+			"trace_id": link.TraceID,
+			"span_id":  link.SpanID,
+		}
+		if len(link.Attributes) > 0 {
+			linkMap["attributes"] = fromKeyValues(link.Attributes)
+		}
+		links = append(links, linkMap)
+	}
+	return &types.SpanResponse{
+		TraceID:  span.TraceID,
+		ID:       span.ID,
+		ParentID: span.ParentID,
+		Name:     span.Operation,
+		LocalEndpoint: types.SpanEndpoint{
+			ServiceName: span.Service,
+		},
+		Timestamp:     span.Timestamp,
+		Duration:      span.Duration,
+		Tags:          tags,
+		Kind:          span.Kind,
+		StatusCode:    span.StatusCode,
+		StatusMessage: span.StatusMessage,
+		Events:        events,
+		Links:         links,
+	}
+}
+
+func fromKeyValues(kvs []types.KeyValue) map[string]any {
+	res := make(map[string]any, len(kvs))
+	for _, kv := range kvs {
+		res[kv.Key] = kv.Value
+	}
+	return res
+}
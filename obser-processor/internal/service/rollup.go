@@ -0,0 +1,312 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"kuroko.com/processor/internal/config"
+	"kuroko.com/processor/internal/types"
+)
+
+var (
+	rollupEnabled  = flag.Bool("rollup.enabled", true, "Maintain minute, hour and day rollups of API, path and hop events")
+	rollupInterval = flag.Duration("rollup.interval", 10*time.Second, "How often accumulated rollup increments are written")
+	rollupAttempts = flag.Int("rollup.max-attempts", 5, "Flushes a rollup increment is tried in before it is dropped")
+)
+
+var rollupDroppedCount = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pipeline_rollup_increments_dropped_total",
+		Help: "Tổng số rollup bị bỏ sau nhiều lần ghi thất bại",
+	},
+)
+
+func init() {
+	config.Validate(func() error {
+		if *rollupInterval <= 0 {
+			return errors.New("rollup.interval must be positive")
+		}
+		if *rollupAttempts < 1 {
+			return errors.New("rollup.max-attempts must be at least 1")
+		}
+		return nil
+	})
+}
+
+// rollupUnits are the bucket sizes in milliseconds, days are cut in UTC
+var rollupUnits = []struct {
+	name string
+	size int64
+}{
+	{"minute", 60 * 1000},
+	{"hour", 60 * 60 * 1000},
+	{"day", 24 * 60 * 60 * 1000},
+}
+
+// sketchAccuracy is the relative accuracy of the latency sketches kept in rollups,
+// analytics estimates quantiles with the same value
+const sketchAccuracy = 0.01
+
+var sketchLogGamma = math.Log((1 + sketchAccuracy) / (1 - sketchAccuracy))
+
+// sketchIndex is the DDSketch bin of a latency in microseconds, bins of rollups are
+// merged by adding their counts
+func sketchIndex(latency int64) int {
+	// latencies under a microsecond share the first bin
+	if latency < 1 {
+		latency = 1
+	}
+	return int(math.Ceil(math.Log(float64(latency)) / sketchLogGamma))
+}
+
+// rollupDelta is the pending increment of one rollup document
+type rollupDelta struct {
+	coll       *qmgo.Collection
+	key        bson.M
+	count      int64
+	errorCount int64
+	latencySum int64
+	// latencyMin and latencyMax are only set by added events, a take back cannot
+	// narrow the stored range
+	hasRange    bool
+	latencyMin  int64
+	latencyMax  int64
+	sketch      map[int]int64
+	statusCodes map[int]int64
+	// attempts counts the flushes the increment failed in
+	attempts int
+}
+
+// RollupWriter accumulates increments of the rollup collections in memory and writes
+// one upsert per rollup document every rollup.interval
+type RollupWriter struct {
+	mu     sync.Mutex
+	deltas map[string]*rollupDelta
+}
+
+// NewRollupWriter creates an empty rollup writer
+func NewRollupWriter() *RollupWriter {
+	return &RollupWriter{deltas: make(map[string]*rollupDelta)}
+}
+
+// AddHttpLogEntry counts a request in the rollups of its API
+func (w *RollupWriter) AddHttpLogEntry(entry *types.HttpLogEntry) {
+	key := bson.M{"service_name": entry.ServiceName, "uri_path": entry.URIPath, "method": entry.Method}
+	id := entry.ServiceName + "|" + entry.Method + "|" + entry.URIPath
+	w.add(apiRollupCollection, id, key, entry.StartTime, entry.Duration, entry.StatusCode >= 400, entry.StatusCode, 1)
+}
+
+// AddPathEvent counts a trace in the rollups of its path, sign -1 takes back an event
+// that is removed
+func (w *RollupWriter) AddPathEvent(pe *types.PathEvent, sign int64) {
+	id := strconv.FormatUint(pe.PathID, 10)
+	w.add(pathRollupCollection, id, bson.M{"path_id": pe.PathID}, pe.Timestamp, int64(pe.Duration), pe.HasError, 0, sign)
+}
+
+// AddHopEvent counts a call in the rollups of its hop, sign -1 takes back an event
+// that is removed
+func (w *RollupWriter) AddHopEvent(he *types.HopEvent, sign int64) {
+	w.add(hopRollupCollection, he.HopID, bson.M{"hop_id": he.HopID}, he.Timestamp, int64(he.Duration), he.HasError, 0, sign)
+}
+
+func (w *RollupWriter) add(coll *qmgo.Collection, id string, key bson.M, timestamp, latency int64, hasError bool, statusCode int, sign int64) {
+	if !*rollupEnabled {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, unit := range rollupUnits {
+		bucket := timestamp / unit.size * unit.size
+		docId := unit.name + "|" + id + "|" + strconv.FormatInt(bucket, 10)
+		d, ok := w.deltas[docId]
+		if !ok {
+			d = &rollupDelta{
+				coll:        coll,
+				key:         bson.M{"unit": unit.name, "bucket": bucket},
+				sketch:      make(map[int]int64),
+				statusCodes: make(map[int]int64),
+			}
+			for k, v := range key {
+				d.key[k] = v
+			}
+			w.deltas[docId] = d
+		}
+		d.count += sign
+		if hasError {
+			d.errorCount += sign
+		}
+		d.latencySum += sign * latency
+		if sign > 0 {
+			d.addRange(latency, latency)
+		}
+		d.sketch[sketchIndex(latency)] += sign
+		if statusCode > 0 {
+			d.statusCodes[statusCode] += sign
+		}
+	}
+}
+
+// Start flushes the writer every rollup.interval until the context is cancelled, the
+// caller flushes what is left once nothing adds increments anymore
+func (w *RollupWriter) Start(ctx context.Context) {
+	ticker := time.NewTicker(*rollupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Flush(context.Background())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Flush writes the accumulated increments, the upserts that fail are kept for the
+// next flush until they failed rollup.max-attempts times
+func (w *RollupWriter) Flush(ctx context.Context) error {
+	w.mu.Lock()
+	deltas := w.deltas
+	w.deltas = make(map[string]*rollupDelta)
+	w.mu.Unlock()
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	byColl := make(map[*qmgo.Collection]map[string]*rollupDelta)
+	for id, d := range deltas {
+		if byColl[d.coll] == nil {
+			byColl[d.coll] = make(map[string]*rollupDelta)
+		}
+		byColl[d.coll][id] = d
+	}
+	var failed []string
+	var err error
+	for coll, collDeltas := range byColl {
+		ids := make([]string, 0, len(collDeltas))
+		writeErr := writeBulk(ctx, coll, len(collDeltas), func(b *qmgo.Bulk) {
+			for id, d := range collDeltas {
+				ids = append(ids, id)
+				b.UpsertOne(bson.M{"_id": id}, d.update())
+			}
+		})
+		if writeErr != nil {
+			err = writeErr
+			failed = append(failed, failedWrites(writeErr, ids)...)
+		}
+	}
+	if err != nil {
+		kept := w.requeue(deltas, failed)
+		log.Printf("Failed to write rollups, %d increments kept: %v", kept, err)
+	}
+	return err
+}
+
+// requeue puts back the failed deltas for the next flush and drops those that failed
+// rollup.max-attempts times, it returns how many were kept
+func (w *RollupWriter) requeue(deltas map[string]*rollupDelta, failed []string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	kept := 0
+	for _, id := range failed {
+		d := deltas[id]
+		if d.attempts++; d.attempts >= *rollupAttempts {
+			log.Printf("Dropping rollup increment %s after %d failed writes", id, d.attempts)
+			rollupDroppedCount.Inc()
+			continue
+		}
+		w.merge(id, d)
+		kept++
+	}
+	return kept
+}
+
+// failedWrites returns the ids whose write failed in a bulk write of ids in order. The
+// other upserts of an unordered bulk were applied and must not be repeated, only an
+// error that is not a per write error leaves every write in doubt
+func failedWrites(err error, ids []string) []string {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil || len(bwe.WriteErrors) == 0 {
+		return ids
+	}
+	failed := make([]string, 0, len(bwe.WriteErrors))
+	for _, we := range bwe.WriteErrors {
+		if we.Index >= 0 && we.Index < len(ids) {
+			failed = append(failed, ids[we.Index])
+		}
+	}
+	return failed
+}
+
+// merge puts back a delta that was not written, w.mu must be held
+func (w *RollupWriter) merge(id string, d *rollupDelta) {
+	cur, ok := w.deltas[id]
+	if !ok {
+		w.deltas[id] = d
+		return
+	}
+	cur.attempts = max(cur.attempts, d.attempts)
+	cur.count += d.count
+	cur.errorCount += d.errorCount
+	cur.latencySum += d.latencySum
+	if d.hasRange {
+		cur.addRange(d.latencyMin, d.latencyMax)
+	}
+	for k, v := range d.sketch {
+		cur.sketch[k] += v
+	}
+	for k, v := range d.statusCodes {
+		cur.statusCodes[k] += v
+	}
+}
+
+func (d *rollupDelta) addRange(lo, hi int64) {
+	if !d.hasRange {
+		d.latencyMin, d.latencyMax, d.hasRange = lo, hi, true
+		return
+	}
+	d.latencyMin = min(d.latencyMin, lo)
+	d.latencyMax = max(d.latencyMax, hi)
+}
+
+func (d *rollupDelta) update() bson.M {
+	inc := bson.M{
+		"count":       d.count,
+		"error_count": d.errorCount,
+		"latency_sum": d.latencySum,
+	}
+	for k, v := range d.sketch {
+		inc["sketch."+strconv.Itoa(k)] = v
+	}
+	for k, v := range d.statusCodes {
+		inc["status_codes."+strconv.Itoa(k)] = v
+	}
+	update := bson.M{
+		"$setOnInsert": d.key,
+		"$inc":         inc,
+	}
+	if d.hasRange {
+		update["$min"] = bson.M{"latency_min": d.latencyMin}
+		update["$max"] = bson.M{"latency_max": d.latencyMax}
+	}
+	return update
+}
+
+// StartRollupWriter flushes the rollup writer until the context is cancelled
+func (s *Service) StartRollupWriter(ctx context.Context) {
+	rollupWriter.Start(ctx)
+}
+
+// FlushRollups writes the pending rollup increments
+func (s *Service) FlushRollups(ctx context.Context) error {
+	return rollupWriter.Flush(ctx)
+}
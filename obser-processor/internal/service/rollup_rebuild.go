@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/processor/internal/types"
+)
+
+// RebuildRollups recomputes the rollups of every UTC day from from to to, both included
+// and formatted 2006-01-02, from the stored http logs, path events and hop events. It
+// fills the history written before rollups were enabled, the days must be complete
+// since a running processor adds to the buckets being rebuilt
+func (s *Service) RebuildRollups(ctx context.Context, from, to string) error {
+	if !*rollupEnabled {
+		return errors.New("rollup.enabled is off")
+	}
+	first, err := time.ParseInLocation(time.DateOnly, from, time.UTC)
+	if err != nil {
+		return fmt.Errorf("invalid from: %w", err)
+	}
+	last, err := time.ParseInLocation(time.DateOnly, to, time.UTC)
+	if err != nil {
+		return fmt.Errorf("invalid to: %w", err)
+	}
+	if last.Before(first) {
+		return errors.New("to must not be before from")
+	}
+	return s.rebuildRollupDays(ctx, first, last)
+}
+
+// rebuildRollupDays rebuilds the UTC days from first to last, both included
+func (s *Service) rebuildRollupDays(ctx context.Context, first, last time.Time) error {
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		n, err := s.rebuildDayRollups(ctx, day.UnixMilli(), day.AddDate(0, 0, 1).UnixMilli())
+		if err != nil {
+			return fmt.Errorf("%s: %w", day.Format(time.DateOnly), err)
+		}
+		log.Printf("Rollups of %s rebuilt from %d events", day.Format(time.DateOnly), n)
+	}
+	return nil
+}
+
+// rebuildDayRollups replaces the rollups of the day [start, end) with the counts of
+// its raw events, it returns how many events were counted
+func (s *Service) rebuildDayRollups(ctx context.Context, start, end int64) (int, error) {
+	// the minute and hour buckets of the day and its day bucket
+	buckets := bson.M{"bucket": bson.M{"$gte": start, "$lt": end}}
+	for _, coll := range []*qmgo.Collection{apiRollupCollection, pathRollupCollection, hopRollupCollection} {
+		if _, err := coll.RemoveAll(ctx, buckets); err != nil {
+			return 0, err
+		}
+	}
+
+	w := NewRollupWriter()
+	n := 0
+	err := forEachEvent(ctx, httpLogEntryCollection, "start_time", start, end, func(hle *types.HttpLogEntry) {
+		w.AddHttpLogEntry(hle)
+		n++
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = forEachEvent(ctx, pathEventCollection, "timestamp", start, end, func(pe *types.PathEvent) {
+		w.AddPathEvent(pe, 1)
+		n++
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = forEachEvent(ctx, hopEventCollection, "timestamp", start, end, func(he *types.HopEvent) {
+		w.AddHopEvent(he, 1)
+		n++
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, w.Flush(ctx)
+}
+
+// forEachEvent calls fn with every document of coll with field in [start, end)
+func forEachEvent[T any](ctx context.Context, coll *qmgo.Collection, field string, start, end int64, fn func(*T)) error {
+	cursor := coll.Find(ctx, bson.M{field: bson.M{"$gte": start, "$lt": end}}).Cursor()
+	defer cursor.Close()
+	for {
+		// a fresh document so fields missing from the next one are not carried over
+		var doc T
+		if !cursor.Next(&doc) {
+			break
+		}
+		fn(&doc)
+	}
+	return cursor.Err()
+}
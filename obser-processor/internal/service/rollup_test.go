@@ -0,0 +1,145 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"kuroko.com/processor/internal/types"
+)
+
+func TestFailedWrites(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	writeErrors := func(indexes ...int) []mongo.BulkWriteError {
+		var wes []mongo.BulkWriteError
+		for _, i := range indexes {
+			wes = append(wes, mongo.BulkWriteError{WriteError: mongo.WriteError{Index: i, Code: 11000}})
+		}
+		return wes
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{"network error leaves every write in doubt", errors.New("connection reset"), ids},
+		{"per write errors", mongo.BulkWriteException{WriteErrors: writeErrors(0, 2)}, []string{"a", "c"}},
+		{"wrapped per write error", errors.Join(errors.New("flush"), mongo.BulkWriteException{WriteErrors: writeErrors(1)}), []string{"b"}},
+		{"index out of range is ignored", mongo.BulkWriteException{WriteErrors: writeErrors(1, 7)}, []string{"b"}},
+		{
+			"write concern error",
+			mongo.BulkWriteException{WriteErrors: writeErrors(1), WriteConcernError: &mongo.WriteConcernError{Code: 64}},
+			ids,
+		},
+		{"exception without write errors", mongo.BulkWriteException{}, ids},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failedWrites(tt.err, ids); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("failedWrites() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollupDeltaUpdate(t *testing.T) {
+	defer func(enabled bool) { *rollupEnabled = enabled }(*rollupEnabled)
+	*rollupEnabled = true
+	event := func(duration int, hasError bool) *types.HopEvent {
+		return &types.HopEvent{HopID: "h", Timestamp: 120_000, Duration: duration, HasError: hasError}
+	}
+
+	tests := []struct {
+		name      string
+		events    []*types.HopEvent
+		signs     []int64
+		wantInc   bson.M
+		wantRange []int64 // min and max, nil when the update must not touch them
+	}{
+		{
+			"added events",
+			[]*types.HopEvent{event(100, false), event(300, true)},
+			[]int64{1, 1},
+			bson.M{"count": int64(2), "error_count": int64(1), "latency_sum": int64(400)},
+			[]int64{100, 300},
+		},
+		{
+			"take back only",
+			[]*types.HopEvent{event(100, true)},
+			[]int64{-1},
+			bson.M{"count": int64(-1), "error_count": int64(-1), "latency_sum": int64(-100)},
+			nil,
+		},
+		{
+			"take back does not narrow the range",
+			[]*types.HopEvent{event(5, false), event(200, false)},
+			[]int64{-1, 1},
+			bson.M{"count": int64(0), "error_count": int64(0), "latency_sum": int64(195)},
+			[]int64{200, 200},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewRollupWriter()
+			for i, he := range tt.events {
+				w.AddHopEvent(he, tt.signs[i])
+			}
+			d := w.deltas["minute|h|120000"]
+			if d == nil {
+				t.Fatalf("no minute delta in %v", w.deltas)
+			}
+			update := d.update()
+			inc := update["$inc"].(bson.M)
+			for k, v := range tt.wantInc {
+				if inc[k] != v {
+					t.Errorf("$inc.%s = %v, want %v", k, inc[k], v)
+				}
+			}
+			lo, hasMin := update["$min"]
+			hi, hasMax := update["$max"]
+			if tt.wantRange == nil {
+				if hasMin || hasMax {
+					t.Errorf("update sets the range %v %v, want none", lo, hi)
+				}
+				return
+			}
+			if !reflect.DeepEqual(lo, bson.M{"latency_min": tt.wantRange[0]}) || !reflect.DeepEqual(hi, bson.M{"latency_max": tt.wantRange[1]}) {
+				t.Errorf("range = %v %v, want %v", lo, hi, tt.wantRange)
+			}
+		})
+	}
+}
+
+func TestRollupRequeueDropsAfterMaxAttempts(t *testing.T) {
+	defer func(enabled bool, attempts int) { *rollupEnabled, *rollupAttempts = enabled, attempts }(*rollupEnabled, *rollupAttempts)
+	*rollupEnabled, *rollupAttempts = true, 3
+
+	w := NewRollupWriter()
+	w.AddHopEvent(&types.HopEvent{HopID: "h", Timestamp: 120_000, Duration: 10}, 1)
+	for flush := 1; flush <= 3; flush++ {
+		deltas := w.deltas
+		w.deltas = make(map[string]*rollupDelta)
+		ids := make([]string, 0, len(deltas))
+		for id := range deltas {
+			ids = append(ids, id)
+		}
+		kept := w.requeue(deltas, ids)
+		want := len(ids)
+		if flush == 3 {
+			want = 0
+		}
+		if kept != want || len(w.deltas) != want {
+			t.Fatalf("flush %d kept %d deltas with %d pending, want %d", flush, kept, len(w.deltas), want)
+		}
+	}
+
+	// a delta merged into a newer one keeps its attempts
+	w.AddHopEvent(&types.HopEvent{HopID: "h", Timestamp: 120_000, Duration: 10}, 1)
+	w.merge("minute|h|120000", &rollupDelta{count: 1, attempts: 2})
+	if d := w.deltas["minute|h|120000"]; d.attempts != 2 || d.count != 2 {
+		t.Errorf("merged delta has %d attempts and count %d, want 2 and 2", d.attempts, d.count)
+	}
+}
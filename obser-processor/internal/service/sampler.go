@@ -0,0 +1,162 @@
+package service
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"kuroko.com/processor/internal/config"
+	"kuroko.com/processor/internal/types"
+)
+
+var (
+	samplingEnabled  = flag.Bool("sampling.enabled", false, "Store spans of sampled traces only, path and hop events are written for every trace")
+	keepErrors       = flag.Bool("sampling.keep-errors", true, "Always keep traces with an error span")
+	latencyThreshold = flag.Duration("sampling.latency-threshold", 0, "Always keep traces whose root span is at least this long, 0 disables the policy")
+	samplingRate     = flag.Float64("sampling.rate", 1, "Probability of keeping a trace that no other policy keeps")
+	operationRates   = flag.String("sampling.operation-rates", "", "Per root operation probabilities overriding sampling.rate, e.g. SERVICE_OPERATION=0.1,OTHER_OPERATION=0.5")
+	pathRateLimit    = flag.Float64("sampling.path-rate-limit", 0, "Maximum traces per second kept per path by sampling.rate, 0 means unlimited")
+)
+
+var sampledCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pipeline_traces_sampled_total",
+		Help: "Tổng số trace theo quyết định lấy mẫu",
+	},
+	[]string{"decision", "policy"},
+)
+
+// errSampledOut marks late spans of a trace whose spans were not stored
+var errSampledOut = errors.New("trace was sampled out")
+
+func init() {
+	config.Validate(func() error {
+		if *samplingRate < 0 || *samplingRate > 1 {
+			return errors.New("sampling.rate must be between 0 and 1")
+		}
+		if *pathRateLimit < 0 {
+			return errors.New("sampling.path-rate-limit must not be negative")
+		}
+		if *latencyThreshold < 0 {
+			return errors.New("sampling.latency-threshold must not be negative")
+		}
+		_, err := parseOperationRates(*operationRates)
+		return err
+	})
+}
+
+// Sampler decides which complete traces have their spans stored. Policies are tried in
+// order: errors, latency, then the probability of the root operation capped by the
+// rate limit of the path.
+type Sampler struct {
+	enabled    bool
+	keepErrors bool
+	latency    time.Duration
+	rate       float64
+	operations map[string]float64
+	limit      float64
+
+	mu      sync.Mutex
+	buckets map[uint64]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewSampler builds a sampler from the sampling flags
+func NewSampler() *Sampler {
+	operations, _ := parseOperationRates(*operationRates)
+	return &Sampler{
+		enabled:    *samplingEnabled,
+		keepErrors: *keepErrors,
+		latency:    *latencyThreshold,
+		rate:       *samplingRate,
+		operations: operations,
+		limit:      *pathRateLimit,
+		buckets:    make(map[uint64]*tokenBucket),
+	}
+}
+
+// Sample reports whether the spans of the trace should be stored and the policy that decided
+func (sp *Sampler) Sample(trace []*types.SpanResponse, root *types.GraphNode, pathId uint64) (bool, string) {
+	if !sp.enabled {
+		return true, "disabled"
+	}
+	if sp.keepErrors {
+		for _, sr := range trace {
+			if isSpanError(sr) {
+				return true, "error"
+			}
+		}
+	}
+	// span durations are in microseconds
+	if sp.latency > 0 && time.Duration(root.Span.Duration)*time.Microsecond >= sp.latency {
+		return true, "latency"
+	}
+
+	rate, ok := sp.operations[generateOperationID(root.Span)]
+	if !ok {
+		rate = sp.rate
+	}
+	// the draw depends on the trace id only, so a redelivered trace gets the same decision
+	if float64(HashCode64(root.Span.TraceID)>>11)/(1<<53) >= rate {
+		return false, "probabilistic"
+	}
+	if !sp.take(pathId) {
+		return false, "rate-limit"
+	}
+	return true, "probabilistic"
+}
+
+// take spends a token of the path bucket, buckets hold up to one second of traces
+func (sp *Sampler) take(pathId uint64) bool {
+	if sp.limit <= 0 {
+		return true
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	now := time.Now()
+	b, ok := sp.buckets[pathId]
+	if !ok {
+		b = &tokenBucket{tokens: math.Max(sp.limit, 1), last: now}
+		sp.buckets[pathId] = b
+	}
+	b.tokens = math.Min(math.Max(sp.limit, 1), b.tokens+now.Sub(b.last).Seconds()*sp.limit)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// parseOperationRates parses OPERATION_ID=rate pairs separated by commas, operation
+// ids are matched case-insensitively
+func parseOperationRates(value string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("sampling.operation-rates: %q is not OPERATION=rate", pair)
+		}
+		rate, err := strconv.ParseFloat(pair[i+1:], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("sampling.operation-rates: rate of %q must be between 0 and 1", pair[:i])
+		}
+		rates[strings.ToUpper(pair[:i])] = rate
+	}
+	return rates, nil
+}
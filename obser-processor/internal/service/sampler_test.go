@@ -0,0 +1,33 @@
+package service
+
+import (
+	"testing"
+
+	"kuroko.com/processor/internal/types"
+)
+
+func TestSamplerKeepsErrorSpans(t *testing.T) {
+	sp := &Sampler{enabled: true, keepErrors: true, rate: 0, buckets: make(map[uint64]*tokenBucket)}
+	tests := []struct {
+		name string
+		tags map[string]string
+		keep bool
+	}{
+		{"error message", map[string]string{"error": "timeout"}, true},
+		{"error flag", map[string]string{"error": "true"}, true},
+		{"error.message only", map[string]string{"error.message": "boom"}, true},
+		{"empty error tag", map[string]string{"error": ""}, false},
+		{"error false", map[string]string{"error": "false"}, false},
+		{"no error", map[string]string{"http.status_code": "200"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			child := &types.SpanResponse{TraceID: "t", ID: "2", ParentID: "1", Tags: tt.tags}
+			root := &types.SpanResponse{TraceID: "t", ID: "1", Tags: map[string]string{}}
+			keep, _ := sp.Sample([]*types.SpanResponse{root, child}, &types.GraphNode{Span: root}, 1)
+			if keep != tt.keep || isSpanError(child) != tt.keep {
+				t.Errorf("Sample() kept %v, isSpanError %v, want %v", keep, isSpanError(child), tt.keep)
+			}
+		})
+	}
+}
@@ -25,11 +25,25 @@ var pathEventCollection *qmgo.Collection
 var spanCollection *qmgo.Collection
 var pathIdCollection *qmgo.Collection
 var pathCollection *qmgo.Collection
+var spanBufferCollection *qmgo.Collection
+var apiRollupCollection *qmgo.Collection
+var pathRollupCollection *qmgo.Collection
+var hopRollupCollection *qmgo.Collection
+
+// bulkWriter batches the writes of trace processing
+var bulkWriter = NewBulkWriter()
+
+// rollupWriter batches the increments of the rollup collections
+var rollupWriter = NewRollupWriter()
+
+// sampler decides which traces have their spans stored
+var sampler *Sampler
 
 func NewService(db *qmgo.Database) *Service {
 	s := &Service{db}
 
 	s.init()
+	sampler = NewSampler()
 
 	httpLogEntryCollection = s.Collection("http_log_entry")
 	alertGetCollection = s.Collection("alert_get")
@@ -46,5 +60,9 @@ func NewService(db *qmgo.Database) *Service {
 	pathCollection = s.Collection("path")
 	spanCollection = s.Collection("span")
 	pathIdCollection = s.Collection("path_id")
+	spanBufferCollection = s.Collection("span_buffer")
+	apiRollupCollection = s.Collection("api_rollup")
+	pathRollupCollection = s.Collection("path_rollup")
+	hopRollupCollection = s.Collection("hop_rollup")
 	return s
 }
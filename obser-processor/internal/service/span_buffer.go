@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"kuroko.com/processor/internal/config"
+	"kuroko.com/processor/internal/types"
+)
+
+var (
+	bufferBackend  = flag.String("buffer.backend", "memory", "Backing store for buffered spans: memory or mongo")
+	bufferAttempts = flag.Int("buffer.max-attempts", 5, "Attempts at processing a trace held by a durable buffer before it waits for the next start")
+)
+
+var bufferRetryCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pipeline_trace_retries_total",
+		Help: "Tổng số trace xử lý thất bại được thử lại, theo kết quả",
+	},
+	[]string{"decision"},
+)
+
+func init() {
+	config.Validate(func() error {
+		if *bufferAttempts < 1 {
+			return errors.New("buffer.max-attempts must be at least 1")
+		}
+		_, err := NewSpanBackend(*bufferBackend)
+		return err
+	})
+}
+
+// SpanBackend persists spans buffered in TraceStore so they survive a restart
+type SpanBackend interface {
+	// Durable reports whether saved spans survive a process restart
+	Durable() bool
+	// Save persists the spans of one message in a single write
+	Save(ctx context.Context, spans []*tracepb.Span) error
+	Delete(ctx context.Context, traceID string) error
+	Load(ctx context.Context) (map[string][]*tracepb.Span, error)
+}
+
+// NewSpanBackend returns the backend registered under name
+func NewSpanBackend(name string) (SpanBackend, error) {
+	switch name {
+	case "", "memory":
+		return memoryBackend{}, nil
+	case "mongo":
+		return mongoBackend{}, nil
+	default:
+		return nil, fmt.Errorf("unknown buffer backend %q", name)
+	}
+}
+
+// memoryBackend keeps nothing outside of TraceStore, spans are lost on crash
+type memoryBackend struct{}
+
+func (memoryBackend) Durable() bool { return false }
+
+func (memoryBackend) Save(ctx context.Context, spans []*tracepb.Span) error {
+	return nil
+}
+
+func (memoryBackend) Delete(ctx context.Context, traceID string) error {
+	return nil
+}
+
+func (memoryBackend) Load(ctx context.Context) (map[string][]*tracepb.Span, error) {
+	return map[string][]*tracepb.Span{}, nil
+}
+
+// mongoBackend stages spans in the span_buffer collection until their trace is processed
+type mongoBackend struct{}
+
+func (mongoBackend) Durable() bool { return true }
+
+func (mongoBackend) Save(ctx context.Context, spans []*tracepb.Span) error {
+	docs := make([]types.BufferedSpan, 0, len(spans))
+	now := time.Now().UnixMilli()
+	for _, span := range spans {
+		data, err := proto.Marshal(span)
+		if err != nil {
+			return err
+		}
+		traceID := fmt.Sprintf("%x", span.TraceId)
+		docs = append(docs, types.BufferedSpan{
+			ID:         traceID + "_" + fmt.Sprintf("%x", span.SpanId),
+			TraceID:    traceID,
+			Data:       data,
+			ReceivedAt: now,
+		})
+	}
+	// spans are replaced by id so a redelivered message is saved once
+	return writeBulk(ctx, spanBufferCollection, len(docs), func(b *qmgo.Bulk) {
+		for _, doc := range docs {
+			b.UpsertId(doc.ID, doc)
+		}
+	})
+}
+
+func (mongoBackend) Delete(ctx context.Context, traceID string) error {
+	_, err := spanBufferCollection.RemoveAll(ctx, bson.M{"trace_id": traceID})
+	return err
+}
+
+func (mongoBackend) Load(ctx context.Context) (map[string][]*tracepb.Span, error) {
+	var docs []types.BufferedSpan
+	err := spanBufferCollection.Find(ctx, bson.M{}).Sort("received_at").All(&docs)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]*tracepb.Span)
+	for _, doc := range docs {
+		var span tracepb.Span
+		if err := proto.Unmarshal(doc.Data, &span); err != nil {
+			return nil, fmt.Errorf("failed to decode buffered span %s: %w", doc.ID, err)
+		}
+		res[doc.TraceID] = append(res[doc.TraceID], &span)
+	}
+	return res, nil
+}
@@ -2,115 +2,229 @@ package service
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
 	"time"
 
+	"github.com/qiniu/qmgo"
 	"go.mongodb.org/mongo-driver/bson"
+	"kuroko.com/processor/internal/config"
 	"kuroko.com/processor/internal/types"
 )
 
-func (s *Service) UpdateDataStatistic(ctx context.Context) error {
-	yesterday := time.Now().AddDate(0, 0, -1).Local().Format("20060102")
+// statisticDateLayout is the layout of start_time_date and of the statistic dates
+const statisticDateLayout = "20060102"
+
+var (
+	statisticTimezone    = flag.String("statistic.timezone", "Local", "Timezone days and hours of the daily statistics are cut in, e.g. Asia/Ho_Chi_Minh")
+	statisticDelay       = flag.Duration("statistic.delay", 10*time.Minute, "How long after midnight a day is aggregated, for late http logs to arrive")
+	statisticCatchUpDays = flag.Int("statistic.catch-up-days", 7, "Past days the statistic job aggregates when they are missing")
+)
+
+// statisticLocation is the loaded statistic.timezone
+var statisticLocation = time.Local
 
-	sd := []types.StatisticDone{}
-	statisticDoneCollection.Find(ctx, bson.M{"_id": yesterday}).All(&sd)
-	if len(sd) > 0 {
+func init() {
+	config.Validate(func() error {
+		loc, err := time.LoadLocation(*statisticTimezone)
+		if err != nil {
+			return fmt.Errorf("statistic.timezone: %w", err)
+		}
+		statisticLocation = loc
+		if *statisticDelay < 0 {
+			return errors.New("statistic.delay must not be negative")
+		}
+		if *statisticCatchUpDays < 1 {
+			return errors.New("statistic.catch-up-days must be at least 1")
+		}
 		return nil
-	}
+	})
+}
+
+// statisticDate is the day of a millisecond timestamp in statistic.timezone
+func statisticDate(ms int64) string {
+	return time.UnixMilli(ms).In(statisticLocation).Format(statisticDateLayout)
+}
 
-	entries := []types.HttpLogEntry{}
-	httpLogEntryCollection.Find(ctx, bson.M{"start_time_date": yesterday}).Sort("start_time").All(&entries)
-
-	svcList := []types.ServiceObject{}
-	svcObjectCollection.Find(ctx, bson.M{}).All(&svcList)
-	svcStatistic := []types.ServiceStatisticObject{}
-	for _, so := range svcList {
-		svcStatistic = append(svcStatistic, types.ServiceStatisticObject{
-			ID:          so.ServiceName + "*" + yesterday,
-			Date:        yesterday,
-			ServiceName: so.ServiceName,
-			Statistic:   map[int]int64{}})
-	}
-	uriList := []types.URIObject{}
-	uriObjectCollection.Find(ctx, bson.M{}).All(&uriList)
-	uriStatistic := []types.URIStatisticObject{}
-	for _, u := range uriList {
-		if u.Method == "GET" {
+// UpdateDataStatistic aggregates the last statistic.catch-up-days complete days that
+// are not marked in statistic_done yet
+func (s *Service) UpdateDataStatistic(ctx context.Context) error {
+	today := time.Now().Add(-*statisticDelay).In(statisticLocation)
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, statisticLocation)
+	for i := *statisticCatchUpDays; i >= 1; i-- {
+		day := today.AddDate(0, 0, -i)
+		n, err := statisticDoneCollection.Find(ctx, bson.M{"_id": day.Format(statisticDateLayout)}).Count()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
 			continue
 		}
-		uriStatistic = append(uriStatistic, types.URIStatisticObject{
-			ID:          u.ServiceName + "*" + u.URIPath + "*" + u.Method + "*" + yesterday,
-			Date:        yesterday,
-			ServiceName: u.ServiceName,
-			URIPath:     u.URIPath,
-			Method:      u.Method,
-			Statistic:   map[int]int64{}})
+		if err := s.updateDayStatistic(ctx, day); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillStatistics recomputes the statistics of every day from from to to, both
+// included and formatted 2006-01-02, whether they were done or not
+func (s *Service) BackfillStatistics(ctx context.Context, from, to string) error {
+	first, err := time.ParseInLocation(time.DateOnly, from, statisticLocation)
+	if err != nil {
+		return fmt.Errorf("invalid from: %w", err)
+	}
+	last, err := time.ParseInLocation(time.DateOnly, to, statisticLocation)
+	if err != nil {
+		return fmt.Errorf("invalid to: %w", err)
+	}
+	if last.Before(first) {
+		return errors.New("to must not be before from")
+	}
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		if err := s.updateDayStatistic(ctx, day); err != nil {
+			return fmt.Errorf("%s: %w", day.Format(statisticDateLayout), err)
+		}
+		log.Printf("Statistics of %s recomputed", day.Format(statisticDateLayout))
 	}
+	return nil
+}
+
+// updateDayStatistic aggregates the http logs of the day starting at day, in
+// statistic.timezone, into the service and uri statistics and marks the day done.
+// Documents are replaced by id so a day can be recomputed
+func (s *Service) updateDayStatistic(ctx context.Context, day time.Time) error {
+	date := day.Format(statisticDateLayout)
+	start, end := day.UnixMilli(), day.AddDate(0, 0, 1).UnixMilli()
+
+	svcStatistic := make(map[string]*types.ServiceStatisticObject)
+	uriStatistic := make(map[string]*types.URIStatisticObject)
 	entriesAlert := []types.HttpLogEntry{}
-	for _, hle := range entries {
+	cursor := httpLogEntryCollection.Find(ctx, bson.M{"start_time": bson.M{"$gte": start, "$lt": end}}).Sort("start_time").Cursor()
+	defer cursor.Close()
+	var hle types.HttpLogEntry
+	for cursor.Next(&hle) {
+		svcId := hle.ServiceName + "*" + date
+		sso, ok := svcStatistic[svcId]
+		if !ok {
+			sso = &types.ServiceStatisticObject{ID: svcId, Date: date, ServiceName: hle.ServiceName, Statistic: map[int]int64{}}
+			svcStatistic[svcId] = sso
+		}
 		if hle.Method == "GET" {
 			entriesAlert = append(entriesAlert, hle)
+			hle = types.HttpLogEntry{}
 			continue
 		}
 
-		// !TODO
-		hour := time.Unix(hle.StartTime/1000, 0).Hour()
-		serviceName := hle.ServiceName
-		uriPath := hle.URIPath
-		method := hle.Method
-		date := hle.StartTimeDate
-
-		for _, sso := range svcStatistic {
-			if sso.ID == serviceName+"*"+date {
-				sso.Statistic[hour] += 1
-			}
-		}
-
-		for _, uso := range uriStatistic {
-			if uso.ID == serviceName+"*"+uriPath+"*"+method+"*"+date {
-				uso.Statistic[hour] += 1
-			}
+		hour := time.UnixMilli(hle.StartTime).In(statisticLocation).Hour()
+		uriId := hle.ServiceName + "*" + hle.URIPath + "*" + hle.Method + "*" + date
+		uso, ok := uriStatistic[uriId]
+		if !ok {
+			uso = &types.URIStatisticObject{ID: uriId, Date: date, ServiceName: hle.ServiceName, URIPath: hle.URIPath, Method: hle.Method, Statistic: map[int]int64{}}
+			uriStatistic[uriId] = uso
 		}
+		sso.Statistic[hour]++
+		uso.Statistic[hour]++
+		hle = types.HttpLogEntry{}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if err := s.UpdateDataAlertGet(ctx, entriesAlert); err != nil {
+		return err
 	}
-	go s.UpdateDataAlertGet(ctx, entriesAlert)
 
-	_, err := serviceStatisticObjectCollection.InsertMany(ctx, svcStatistic)
+	err := writeBulk(ctx, serviceStatisticObjectCollection, len(svcStatistic), func(b *qmgo.Bulk) {
+		for id, sso := range svcStatistic {
+			b.UpsertId(id, sso)
+		}
+	})
 	if err != nil {
 		return err
 	}
-	_, err = uriStatisticObjectCollection.InsertMany(ctx, uriStatistic)
+	err = writeBulk(ctx, uriStatisticObjectCollection, len(uriStatistic), func(b *qmgo.Bulk) {
+		for id, uso := range uriStatistic {
+			b.UpsertId(id, uso)
+		}
+	})
 	if err != nil {
 		return err
 	}
-	_, err = statisticDoneCollection.UpsertId(ctx, yesterday, types.StatisticDone{Date: yesterday})
+	// a recomputed day drops what is no longer in its logs
+	svcIds := make([]string, 0, len(svcStatistic))
+	for id := range svcStatistic {
+		svcIds = append(svcIds, id)
+	}
+	if _, err := serviceStatisticObjectCollection.RemoveAll(ctx, bson.M{"date": date, "_id": bson.M{"$nin": svcIds}}); err != nil {
+		return err
+	}
+	uriIds := make([]string, 0, len(uriStatistic))
+	for id := range uriStatistic {
+		uriIds = append(uriIds, id)
+	}
+	if _, err := uriStatisticObjectCollection.RemoveAll(ctx, bson.M{"date": date, "_id": bson.M{"$nin": uriIds}}); err != nil {
+		return err
+	}
+	if err := s.updateStatisticObjects(ctx, svcStatistic, uriStatistic); err != nil {
+		return err
+	}
+
+	_, err = statisticDoneCollection.UpsertId(ctx, date, types.StatisticDone{Date: date})
+	return err
+}
+
+// updateStatisticObjects keeps the services and APIs seen in the statistics in
+// service_object and uri_object
+func (s *Service) updateStatisticObjects(ctx context.Context, svcStatistic map[string]*types.ServiceStatisticObject, uriStatistic map[string]*types.URIStatisticObject) error {
+	err := writeBulk(ctx, svcObjectCollection, len(svcStatistic), func(b *qmgo.Bulk) {
+		for _, sso := range svcStatistic {
+			b.Upsert(bson.M{"service_name": sso.ServiceName}, types.ServiceObject{ServiceName: sso.ServiceName})
+		}
+	})
 	if err != nil {
 		return err
 	}
-	return nil
+	return writeBulk(ctx, uriObjectCollection, len(uriStatistic), func(b *qmgo.Bulk) {
+		for _, uso := range uriStatistic {
+			b.Upsert(bson.M{"service_name": uso.ServiceName, "uri_path": uso.URIPath, "method": uso.Method}, types.URIObject{
+				ID:          uso.ServiceName + "*" + uso.URIPath + "*" + uso.Method,
+				ServiceName: uso.ServiceName,
+				URIPath:     uso.URIPath,
+				Method:      uso.Method,
+			})
+		}
+	})
 }
 
+// UpdateDataAlertGet records the GET APIs called again by the same user from the same
+// referer within 30 seconds, the logs are sorted by start_time. Only the computed
+// fields are written so the ignore flag set by users survives a recomputed day
 func (s *Service) UpdateDataAlertGet(ctx context.Context, http_logs []types.HttpLogEntry) error {
-	mapTime := make(map[string]int)
+	mapTime := make(map[string]int64)
+	alerts := make(map[string]types.HttpLogEntry)
 	for _, hle := range http_logs {
 		key := hle.ServiceName + "*" + hle.URIPath + "*" + hle.UserId + "*" + hle.Referer
-		time := mapTime[key]
-		if time == 0 {
-			mapTime[key] = int(hle.StartTime)
-		} else {
-			if hle.StartTime/1000-int64(time) < 30 { // goi cung 1 api trong 30s
-				id := hle.ServiceName + "*" + hle.URIPath + "*" + hle.Referer
-				_, err := alertGetCollection.UpsertId(ctx, id, types.AlertGetObject{
-					ID:          id,
-					URIPath:     hle.URIPath,
-					Referer:     hle.Referer,
-					ServiceName: hle.ServiceName,
-					Entry:       hle,
-				})
-				if err != nil {
-					return err
-				}
-			}
-			mapTime[key] = int(hle.StartTime)
+		last, ok := mapTime[key]
+		mapTime[key] = hle.StartTime
+		if !ok || hle.StartTime-last >= 30*1000 { // goi cung 1 api trong 30s
+			continue
 		}
+		alerts[hle.ServiceName+"*"+hle.URIPath+"*"+hle.Referer] = hle
 	}
-	return nil
+	return writeBulk(ctx, alertGetCollection, len(alerts), func(b *qmgo.Bulk) {
+		for id, hle := range alerts {
+			b.UpsertOne(bson.M{"_id": id}, bson.M{
+				"$set": bson.M{
+					"id":           id,
+					"uri_path":     hle.URIPath,
+					"referer":      hle.Referer,
+					"service_name": hle.ServiceName,
+					"entry":        hle,
+				},
+				"$setOnInsert": bson.M{"ignore": false},
+			})
+		}
+	})
 }
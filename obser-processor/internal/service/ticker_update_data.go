@@ -1,17 +1,21 @@
 package service
 
 import (
-	"fmt"
+	"context"
+	"log"
 	"time"
 )
 
-func (s *Service) StartTickerUpdateData(timeInterval int) *time.Ticker {
-	ticker := time.NewTicker(time.Duration(timeInterval) * time.Second)
+// StartTickerUpdateData runs the daily statistic job every interval, a run waits for the
+// previous one to finish
+func (s *Service) StartTickerUpdateData(interval time.Duration) *time.Ticker {
+	ticker := time.NewTicker(interval)
 
 	go func() {
-		for t := range ticker.C {
-			fmt.Println("Tick at ", t)
-			// go s.UpdateDataStatistic(context.Background())
+		for range ticker.C {
+			if err := s.UpdateDataStatistic(context.Background()); err != nil {
+				log.Printf("Failed to update statistics: %v", err)
+			}
 		}
 	}()
 
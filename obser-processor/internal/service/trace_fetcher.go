@@ -2,8 +2,13 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
@@ -19,44 +24,107 @@ var (
 			Help: "Tổng số message",
 		},
 	)
+	dlqCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pipeline_messages_dead_lettered_total",
+			Help: "Tổng số message chuyển sang dead letter",
+		},
+	)
+	repairedCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pipeline_traces_repaired_total",
+			Help: "Tổng số trace bị thiếu span cha được sửa",
+		},
+	)
+	collisionCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pipeline_path_id_collisions_total",
+			Help: "Tổng số path id trùng cho cấu trúc khác nhau",
+		},
+	)
+	droppedCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pipeline_traces_dropped_total",
+			Help: "Tổng số trace bị thiếu span cha bị bỏ qua",
+		},
+	)
 )
 
+// knownPaths caches the canonical forms of path ids whose path is stored
+var knownPaths sync.Map
+
 func (s *Service) init() {
 	prometheus.MustRegister(msgCount)
+	prometheus.MustRegister(dlqCount)
+	prometheus.MustRegister(reconciledCount)
+	prometheus.MustRegister(repairedCount)
+	prometheus.MustRegister(droppedCount)
+	prometheus.MustRegister(collisionCount)
+	prometheus.MustRegister(bulkFlushDuration)
+	prometheus.MustRegister(bulkBatchSize)
+	prometheus.MustRegister(droppedSpanCount)
+	prometheus.MustRegister(traceQueueDepth)
+	prometheus.MustRegister(bufferedSpanCount)
+	prometheus.MustRegister(sampledCount)
+	prometheus.MustRegister(rollupDroppedCount)
+	prometheus.MustRegister(bufferRetryCount)
 }
 
 func (s *Service) ProcessTrace(ctx context.Context, trace []*types.SpanResponse) error {
-	root, err := s.ConvertTraceToGraph(ctx, trace)
+	// late spans of an already processed trace are merged with the stored ones
+	trace, processed, err := s.mergeStoredSpans(ctx, trace)
+	if err != nil {
+		return err
+	}
+	adoptSharedChildren(trace)
+	root, orphans, err := s.ConvertTraceToGraph(ctx, trace)
 	if err != nil {
 		fmt.Printf("Error when converting trace: %s\n", err.Error())
+		if errors.Is(err, ErrBrokenTrace) {
+			droppedCount.Inc()
+		}
 		return err
 	}
-	pathId, err := s.CaculatePathId(ctx, root, 0)
+	if orphans > 0 {
+		repairedCount.Inc()
+	}
+	pathId, canonical := s.CaculatePathId(ctx, root)
+	pathId, stored, err := s.resolvePathId(ctx, pathId, canonical)
 	if err != nil {
-		fmt.Printf("Error when caculating path id: %s\n", err.Error())
 		return err
 	}
-	if !s.IsPathExist(ctx, pathId) {
-		s.InsertEntityFromGraph(ctx, root, pathId)
-		s.InsertPath(ctx, root, pathId)
-
-		pathIdCollection.InsertOne(ctx, bson.M{"_id": pathId})
+	if processed {
+		if err := s.reconcileTrace(ctx, root.Span.TraceID); err != nil {
+			return err
+		}
+	}
+	if !stored {
+		if err := s.storePath(ctx, root, pathId, canonical); err != nil {
+			return err
+		}
+	}
+	// every trace counts toward path and hop statistics, only sampled ones keep their spans
+	keep, policy := sampler.Sample(trace, root, pathId)
+	if keep {
+		sampledCount.WithLabelValues("kept", policy).Inc()
+	} else {
+		sampledCount.WithLabelValues("dropped", policy).Inc()
+	}
+	s.ProcessGraph(ctx, root, pathId, orphans, !keep)
+	if !keep {
+		return nil
 	}
-	s.ProcessGraph(ctx, root, pathId)
 
 	for _, sr := range trace {
 		span := convertSrToSpan(sr)
 		span.PathID = pathId
-		spanCollection.InsertOne(ctx, span)
+		bulkWriter.AddSpan(span)
 	}
-
-	return err
+	return nil
 }
 
 func convertSrToSpan(sr *types.SpanResponse) *types.Span {
 	var span types.Span
-	_, hasErrorTag := sr.Tags["error"]
-	_, hasErrorMessageTag := sr.Tags["error.message"]
 	span.ID = sr.ID
 	span.TraceID = sr.TraceID
 	span.Service = sr.LocalEndpoint.ServiceName
@@ -64,14 +132,78 @@ func convertSrToSpan(sr *types.SpanResponse) *types.Span {
 	span.Timestamp = sr.Timestamp
 	span.Duration = sr.Duration
 	span.Error = sr.Tags["error"] + sr.Tags["error.message"]
-	span.HasError = hasErrorTag || hasErrorMessageTag
+	span.HasError = isSpanError(sr)
 	span.ParentID = sr.ParentID
+	span.Tags = make([]types.KeyValue, 0, len(sr.Tags))
+	for key, value := range sr.Tags {
+		// the service is already stored on its own
+		if key == "service.name" {
+			continue
+		}
+		span.Tags = append(span.Tags, types.KeyValue{Key: key, Value: value})
+	}
+	sortKeyValues(span.Tags)
+
+	span.Kind = sr.Kind
+	span.StatusCode = sr.StatusCode
+	span.StatusMessage = sr.StatusMessage
+	span.Events = make([]types.SpanEvent, 0, len(sr.Events))
+	for _, event := range sr.Events {
+		name, _ := event["name"].(string)
+		ts, _ := event["timestamp"].(uint64)
+		attrs, _ := event["attributes"].(map[string]any)
+		span.Events = append(span.Events, types.SpanEvent{
+			Name:       name,
+			Timestamp:  int64(ts / 1000),
+			Attributes: toKeyValues(attrs),
+		})
+	}
+	span.Links = make([]types.SpanLink, 0, len(sr.Links))
+	for _, link := range sr.Links {
+		traceID, _ := link["trace_id"].(string)
+		spanID, _ := link["span_id"].(string)
+		attrs, _ := link["attributes"].(map[string]any)
+		span.Links = append(span.Links, types.SpanLink{
+			TraceID:    traceID,
+			SpanID:     spanID,
+			Attributes: toKeyValues(attrs),
+		})
+	}
 	return &span
 }
 
-func (s *Service) InsertPath(ctx context.Context, root *types.GraphNode, pathId uint32) {
+func toKeyValues(attrs map[string]any) []types.KeyValue {
+	kvs := make([]types.KeyValue, 0, len(attrs))
+	for key, value := range attrs {
+		kvs = append(kvs, types.KeyValue{Key: key, Value: fmt.Sprintf("%v", value)})
+	}
+	sortKeyValues(kvs)
+	return kvs
+}
+
+func sortKeyValues(kvs []types.KeyValue) {
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+}
+
+// storePath writes the entities and the path of a path id claimed by resolvePathId,
+// then marks its fingerprint stored. Every write is keyed on the path id, so workers
+// racing on the same new path store it once
+func (s *Service) storePath(ctx context.Context, root *types.GraphNode, pathId uint64, canonical string) error {
+	s.InsertEntityFromGraph(ctx, root, pathId)
+	if err := s.InsertPath(ctx, root, pathId); err != nil {
+		return err
+	}
+	_, err := pathIdCollection.UpsertId(ctx, pathId, types.PathFingerprint{ID: pathId, Canonical: canonical})
+	if err != nil && !qmgo.IsDup(err) {
+		return err
+	}
+	knownPaths.Store(pathId, canonical)
+	return nil
+}
+
+func (s *Service) InsertPath(ctx context.Context, root *types.GraphNode, pathId uint64) error {
 	path := types.Path{
-		ID:                uuid.NewString(),
+		ID:                strconv.FormatUint(pathId, 10),
 		PathID:            pathId,
 		CreatedAt:         root.Span.Timestamp / 1000,
 		Operations:        []types.PathOperation{},
@@ -140,51 +272,84 @@ func (s *Service) InsertPath(ctx context.Context, root *types.GraphNode, pathId
 	processNode(root)
 
 	fmt.Printf("Path created with %d operations and %d hops\n", len(path.Operations), len(path.Hops))
-	pathCollection.InsertOne(ctx, &path)
+	_, err := pathCollection.UpsertId(ctx, path.ID, &path)
+	if err != nil && !qmgo.IsDup(err) {
+		return err
+	}
+	return nil
 }
 
 // insert operation, hop
-func (s *Service) InsertEntityFromGraph(ctx context.Context, root *types.GraphNode, pathId uint32) {
+func (s *Service) InsertEntityFromGraph(ctx context.Context, root *types.GraphNode, pathId uint64) {
 	if root == nil {
 		return
 	}
-	opID := generateOperationID(root.Span)
-	var op types.Operation
-	err := operationCollection.Find(ctx, bson.M{"_id": opID}).One(&op)
-	if err != nil {
-		if qmgo.IsErrNoDocuments(err) {
-			op = types.Operation{
-				ID:      opID,
-				Name:    root.Span.Name,
-				Service: root.Span.LocalEndpoint.ServiceName,
-			}
-			operationCollection.InsertOne(ctx, &op)
-		}
-	}
+	bulkWriter.UpsertOperation(&types.Operation{
+		ID:      generateOperationID(root.Span),
+		Name:    root.Span.Name,
+		Service: root.Span.LocalEndpoint.ServiceName,
+	})
 
 	for _, child := range root.Children {
-		hopID := generateHopID(root, child, pathId)
-		var hop types.Hop
-		err := hopCollection.Find(ctx, bson.M{"_id": hopID}).One(&hop)
+		bulkWriter.UpsertHop(&types.Hop{
+			ID:              generateHopID(root, child, pathId),
+			PathID:          pathId,
+			CallerService:   root.Span.LocalEndpoint.ServiceName,
+			CallerOperation: root.Span.Name,
+			CalledService:   child.Span.LocalEndpoint.ServiceName,
+			CalledOperation: child.Span.Name,
+		})
+		s.InsertEntityFromGraph(ctx, child, pathId)
+	}
+}
+
+// resolvePathId returns the id of the structure: the hashed id, or when another
+// structure already holds it the next free id of its probe sequence, so a collision of
+// the 53-bit ids never merges two structures. Ids are claimed in path_id with their
+// canonical form, stored is false while the path of the id still has to be written
+func (s *Service) resolvePathId(ctx context.Context, pathId uint64, canonical string) (uint64, bool, error) {
+	for attempt := 1; ; attempt++ {
+		fp, err := claimPathId(ctx, pathId, canonical)
 		if err != nil {
-			if qmgo.IsErrNoDocuments(err) {
-				hop = types.Hop{
-					ID:              hopID,
-					PathID:          pathId,
-					CallerService:   root.Span.LocalEndpoint.ServiceName,
-					CallerOperation: root.Span.Name,
-					CalledService:   child.Span.LocalEndpoint.ServiceName,
-					CalledOperation: child.Span.Name,
-				}
-				hopCollection.InsertOne(ctx, &hop)
-			}
+			return 0, false, err
 		}
-		s.InsertEntityFromGraph(ctx, child, pathId)
+		// fingerprints written before canonical forms were recorded match any structure
+		if fp.Canonical == "" || fp.Canonical == canonical {
+			return pathId, !fp.Pending, nil
+		}
+		collisionCount.Inc()
+		log.Printf("Path id collision on %d: %q and %q", pathId, fp.Canonical, canonical)
+		pathId = probePathId(canonical, attempt)
 	}
 }
-func (s *Service) IsPathExist(ctx context.Context, pathId uint32) bool {
-	c, _ := pathIdCollection.Find(ctx, bson.M{"_id": pathId}).Count()
-	return c > 0
+
+// probePathId is the id a structure tries after attempt collisions
+func probePathId(canonical string, attempt int) uint64 {
+	return HashCode64(canonical+"#"+strconv.Itoa(attempt)) & pathIdMask
+}
+
+// claimPathId returns the fingerprint holding the id, claiming it for canonical when
+// it is free
+func claimPathId(ctx context.Context, pathId uint64, canonical string) (*types.PathFingerprint, error) {
+	if known, ok := knownPaths.Load(pathId); ok {
+		return &types.PathFingerprint{ID: pathId, Canonical: known.(string)}, nil
+	}
+	var fp types.PathFingerprint
+	err := pathIdCollection.Find(ctx, bson.M{"_id": pathId}).One(&fp)
+	if qmgo.IsErrNoDocuments(err) {
+		fp = types.PathFingerprint{ID: pathId, Canonical: canonical, Pending: true}
+		if _, err = pathIdCollection.InsertOne(ctx, fp); qmgo.IsDup(err) {
+			// another worker claimed it first
+			err = pathIdCollection.Find(ctx, bson.M{"_id": pathId}).One(&fp)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fp.Pending {
+		knownPaths.Store(pathId, fp.Canonical)
+	}
+	return &fp, nil
 }
 
 func generateOperationID(sr *types.SpanResponse) string {
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"kuroko.com/processor/internal/config"
+)
+
+var (
+	workerCount    = flag.Int("worker.count", 4, "Number of workers processing expired traces")
+	workerQueue    = flag.Int("worker.queue", 1000, "Capacity of the expired trace queue")
+	maxBufferSpans = flag.Int("buffer.max-spans", 200000, "Maximum spans buffered in memory, 0 means unbounded")
+	overflowPolicy = flag.String("buffer.overflow", "spill", "What to do when buffer.max-spans is reached: drop new spans or spill the oldest traces to the workers early")
+)
+
+var (
+	droppedSpanCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pipeline_spans_dropped_total",
+			Help: "Tổng số span bị bỏ do vượt giới hạn bộ đệm",
+		},
+	)
+	traceQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pipeline_trace_queue_depth",
+			Help: "Số trace đang chờ xử lý",
+		},
+	)
+	bufferedSpanCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pipeline_buffered_spans",
+			Help: "Số span đang nằm trong bộ đệm",
+		},
+	)
+)
+
+// expiredTrace is a unit of work for the trace workers
+type expiredTrace struct {
+	traceID string
+	trace   *BufferedTrace
+}
+
+// TraceWorkers processes expired traces from a bounded queue, a full queue blocks
+// whoever enqueues
+type TraceWorkers struct {
+	s     *Service
+	store *TraceStore
+	queue chan expiredTrace
+	wg    sync.WaitGroup
+}
+
+func init() {
+	config.Validate(func() error {
+		if *workerCount <= 0 {
+			return errors.New("worker.count must be positive")
+		}
+		if *workerQueue <= 0 {
+			return errors.New("worker.queue must be positive")
+		}
+		if *maxBufferSpans < 0 {
+			return errors.New("buffer.max-spans must not be negative")
+		}
+		if *bufferTime <= 0 {
+			return errors.New("buffer.time must be positive")
+		}
+		return validateOverflowPolicy(*overflowPolicy)
+	})
+}
+
+func validateOverflowPolicy(policy string) error {
+	switch policy {
+	case "drop", "spill":
+		return nil
+	default:
+		return fmt.Errorf("unknown buffer overflow policy %q", policy)
+	}
+}
+
+// NewTraceWorkers starts count workers
+func (s *Service) NewTraceWorkers(store *TraceStore, count, capacity int) *TraceWorkers {
+	w := &TraceWorkers{
+		s:     s,
+		store: store,
+		queue: make(chan expiredTrace, capacity),
+	}
+	for i := 0; i < count; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for item := range w.queue {
+				traceQueueDepth.Dec()
+				s.flushTrace(context.Background(), store, item.traceID, item.trace)
+			}
+		}()
+	}
+	return w
+}
+
+// Enqueue hands traces to the workers, if ctx is cancelled while the queue is full the
+// remaining traces are processed by the caller
+func (w *TraceWorkers) Enqueue(ctx context.Context, traces map[string]*BufferedTrace) {
+	for traceID, trace := range traces {
+		item := expiredTrace{traceID: traceID, trace: trace}
+		// counted before the send so a worker never takes it out first
+		traceQueueDepth.Inc()
+		select {
+		case w.queue <- item:
+		case <-ctx.Done():
+			traceQueueDepth.Dec()
+			w.s.flushTrace(context.Background(), w.store, traceID, trace)
+		}
+	}
+}
+
+// Close stops accepting traces and waits for the queued ones to be processed
+func (w *TraceWorkers) Close() {
+	close(w.queue)
+	w.wg.Wait()
+}
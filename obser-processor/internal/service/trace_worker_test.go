@@ -0,0 +1,11 @@
+package service
+
+import "testing"
+
+func TestNewTraceWorkersCanBeStartedAgain(t *testing.T) {
+	s := &Service{}
+	store := NewTraceStore(memoryBackend{}, 0)
+	for i := 0; i < 2; i++ {
+		s.NewTraceWorkers(store, 1, 1).Close()
+	}
+}
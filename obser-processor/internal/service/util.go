@@ -12,6 +12,17 @@ func HashCode(str string) uint32 {
 	return h.Sum32()
 }
 
-func (s *Service) isSpanError(span *types.SpanResponse) bool {
-	return span.Tags["error"] != ""
+func HashCode64(str string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(str))
+	return h.Sum64()
+}
+
+// isSpanError is the error flag of a span wherever one is needed: an error tag with a
+// value other than false, or an error message
+func isSpanError(span *types.SpanResponse) bool {
+	if v := span.Tags["error"]; v != "" && v != "false" {
+		return true
+	}
+	return span.Tags["error.message"] != ""
 }
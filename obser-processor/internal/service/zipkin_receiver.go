@@ -0,0 +1,258 @@
+package service
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	zipkinmodel "github.com/openzipkin/zipkin-go/model"
+	"github.com/openzipkin/zipkin-go/proto/zipkin_proto3"
+	v1 "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"kuroko.com/processor/internal/types"
+)
+
+var zipkinAddr = flag.String("zipkin.addr", ":9411", "Listen address of the Zipkin v2 span receiver, empty disables it")
+
+// StartZipkinReceiver serves the Zipkin v2 POST /api/v2/spans endpoint on zipkin.addr,
+// spans are converted to SpanResponse and republished on the span subject like OTLP
+// exports. The returned server is nil when Zipkin is disabled
+func (s *Service) StartZipkinReceiver(js nats.JetStreamContext) *http.Server {
+	if *zipkinAddr == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/spans", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body io.Reader = http.MaxBytesReader(w, req.Body, *otlpMaxBody)
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			body = io.LimitReader(gz, *otlpMaxBody)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var models []*zipkinmodel.SpanModel
+		contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		switch contentType {
+		case "application/x-protobuf":
+			models, err = zipkin_proto3.ParseSpans(data, false)
+		case "", "application/json":
+			err = json.Unmarshal(data, &models)
+		default:
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		spans := make([]*types.SpanResponse, 0, len(models))
+		for _, model := range models {
+			spans = append(spans, convertZipkinToSpanResponse(model))
+		}
+		resourceSpans, err := convertSpanResponsesToOTLP(spans)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := publishResourceSpans(req.Context(), js, resourceSpans); err != nil {
+			log.Printf("Failed to publish Zipkin spans: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	server := &http.Server{Addr: *zipkinAddr, Handler: mux}
+	go func() {
+		log.Printf("Serving Zipkin at %s", *zipkinAddr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start Zipkin receiver: %v", err)
+		}
+	}()
+	return server
+}
+
+// convertZipkinToSpanResponse maps a Zipkin v2 span onto SpanResponse, annotations
+// become events and the remote service is kept as the peer.service tag. The server half
+// of a shared span gets its own id, a child of the client half that reused the id, see
+// adoptSharedChildren for its children
+func convertZipkinToSpanResponse(model *zipkinmodel.SpanModel) *types.SpanResponse {
+	sr := &types.SpanResponse{
+		TraceID:  fmt.Sprintf("%016x%016x", model.TraceID.High, model.TraceID.Low),
+		ID:       model.ID.String(),
+		Name:     model.Name,
+		Kind:     string(model.Kind),
+		Duration: int(model.Duration.Microseconds()),
+		Tags:     make(map[string]string, len(model.Tags)+1),
+		Events:   make([]map[string]any, 0, len(model.Annotations)),
+	}
+	if model.ParentID != nil {
+		sr.ParentID = model.ParentID.String()
+	}
+	if model.Shared {
+		sr.ID, sr.ParentID = sharedSpanID(model.ID), model.ID.String()
+	}
+	if !model.Timestamp.IsZero() {
+		sr.Timestamp = model.Timestamp.UnixMicro()
+	}
+	if model.LocalEndpoint != nil {
+		sr.LocalEndpoint = types.SpanEndpoint{
+			ServiceName: model.LocalEndpoint.ServiceName,
+			Port:        int(model.LocalEndpoint.Port),
+		}
+		if model.LocalEndpoint.IPv4 != nil {
+			sr.LocalEndpoint.IPv4 = model.LocalEndpoint.IPv4.String()
+		}
+	}
+	if sr.LocalEndpoint.ServiceName == "" {
+		sr.LocalEndpoint.ServiceName = "unknown"
+	}
+	for key, value := range model.Tags {
+		sr.Tags[key] = value
+	}
+	if model.RemoteEndpoint != nil && model.RemoteEndpoint.ServiceName != "" {
+		sr.Tags["peer.service"] = model.RemoteEndpoint.ServiceName
+	}
+	for _, a := range model.Annotations {
+		sr.Events = append(sr.Events, map[string]any{
+			"name":      a.Value,
+			"timestamp": uint64(a.Timestamp.UnixNano()),
+		})
+	}
+	return sr
+}
+
+// adoptSharedChildren moves the children of a shared span from the client half to the
+// server half, the server reported them under the id both halves share. It runs on the
+// whole trace since the halves and the children may come in different exports
+func adoptSharedChildren(trace []*types.SpanResponse) {
+	byID := make(map[string]*types.SpanResponse, len(trace))
+	for _, sr := range trace {
+		byID[sr.ID] = sr
+	}
+	for _, sr := range trace {
+		parentID, err := strconv.ParseUint(sr.ParentID, 16, 64)
+		if err != nil {
+			continue
+		}
+		server := byID[sharedSpanID(zipkinmodel.ID(parentID))]
+		if server == nil || server == sr || server.ParentID != sr.ParentID {
+			continue
+		}
+		if server.LocalEndpoint.ServiceName == sr.LocalEndpoint.ServiceName {
+			sr.ParentID = server.ID
+		}
+	}
+}
+
+// sharedSpanID derives the id of the server half of a shared span from the id it
+// shares with the client half, the same span always gets the same id
+func sharedSpanID(id zipkinmodel.ID) string {
+	derived := zipkinmodel.ID(HashCode64("shared:" + id.String()))
+	if derived == 0 || derived == id {
+		derived++
+	}
+	return derived.String()
+}
+
+var zipkinKinds = map[string]tracepb.Span_SpanKind{
+	"CLIENT":   tracepb.Span_SPAN_KIND_CLIENT,
+	"SERVER":   tracepb.Span_SPAN_KIND_SERVER,
+	"PRODUCER": tracepb.Span_SPAN_KIND_PRODUCER,
+	"CONSUMER": tracepb.Span_SPAN_KIND_CONSUMER,
+}
+
+// convertSpanResponsesToOTLP is the inverse of convertSpanToSpanResponse, spans are
+// grouped into one resource per service
+func convertSpanResponsesToOTLP(spans []*types.SpanResponse) ([]*tracepb.ResourceSpans, error) {
+	byService := make(map[string]*tracepb.ScopeSpans)
+	var resourceSpans []*tracepb.ResourceSpans
+	for _, sr := range spans {
+		span, err := convertSpanResponseToOTLP(sr)
+		if err != nil {
+			return nil, err
+		}
+		service := sr.LocalEndpoint.ServiceName
+		ss, ok := byService[service]
+		if !ok {
+			ss = &tracepb.ScopeSpans{}
+			byService[service] = ss
+			resourceSpans = append(resourceSpans, &tracepb.ResourceSpans{
+				Resource: &resourcepb.Resource{
+					Attributes: []*v1.KeyValue{stringAttribute("service.name", service)},
+				},
+				ScopeSpans: []*tracepb.ScopeSpans{ss},
+			})
+		}
+		ss.Spans = append(ss.Spans, span)
+	}
+	return resourceSpans, nil
+}
+
+func convertSpanResponseToOTLP(sr *types.SpanResponse) (*tracepb.Span, error) {
+	traceID, err := hex.DecodeString(sr.TraceID)
+	if err != nil || len(traceID) != 16 {
+		return nil, fmt.Errorf("invalid trace id %q", sr.TraceID)
+	}
+	spanID, err := hex.DecodeString(sr.ID)
+	if err != nil || len(spanID) != 8 {
+		return nil, fmt.Errorf("invalid span id %q", sr.ID)
+	}
+	span := &tracepb.Span{
+		TraceId:           traceID,
+		SpanId:            spanID,
+		Name:              sr.Name,
+		Kind:              zipkinKinds[strings.ToUpper(sr.Kind)],
+		StartTimeUnixNano: uint64(sr.Timestamp) * 1000,
+		EndTimeUnixNano:   uint64(sr.Timestamp+int64(sr.Duration)) * 1000,
+	}
+	if sr.ParentID != "" {
+		if span.ParentSpanId, err = hex.DecodeString(sr.ParentID); err != nil {
+			return nil, fmt.Errorf("invalid parent id %q", sr.ParentID)
+		}
+	}
+	for key, value := range sr.Tags {
+		span.Attributes = append(span.Attributes, stringAttribute(key, value))
+	}
+	if isSpanError(sr) {
+		span.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: sr.Tags["error"]}
+	}
+	for _, event := range sr.Events {
+		name, _ := event["name"].(string)
+		ts, _ := event["timestamp"].(uint64)
+		span.Events = append(span.Events, &tracepb.Span_Event{Name: name, TimeUnixNano: ts})
+	}
+	return span, nil
+}
+
+func stringAttribute(key, value string) *v1.KeyValue {
+	return &v1.KeyValue{
+		Key:   key,
+		Value: &v1.AnyValue{Value: &v1.AnyValue_StringValue{StringValue: value}},
+	}
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"testing"
+
+	zipkinmodel "github.com/openzipkin/zipkin-go/model"
+	"kuroko.com/processor/internal/types"
+)
+
+func TestConvertZipkinSharedSpan(t *testing.T) {
+	traceID := zipkinmodel.TraceID{Low: 1}
+	parent := zipkinmodel.ID(1)
+	client := &zipkinmodel.SpanModel{
+		SpanContext: zipkinmodel.SpanContext{TraceID: traceID, ID: 2, ParentID: &parent},
+		Kind:        zipkinmodel.Client,
+	}
+	server := &zipkinmodel.SpanModel{
+		SpanContext: zipkinmodel.SpanContext{TraceID: traceID, ID: 2, ParentID: &parent},
+		Kind:        zipkinmodel.Server,
+		Shared:      true,
+	}
+
+	tests := []struct {
+		name     string
+		model    *zipkinmodel.SpanModel
+		id       string
+		parentID string
+	}{
+		{"client half keeps the id", client, "0000000000000002", "0000000000000001"},
+		{"server half is a child of the client half", server, sharedSpanID(2), "0000000000000002"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr := convertZipkinToSpanResponse(tt.model)
+			if sr.ID != tt.id || sr.ParentID != tt.parentID {
+				t.Errorf("got id %s parent %s, want id %s parent %s", sr.ID, sr.ParentID, tt.id, tt.parentID)
+			}
+		})
+	}
+
+	if id := sharedSpanID(2); id == "0000000000000002" || len(id) != 16 || id != sharedSpanID(2) {
+		t.Errorf("sharedSpanID(2) = %s, want a stable 16 hex digit id other than the shared one", id)
+	}
+}
+
+func TestAdoptSharedChildren(t *testing.T) {
+	span := func(id, parentID, service string) *types.SpanResponse {
+		return &types.SpanResponse{ID: id, ParentID: parentID, LocalEndpoint: types.SpanEndpoint{ServiceName: service}}
+	}
+	shared := sharedSpanID(2)
+	trace := []*types.SpanResponse{
+		span("0000000000000001", "", "web"),
+		span("0000000000000002", "0000000000000001", "web"),   // client half
+		span(shared, "0000000000000002", "api"),               // server half
+		span("0000000000000003", "0000000000000002", "api"),   // reported by the server
+		span("0000000000000004", "0000000000000002", "web"),   // reported by the client
+		span("0000000000000005", "0000000000000003", "api"),   // grandchild keeps its parent
+		span("0000000000000006", "0000000000000001", "batch"), // parent is not shared
+	}
+	adoptSharedChildren(trace)
+
+	want := map[string]string{
+		"0000000000000002": "0000000000000001",
+		shared:             "0000000000000002",
+		"0000000000000003": shared,
+		"0000000000000004": "0000000000000002",
+		"0000000000000005": "0000000000000003",
+		"0000000000000006": "0000000000000001",
+	}
+	for _, sr := range trace[1:] {
+		if sr.ParentID != want[sr.ID] {
+			t.Errorf("span %s has parent %s, want %s", sr.ID, sr.ParentID, want[sr.ID])
+		}
+	}
+}
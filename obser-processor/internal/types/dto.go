@@ -12,6 +12,8 @@ type SpanResponse struct {
 	Events        []map[string]any  `json:"events"`
 	Links         []map[string]any  `json:"links"`
 	Tags          map[string]string `json:"tags"`
+	StatusCode    string            `json:"statusCode"`
+	StatusMessage string            `json:"statusMessage"`
 }
 type SpanEndpoint struct {
 	ServiceName string `json:"serviceName"`
@@ -19,15 +19,17 @@ type ServiceObject struct {
 	ServiceName string `json:"service_name" bson:"service_name"`
 }
 
+// ServiceStatisticObject counts the non-GET requests of a service by hour of a day
 type ServiceStatisticObject struct {
-	ID          string        `json:"id" bson:"id"`
+	ID          string        `json:"id" bson:"_id"`
 	Date        string        `json:"date" bson:"date"`
 	ServiceName string        `json:"service_name" bson:"service_name"`
 	Statistic   map[int]int64 `json:"statistic" bson:"statistic"`
 }
 
+// URIStatisticObject counts the requests of a non-GET API by hour of a day
 type URIStatisticObject struct {
-	ID          string        `json:"id" bson:"id"`
+	ID          string        `json:"id" bson:"_id"`
 	Date        string        `json:"date" bson:"date"`
 	URIPath     string        `json:"uri_path" bson:"uri_path"`
 	ServiceName string        `json:"service_name" bson:"service_name"`
@@ -41,6 +43,7 @@ type StatisticDone struct {
 }
 
 type HttpLogEntry struct {
+	ID            string `json:"-" bson:"_id,omitempty"`
 	ServiceName   string `json:"service_name" bson:"service_name"`
 	URIPath       string `json:"uri_path" bson:"uri_path"`
 	Referer       string `json:"referer" bson:"referer"`
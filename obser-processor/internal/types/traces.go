@@ -6,28 +6,59 @@ type Time struct {
 }
 
 type Span struct {
-	ID        string `json:"id" bson:"_id"`
-	TraceID   string `json:"trace_id" bson:"trace_id"`
-	PathID    uint32 `json:"path_id" bson:"path_id"`
-	ParentID  string `json:"parent_id" bson:"parent_id"`
-	Service   string `json:"service" bson:"service"`
-	Operation string `json:"operation" bson:"operation"`
-	Timestamp int64  `json:"timestamp" bson:"timestamp"` // milisecond
-	Duration  int    `json:"duration" bson:"duration"`   // microsecond
-	Error     string `json:"error" bson:"error"`
-	HasError  bool   `json:"has_error" bson:"has_error"`
+	ID        string     `json:"id" bson:"_id"`
+	TraceID   string     `json:"trace_id" bson:"trace_id"`
+	PathID    uint64     `json:"path_id" bson:"path_id"`
+	ParentID  string     `json:"parent_id" bson:"parent_id"`
+	Service   string     `json:"service" bson:"service"`
+	Operation string     `json:"operation" bson:"operation"`
+	Timestamp int64      `json:"timestamp" bson:"timestamp"` // milisecond
+	Duration  int        `json:"duration" bson:"duration"`   // microsecond
+	Error     string     `json:"error" bson:"error"`
+	HasError  bool       `json:"has_error" bson:"has_error"`
+	Tags      []KeyValue `json:"tags" bson:"tags"` // span attributes sorted by key
+
+	Kind          string      `json:"kind" bson:"kind"`
+	StatusCode    string      `json:"status_code" bson:"status_code"`
+	StatusMessage string      `json:"status_message" bson:"status_message"`
+	Events        []SpanEvent `json:"events" bson:"events"`
+	Links         []SpanLink  `json:"links" bson:"links"`
+}
+
+type SpanEvent struct {
+	Name       string     `json:"name" bson:"name"`
+	Timestamp  int64      `json:"timestamp" bson:"timestamp"` // microsecond
+	Attributes []KeyValue `json:"attributes" bson:"attributes"`
+}
+
+type SpanLink struct {
+	TraceID    string     `json:"trace_id" bson:"trace_id"`
+	SpanID     string     `json:"span_id" bson:"span_id"`
+	Attributes []KeyValue `json:"attributes" bson:"attributes"`
+}
+
+// KeyValue is a span tag, tags are stored as a list so keys may contain dots
+type KeyValue struct {
+	Key   string `json:"key" bson:"key"`
+	Value string `json:"value" bson:"value"`
 }
 
 type PathEvent struct {
-	ID        string `json:"id" bson:"_id"`
-	PathID    uint32 `json:"path_id" bson:"path_id"`
-	TraceID   string `json:"trace_id" bson:"trace_id"`
-	Timestamp int64  `json:"timestamp" bson:"timestamp"` // milisecond
+	ID          string `json:"id" bson:"_id"`
+	PathID      uint64 `json:"path_id" bson:"path_id"`
+	TraceID     string `json:"trace_id" bson:"trace_id"`
+	Timestamp   int64  `json:"timestamp" bson:"timestamp"` // milisecond
+	Duration    int    `json:"duration" bson:"duration"`   // microsecond, of the root span
+	HasError    bool   `json:"has_error" bson:"has_error"` // a span of the trace failed
+	Broken      bool   `json:"broken" bson:"broken"`
+	OrphanCount int    `json:"orphan_count" bson:"orphan_count"`
+	SampledOut  bool   `json:"sampled_out" bson:"sampled_out"` // spans of the trace were not stored
 }
 
 type HopEvent struct {
 	ID        string `json:"id" bson:"_id"`
 	HopID     string `json:"hop_id" bson:"hop_id"`
+	TraceID   string `json:"trace_id" bson:"trace_id"`
 	Timestamp int64  `json:"timestamp" bson:"timestamp"` // milisecond
 	Duration  int    `json:"duration" bson:"duration"`   // microsecond
 	HasError  bool   `json:"has_error" bson:"has_error"`
@@ -35,7 +66,7 @@ type HopEvent struct {
 
 type Path struct {
 	ID                string          `json:"id" bson:"_id"`
-	PathID            uint32          `json:"path_id" bson:"path_id"`
+	PathID            uint64          `json:"path_id" bson:"path_id"`
 	CreatedAt         int64           `json:"created_at" bson:"created_at"` // milisecond
 	LongestChain      int             `json:"longest_chain" bson:"longest_chain"`
 	LongestErrorChain int             `json:"longest_error_chain" bson:"longest_error_chain"`
@@ -57,7 +88,7 @@ type PathHop struct {
 
 type Hop struct {
 	ID              string `json:"id" bson:"_id"`
-	PathID          uint32 `json:"path_id" bson:"path_id"`
+	PathID          uint64 `json:"path_id" bson:"path_id"`
 	CallerOperation string `json:"caller_operation" bson:"caller_operation"`
 	CallerService   string `json:"caller_service" bson:"caller_service"`
 	CalledOperation string `json:"called_operation" bson:"called_operation"`
@@ -69,3 +100,16 @@ type Operation struct {
 	Name    string `json:"name" bson:"name"`
 	Service string `json:"service" bson:"service"`
 }
+
+type BufferedSpan struct {
+	ID         string `json:"id" bson:"_id"`
+	TraceID    string `json:"trace_id" bson:"trace_id"`
+	Data       []byte `json:"data" bson:"data"`               // protobuf encoded span
+	ReceivedAt int64  `json:"received_at" bson:"received_at"` // milisecond
+}
+
+type PathFingerprint struct {
+	ID        uint64 `json:"id" bson:"_id"`
+	Canonical string `json:"canonical" bson:"canonical"`
+	Pending   bool   `json:"pending" bson:"pending,omitempty"` // claimed, the path is not written yet
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -15,39 +17,89 @@ import (
 	"kuroko.com/processor/internal/service"
 )
 
+var migratePathIds = flag.Bool("migrate.path-ids", false, "Rewrite stored path ids to structural fingerprints and exit")
+
 func main() {
-	client, err := qmgo.NewClient(context.Background(), &qmgo.Config{Uri: config.MONGO_URI})
+	if err := config.Load(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *config.PrintConfig {
+		if err := config.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	client, err := qmgo.NewClient(context.Background(), &qmgo.Config{Uri: *config.MongoURI})
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println("Connected to MongoDB")
-	db := client.Database(config.MONGO_DATABASE)
+	db := client.Database(*config.MongoDatabase)
+
+	s := service.NewService(db)
+
+	if flag.Arg(0) == "backfill" {
+		if err := backfill(s, flag.Args()[1:]); err != nil {
+			log.Fatalf("Failed to backfill: %v", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "rebuild-rollups" {
+		if err := rebuildRollups(s, flag.Args()[1:]); err != nil {
+			log.Fatalf("Failed to rebuild rollups: %v", err)
+		}
+		return
+	}
+
+	if *migratePathIds {
+		if err := s.MigratePathIds(context.Background()); err != nil {
+			log.Fatalf("Failed to migrate path ids: %v", err)
+		}
+		return
+	}
 
 	// Connect to NATS
-	nc, err := nats.Connect(config.NATS_URL)
+	nc, err := nats.Connect(*config.NatsURL)
 	if err != nil {
 		log.Fatalf("Failed to connect to NATS: %v", err)
 	}
 	fmt.Println("Connected to NATS")
 	defer nc.Close()
 
-	s := service.NewService(db)
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatalf("Failed to create JetStream context: %v", err)
+	}
+	if err := service.EnsureStreams(js); err != nil {
+		log.Fatalf("Failed to set up JetStream streams: %v", err)
+	}
 
-	// ---------------- http logs ----------------
-	// Simple Async Subscriber
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	_, err = nc.Subscribe("logs.http", func(m *nats.Msg) {
-		s.ReceiveNATSMsg(m)
-	})
+	// ---------------- http logs ----------------
+	// Durable pull consumer, acked after the entry is stored
+	err = s.StartConsumeHttpLog(ctx, js)
 	if err != nil {
 		fmt.Println("Failed to subscribe to NATS topic:", err)
 		log.Fatal(err)
 	}
-	ticker := s.StartTickerUpdateData(config.INTERVAL)
+	ticker := s.StartTickerUpdateData(*config.Interval)
+	rollupDone := make(chan struct{})
+	go func() {
+		s.StartRollupWriter(ctx)
+		close(rollupDone)
+	}()
 	// ---------------- http logs ----------------
 
 	// ---------------- trace data ----------------
-	go s.StartProcessTrace(nc)
+	traceDone := make(chan struct{})
+	go func() {
+		s.StartProcessTrace(ctx, js)
+		close(traceDone)
+	}()
 	// ---------------- trace data ----------------
 
 	fmt.Println("Application is running. Press Ctrl+C to exit.")
@@ -67,7 +119,7 @@ func main() {
 			// Implement custom logic on signal reception
 			if sig == syscall.SIGTERM {
 				fmt.Println("SIGTERM received, cleaning up...")
-				// Perform cleanup tasks here if needed
+				stopChan <- true
 			} else if sig == syscall.SIGINT {
 				fmt.Println("SIGINT received, gracefully shutting down...")
 				stopChan <- true
@@ -77,9 +129,48 @@ func main() {
 
 	if <-stopChan {
 		fmt.Println("Exiting the application...")
+		cancel()
+		// wait for buffered traces to be flushed before closing MongoDB
+		<-traceDone
+		<-rollupDone
+		if err := s.FlushRollups(context.Background()); err != nil {
+			log.Printf("Failed to flush rollups: %v", err)
+		}
 		ticker.Stop()
 		client.Close(context.Background())
 		time.Sleep(1 * time.Second)
 		return
 	}
 }
+
+// backfill recomputes the daily statistics of past days:
+// processor [flags] backfill --from 2024-01-01 --to 2024-01-31
+func backfill(s *service.Service, args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	from := fs.String("from", "", "First day to recompute, 2006-01-02")
+	to := fs.String("to", "", "Last day to recompute, 2006-01-02, default from")
+	fs.Parse(args)
+	if *from == "" {
+		return errors.New("--from is required")
+	}
+	if *to == "" {
+		*to = *from
+	}
+	return s.BackfillStatistics(context.Background(), *from, *to)
+}
+
+// rebuildRollups recomputes the rollups of past UTC days from the raw events:
+// processor [flags] rebuild-rollups --from 2024-01-01 --to 2024-01-31
+func rebuildRollups(s *service.Service, args []string) error {
+	fs := flag.NewFlagSet("rebuild-rollups", flag.ExitOnError)
+	from := fs.String("from", "", "First day to rebuild, 2006-01-02 in UTC")
+	to := fs.String("to", "", "Last day to rebuild, 2006-01-02 in UTC, default from")
+	fs.Parse(args)
+	if *from == "" {
+		return errors.New("--from is required")
+	}
+	if *to == "" {
+		*to = *from
+	}
+	return s.RebuildRollups(context.Background(), *from, *to)
+}